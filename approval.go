@@ -0,0 +1,443 @@
+package ud859
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Application statuses.
+const (
+	ApplicationPending  = "PENDING"
+	ApplicationApproved = "APPROVED"
+	ApplicationRejected = "REJECTED"
+	// ApplicationWaitlisted has been approved while its ticket type was full.
+	ApplicationWaitlisted = "WAITLISTED"
+)
+
+// Application is the request of a profile to register to a conference which requires
+// the approval of its organizer, its key is named after the profile and is a child
+// of the conference key. An application holds no seat until it is approved.
+type Application struct {
+	ProfileKey *datastore.Key `json:"-"`
+	Email      string         `json:"email" datastore:",noindex"`
+	Ticket     string         `json:"ticket" datastore:",noindex"`
+	Created    time.Time      `json:"created"`
+	Status     string         `json:"status" datastore:",noindex"`
+	Decided    time.Time      `json:"decided" datastore:",noindex"`
+	// Answers are given to the registration of an approved application.
+	Answers []Answer `json:"answers,omitempty" datastore:",noindex"`
+}
+
+// ApplicationForm approves or rejects the application of the user of the email.
+type ApplicationForm struct {
+	WebsafeKey string `json:"websafeConferenceKey" endpoints:"req"`
+	Email      string `json:"email" endpoints:"req"`
+}
+
+// Applications is a list of Applications.
+type Applications struct {
+	Items []*Application `json:"items"`
+}
+
+func init() {
+	subscribe("application", applicationSubscriber, EventApplicationDecided)
+}
+
+func applicationKey(c context.Context, ckey, pkey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "Application", pkey.StringID(), 0, ckey)
+}
+
+// applyConference creates the application of the current user to a conference
+// which requires approval.
+func applyConference(c context.Context, pid *identity, ckey *datastore.Key, form *RegistrationForm) error {
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		profile, err := loadProfile(c, pid)
+		if err != nil {
+			return err
+		}
+		conference, err := loadConference(c, ckey)
+		if err != nil {
+			return errBadRequest(err, "conference does not exist")
+		}
+
+		if profile.IsRegistered(conference.WebsafeKey) {
+			return errConflict("already registered")
+		}
+		now := time.Now()
+		if err := conference.checkRegistration(now); err != nil {
+			return err
+		}
+		if err := checkInvitation(c, ckey, conference, pid, form.Invitation); err != nil {
+			return err
+		}
+		ticket, err := conference.ticket(form.Ticket)
+		if err != nil {
+			return err
+		}
+		answers, err := registrationAnswers(c, ckey, form.Answers)
+		if err != nil {
+			return err
+		}
+
+		key := applicationKey(c, ckey, pid.key)
+		application := new(Application)
+		err = datastore.Get(c, key, application)
+		if err == nil && application.Status != ApplicationApproved {
+			// an approved application has been cancelled since
+			return errConflict("already applied, application is " + strings.ToLower(application.Status))
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return errInternalServer(err, "unable to get application")
+		}
+
+		application = &Application{
+			ProfileKey: pid.key,
+			Email:      pid.email,
+			Ticket:     ticket.Type,
+			Created:    now,
+			Status:     ApplicationPending,
+			Answers:    answers,
+		}
+		_, err = datastore.Put(c, key, application)
+		if err != nil {
+			return errInternalServer(err, "unable to save application")
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// GetApplication returns the application of the current user to the specified ConferenceKeyForm.
+func (ConferenceAPI) GetApplication(c context.Context, form *ConferenceKeyForm) (*Application, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+
+	application := new(Application)
+	err = datastore.Get(c, applicationKey(c, ckey, pid.key), application)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, errNotFound(fmt.Errorf("%s", form.WebsafeKey), "application not found")
+	} else if err != nil {
+		return nil, errInternalServer(err, "unable to get application")
+	}
+	return application, nil
+}
+
+// Applications returns the applications to a conference created by the current user,
+// in the order they were made.
+func (ConferenceAPI) Applications(c context.Context, form *ConferenceKeyForm) (*Applications, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return nil, errForbidden("not the organizer of the conference")
+	}
+
+	applications := make([]*Application, 0)
+	_, err = datastore.NewQuery("Application").
+		Ancestor(ckey).
+		Order("Created").
+		GetAll(c, &applications)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to query applications")
+	}
+	return &Applications{Items: applications}, nil
+}
+
+// ApproveApplication registers the applicant to a conference created by the current user,
+// the application is waitlisted when its ticket type is full: the oldest waitlisted
+// application is registered when a seat of its type is given back, or may be approved again.
+func (ConferenceAPI) ApproveApplication(c context.Context, form *ApplicationForm) (*Application, error) {
+	return decideApplication(c, form, ApplicationApproved)
+}
+
+// RejectApplication rejects an application to a conference created by the current user.
+func (ConferenceAPI) RejectApplication(c context.Context, form *ApplicationForm) (*Application, error) {
+	return decideApplication(c, form, ApplicationRejected)
+}
+
+// decideApplication approves or rejects a pending or waitlisted application,
+// and notifies the applicant.
+func decideApplication(c context.Context, form *ApplicationForm, decision string) (*Application, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return nil, errForbidden("not the organizer of the conference")
+	}
+	applicant, err := emailID(c, pid, form.Email)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid email")
+	}
+
+	var application *Application
+	var profile *Profile
+	var conference *Conference
+	var events dispatcher
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		var err error
+		conference, err = loadConference(c, ckey)
+		if err != nil {
+			return errBadRequest(err, "conference does not exist")
+		}
+
+		var key *datastore.Key
+		key, application, err = findApplication(c, ckey, applicant)
+		if err == datastore.ErrNoSuchEntity {
+			return errNotFound(fmt.Errorf("%s", form.Email), "application not found")
+		} else if err != nil {
+			return errInternalServer(err, "unable to get application")
+		}
+		// the profile of the application
+		applicant = &identity{key: application.ProfileKey, email: application.Email}
+		if application.Status != ApplicationPending && application.Status != ApplicationWaitlisted {
+			return errConflict("application is " + strings.ToLower(application.Status))
+		}
+
+		now := time.Now()
+		waitlisted := application.Status == ApplicationWaitlisted
+		application.Status, application.Decided = decision, now
+		events = newDispatcher(ckey)
+
+		if decision == ApplicationApproved {
+			if status := conference.status(); status != StatusPublished {
+				return errConflict("conference is " + strings.ToLower(status))
+			}
+			profile, err = loadProfile(c, applicant)
+			if err != nil {
+				return err
+			}
+			if profile.IsRegistered(conference.WebsafeKey) {
+				return errConflict("applicant already registered")
+			}
+
+			ticket, err := conference.ticket(application.Ticket)
+			if err != nil {
+				return err
+			}
+			if ticket.SeatsAvailable > 0 {
+				err = registerApplicant(c, ckey, conference, profile, application, events)
+				if err != nil {
+					return err
+				}
+				_, err = putConference(c, ckey, conference)
+				if err != nil {
+					return errInternalServer(err, "unable to save conference")
+				}
+			} else if waitlisted {
+				return errConflict(fmt.Sprintf("no %s seats available", strings.ToLower(ticket.Type)))
+			} else {
+				application.Status = ApplicationWaitlisted
+			}
+		}
+
+		_, err = datastore.Put(c, key, application)
+		if err != nil {
+			return errInternalServer(err, "unable to save application")
+		}
+
+		// an approved applicant is notified of its registration
+		if application.Status != ApplicationApproved {
+			events.publish(&Event{
+				Name:          EventApplicationDecided,
+				ConferenceKey: conference.WebsafeKey,
+				ProfileKey:    applicant.key.Encode(),
+				Email:         applicant.email,
+			})
+		}
+
+		err = events.save(c)
+		if err != nil {
+			return errInternalServer(err, "unable to publish event")
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the entities
+	if application.Status == ApplicationApproved {
+		cacheProfile(c, applicant.key, profile)
+		cacheConference(c, ckey, conference)
+	}
+	events.flush(c)
+	return application, nil
+}
+
+// findApplication gets the application of the applicant to a conference, or
+// datastore.ErrNoSuchEntity. The applications of the profiles named before their
+// emails were normalised are found by email.
+func findApplication(c context.Context, ckey *datastore.Key, applicant *identity) (*datastore.Key, *Application, error) {
+	key := applicationKey(c, ckey, applicant.key)
+	application := new(Application)
+	err := datastore.Get(c, key, application)
+	if err != datastore.ErrNoSuchEntity {
+		return key, application, err
+	}
+
+	var applications []*Application
+	keys, err := datastore.NewQuery("Application").Ancestor(ckey).GetAll(c, &applications)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, application := range applications {
+		if strings.EqualFold(application.Email, applicant.email) {
+			return keys[i], application, nil
+		}
+	}
+	return nil, nil, datastore.ErrNoSuchEntity
+}
+
+// registerApplicant takes a seat of the ticket type of an approved application,
+// within the transaction of the decision. The caller saves the conference.
+func registerApplicant(c context.Context, ckey *datastore.Key, conference *Conference,
+	profile *Profile, application *Application, events dispatcher) error {
+
+	if err := conference.reserve(application.Ticket); err != nil {
+		return err
+	}
+
+	if profile.Version == 0 {
+		// until its user saves it
+		profile.Pending = true
+	}
+	profile.register(conference.WebsafeKey)
+	_, err := putProfile(c, application.ProfileKey, profile)
+	if err != nil {
+		return errInternalServer(err, "unable to save profile")
+	}
+
+	registration := &Registration{
+		ProfileKey: application.ProfileKey,
+		Email:      application.Email,
+		Ticket:     application.Ticket,
+		Created:    application.Decided,
+		Status:     PaymentConfirmed,
+		Answers:    application.Answers,
+	}
+	_, err = datastore.Put(c, registrationKey(c, ckey, application.ProfileKey), registration)
+	if err != nil {
+		return errInternalServer(err, "unable to save registration")
+	}
+
+	events.publish(&Event{
+		Name:          EventRegistrationCreated,
+		ConferenceKey: conference.WebsafeKey,
+		ProfileKey:    application.ProfileKey.Encode(),
+		Email:         application.Email,
+	})
+	return nil
+}
+
+// promoteWaitlisted registers the oldest waitlisted application to a ticket type,
+// within the transaction which gives back a seat of the type. It returns the identity
+// and the profile of the applicant registered, nil when none is. The caller saves
+// the conference.
+func promoteWaitlisted(c context.Context, ckey *datastore.Key, conference *Conference,
+	typ string, now time.Time, events dispatcher) (*identity, *Profile, error) {
+
+	if err := conference.checkRegistration(now); err != nil {
+		return nil, nil, nil
+	}
+
+	var applications []*Application
+	keys, err := datastore.NewQuery("Application").
+		Ancestor(ckey).
+		Order("Created").
+		GetAll(c, &applications)
+	if err != nil {
+		return nil, nil, errInternalServer(err, "unable to query applications")
+	}
+
+	for i, application := range applications {
+		if application.Status != ApplicationWaitlisted || application.Ticket != typ {
+			continue
+		}
+		applicant := &identity{key: application.ProfileKey, email: application.Email}
+		profile, err := loadProfile(c, applicant)
+		if err != nil {
+			return nil, nil, err
+		}
+		if profile.IsRegistered(conference.WebsafeKey) {
+			continue
+		}
+
+		application.Status, application.Decided = ApplicationApproved, now
+		err = registerApplicant(c, ckey, conference, profile, application, events)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = datastore.Put(c, keys[i], application)
+		if err != nil {
+			return nil, nil, errInternalServer(err, "unable to save application")
+		}
+		return applicant, profile, nil
+	}
+	return nil, nil, nil
+}
+
+// applicationSubscriber notifies the applicant of a rejected or waitlisted application.
+func applicationSubscriber(c context.Context, e *Event) error {
+	ckey, err := datastore.DecodeKey(e.ConferenceKey)
+	if err != nil {
+		return err
+	}
+	pkey, err := datastore.DecodeKey(e.ProfileKey)
+	if err != nil {
+		return err
+	}
+	conference, err := loadConference(c, ckey)
+	if err != nil {
+		return err
+	}
+
+	application := new(Application)
+	err = datastore.Get(c, applicationKey(c, ckey, pkey), application)
+	if err != nil {
+		return err
+	}
+
+	var subject, text string
+	switch application.Status {
+	case ApplicationRejected:
+		subject = "Your registration request has been declined"
+		text = "Hi, your registration request to the following conference has been declined:\n"
+	case ApplicationWaitlisted:
+		subject = "Your registration request has been waitlisted"
+		text = "Hi, your registration request to the following conference has been approved, " +
+			"you will be registered if a seat becomes available:\n"
+	default:
+		// decided again since
+		return nil
+	}
+
+	body, err := conferenceText(conference)
+	if err != nil {
+		return err
+	}
+	// one task per decision, so that a redelivered event sends no duplicate
+	name := taskName("application", e.ConferenceKey, e.ProfileKey, application.Status,
+		application.Decided.String())
+	return sendMail(c, name, e.Email, subject, text+body)
+}
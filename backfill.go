@@ -0,0 +1,174 @@
+package ud859
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	backfillBatch = 100
+	backfillCheck = time.Minute
+)
+
+func init() {
+	http.HandleFunc("/admin/backfill_conferences", backfillHandler)
+}
+
+// backfill records the progress of the backfill of the conferences: the conferences
+// saved before the datastore answered the queries lack the properties it queries.
+type backfill struct {
+	Cursor  string    `json:"cursor" datastore:",noindex"`
+	Count   int       `json:"count" datastore:",noindex"`
+	Done    bool      `json:"done" datastore:",noindex"`
+	Updated time.Time `json:"updated" datastore:",noindex"`
+}
+
+func backfillKey(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "Backfill", "Conference", 0, nil)
+}
+
+// backfilled caches the completion of the backfill in the instance.
+var backfilled struct {
+	sync.Mutex
+	done    bool
+	checked time.Time
+}
+
+// conferencesBackfilled returns true once all the conferences have been saved
+// with the properties queried by the datastore.
+func conferencesBackfilled(c context.Context) bool {
+	backfilled.Lock()
+	defer backfilled.Unlock()
+
+	if backfilled.done || time.Since(backfilled.checked) < backfillCheck {
+		return backfilled.done
+	}
+	backfilled.checked = time.Now()
+
+	progress := new(backfill)
+	err := datastore.Get(c, backfillKey(c), progress)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "unable to get backfill: %v", err)
+	}
+	backfilled.done = progress.Done
+	return backfilled.done
+}
+
+var backfillConferencesDelay *delay.Function
+
+func init() {
+	// backfillConferences refers to backfillConferencesDelay for its continuation
+	backfillConferencesDelay = delay.Func("backfill_conferences", backfillConferences)
+}
+
+// backfillConferences saves again a batch of conferences from the cursor,
+// and chains the next batch through the task queue.
+func backfillConferences(c context.Context, cursor string) error {
+	query := datastore.NewQuery("Conference").KeysOnly().Limit(backfillBatch)
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+		query = query.Start(start)
+	}
+
+	var keys []*datastore.Key
+	it := query.Run(c)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		var conference *Conference
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			var err error
+			conference, err = loadConference(c, key)
+			if err != nil {
+				return err
+			}
+			_, err = putConference(c, key, conference)
+			return err
+		}, nil)
+		if err != nil {
+			return err
+		}
+		cacheConference(c, key, conference)
+	}
+
+	next, err := it.Cursor()
+	if err != nil {
+		return err
+	}
+
+	progress := new(backfill)
+	err = datastore.Get(c, backfillKey(c), progress)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if cursor == "" {
+		progress.Count = 0
+	}
+	progress.Cursor = next.String()
+	progress.Count += len(keys)
+	progress.Done = len(keys) < backfillBatch
+	progress.Updated = time.Now()
+
+	if _, err = datastore.Put(c, backfillKey(c), progress); err != nil {
+		return err
+	}
+
+	if !progress.Done {
+		return backfillConferencesDelay.Call(c, progress.Cursor)
+	}
+
+	backfilled.Lock()
+	backfilled.done = true
+	backfilled.Unlock()
+
+	// the cached queries may have been planned before the backfill
+	invalidateQueries(c)
+	log.Infof(c, "%d conferences backfilled", progress.Count)
+	return nil
+}
+
+// reports the progress of the backfill to the admins, or starts the backfill when posted.
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method == "POST" {
+		if err := backfillConferences(c, ""); err != nil {
+			log.Errorf(c, "could not backfill conferences: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	progress := new(backfill)
+	err := datastore.Get(c, backfillKey(c), progress)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(c, "could not get backfill: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(progress); err != nil {
+		log.Errorf(c, "could not encode backfill: %v", err)
+	}
+}
@@ -1,46 +1,369 @@
 package ud859
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
-	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
 )
 
-const keyNoFilters = "CACHE_NO_FILTERS"
+const (
+	keyGeneration = "QUERY_GENERATION"
+	keyHits       = "QUERY_HITS"
+	keyMisses     = "QUERY_MISSES"
+)
 
-var deleteCacheNoFilters = delay.Func("delete_no_filters",
-	func(c context.Context) {
-		err := memcache.Delete(c, keyNoFilters)
-		if err != nil {
-			log.Errorf(c, "unable to delete cache: %v", err)
+const (
+	cacheExpiration = 10 * time.Minute
+	lockExpiration  = 10 * time.Second
+	lockPolling     = 100 * time.Millisecond
+	lockAttempts    = 20
+)
+
+func init() {
+	http.HandleFunc("/admin/cache_stats", cacheStatsHandler)
+
+	subscribe("queries", queriesSubscriber,
+		EventConferenceCreated, EventConferenceUpdated,
+		EventRegistrationCreated, EventRegistrationCancelled)
+	subscribe("entities", entitiesSubscriber,
+		EventConferenceCreated, EventConferenceUpdated,
+		EventRegistrationCreated, EventRegistrationCancelled,
+		EventRegistrationTransferred, EventProfileSaved)
+}
+
+// cacheKey returns a canonical hash of the ConferenceQueryForm:
+// the order of the filters does not matter.
+func (q ConferenceQueryForm) cacheKey() string {
+	filters := make([]string, len(q.Filters))
+	for i, filter := range q.Filters {
+		var value string
+		switch v := filter.Value.(type) {
+		case time.Time:
+			value = v.UTC().Format(time.RFC3339)
+		case int:
+			value = strconv.Itoa(v)
+		default:
+			value = fmt.Sprintf("%v", v)
 		}
+		filters[i] = strings.Join([]string{filter.Field, filter.Op, value}, "\x00")
+	}
+	sort.Strings(filters)
+	filters = append(filters, q.Sort)
+	if q.Near != nil {
+		filters = append(filters, fmt.Sprintf("%v,%v,%v", q.Near.Latitude, q.Near.Longitude, q.Near.Radius))
+	}
+
+	sum := sha1.Sum([]byte(strings.Join(filters, "\x01")))
+	return hex.EncodeToString(sum[:])
+}
+
+// queryGeneration returns the current generation of the cached queries.
+func queryGeneration(c context.Context) (uint64, error) {
+	// the initial value makes sure that an evicted counter never reuses an old generation
+	return memcache.Increment(c, keyGeneration, 0, uint64(time.Now().UnixNano()))
+}
+
+// invalidateQueries bumps the generation of the cached queries,
+// the entries of the previous generation are left to expire.
+func invalidateQueries(c context.Context) {
+	_, err := memcache.Increment(c, keyGeneration, 1, uint64(time.Now().UnixNano()))
+	if err != nil {
+		log.Errorf(c, "unable to clear cache: %v", err)
+	}
+}
+
+// queriesSubscriber invalidates the cached queries.
+func queriesSubscriber(c context.Context, e *Event) error {
+	invalidateQueries(c)
+	return nil
+}
+
+// getCacheQuery returns the Conferences matching the ConferenceQueryForm from cache,
+// or computes them with fn and caches the result.
+func getCacheQuery(c context.Context, form *ConferenceQueryForm,
+	fn func() (*Conferences, error)) (*Conferences, error) {
+
+	generation, err := queryGeneration(c)
+	if err != nil {
+		log.Errorf(c, "unable to get cache generation: %v", err)
+		return fn()
+	}
+	key := fmt.Sprintf("QUERY:%d:%s", generation, form.cacheKey())
+
+	conferences := new(Conferences)
+	_, err = memcache.Gob.Get(c, key, conferences)
+	if err == nil {
+		countCache(c, keyHits)
+		return conferences, nil
+	} else if err != memcache.ErrCacheMiss {
+		log.Errorf(c, "unable to get cache: %v", err)
+	}
+	countCache(c, keyMisses)
+
+	return flights.do(key, func() (*Conferences, error) {
+		return fillCacheQuery(c, key, fn)
 	})
+}
+
+// fillCacheQuery computes and caches the value of a missing key.
+// Only one request computes the value, the others wait for the key to be set.
+func fillCacheQuery(c context.Context, key string,
+	fn func() (*Conferences, error)) (*Conferences, error) {
+
+	lock := &memcache.Item{
+		Key:        "LOCK:" + key,
+		Value:      []byte{},
+		Expiration: lockExpiration,
+	}
 
-var setCacheNoFilters = delay.Func("set_no_filters",
-	func(c context.Context, conferences *Conferences) {
-		item := &memcache.Item{
-			Key:        keyNoFilters,
-			Object:     conferences,
-			Expiration: 10 * time.Minute,
+	err := memcache.Add(c, lock)
+	if err == memcache.ErrNotStored {
+		// another request is computing the value
+		conferences := new(Conferences)
+		for i := 0; i < lockAttempts; i++ {
+			time.Sleep(lockPolling)
+			_, err = memcache.Gob.Get(c, key, conferences)
+			if err == nil {
+				return conferences, nil
+			}
 		}
-		err := memcache.Gob.Set(c, item)
-		if err != nil {
-			log.Errorf(c, "unable to set cache: %v", err)
+		// the other request is taking too long, or has failed
+		return fn()
+
+	} else if err != nil {
+		log.Errorf(c, "unable to lock cache: %v", err)
+		return fn()
+	}
+
+	defer func() {
+		if err := memcache.Delete(c, lock.Key); err != nil {
+			log.Errorf(c, "unable to unlock cache: %v", err)
 		}
-	})
+	}()
 
-func getCacheNoFilters(c context.Context) *Conferences {
-	conferences := new(Conferences)
-	_, err := memcache.Gob.Get(c, keyNoFilters, conferences)
+	conferences, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	if conferences.Degraded {
+		// do not keep the degraded results once the index is available again
+		return conferences, nil
+	}
+
+	item := &memcache.Item{
+		Key:        key,
+		Object:     conferences,
+		Expiration: cacheExpiration,
+	}
+	if err := memcache.Gob.Set(c, item); err != nil {
+		log.Errorf(c, "unable to set cache: %v", err)
+	}
+	return conferences, nil
+}
+
+func countCache(c context.Context, key string) {
+	_, err := memcache.Increment(c, key, 1, 0)
+	if err != nil {
+		log.Errorf(c, "unable to count cache: %v", err)
+	}
+}
+
+// flightGroup merges the concurrent computations of the same key within an instance.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	wg          sync.WaitGroup
+	conferences *Conferences
+	err         error
+}
+
+var flights = &flightGroup{calls: make(map[string]*flight)}
+
+// errFlightPanicked is returned to the waiters of a computation that panicked.
+var errFlightPanicked = errors.New("query computation panicked")
+
+func (g *flightGroup) do(key string, fn func() (*Conferences, error)) (*Conferences, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.conferences, f.err
+	}
+	f := new(flight)
+	f.wg.Add(1)
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		f.wg.Done()
+	}()
+
+	f.err = errFlightPanicked
+	f.conferences, f.err = fn()
+	return f.conferences, f.err
+}
+
+// cacheStats reports the statistics of the query cache.
+type cacheStats struct {
+	Generation uint64               `json:"generation"`
+	Hits       uint64               `json:"hits"`
+	Misses     uint64               `json:"misses"`
+	Memcache   *memcache.Statistics `json:"memcache"`
+}
+
+// reports the query cache statistics to the admins.
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	stats := new(cacheStats)
+	var err error
+
+	stats.Generation, err = queryGeneration(c)
+	if err != nil {
+		log.Errorf(c, "could not get cache generation: %v", err)
+	}
+	stats.Hits, err = memcache.Increment(c, keyHits, 0, 0)
+	if err != nil {
+		log.Errorf(c, "could not get cache hits: %v", err)
+	}
+	stats.Misses, err = memcache.Increment(c, keyMisses, 0, 0)
+	if err != nil {
+		log.Errorf(c, "could not get cache misses: %v", err)
+	}
+	stats.Memcache, err = memcache.Stats(c)
+	if err != nil {
+		log.Errorf(c, "could not get memcache statistics: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Errorf(c, "could not encode cache statistics: %v", err)
+	}
+}
+
+// versioned is implemented by the entities cached with a version stamp.
+type versioned interface {
+	version() int64
+}
+
+func (c *Conference) version() int64 { return c.Version }
+func (p *Profile) version() int64    { return p.Version }
+
+func conferenceCacheKey(key *datastore.Key) string {
+	return "Conference:" + key.Encode()
+}
+
+func profileCacheKey(key *datastore.Key) string {
+	return "Profile:" + key.Encode()
+}
+
+// getCacheEntity reads the entity from cache, it returns false on cache miss.
+func getCacheEntity(c context.Context, key string, dst versioned) bool {
+	_, err := memcache.Gob.Get(c, key, dst)
 	if err == memcache.ErrCacheMiss {
-		return nil
+		return false
 	} else if err != nil {
 		log.Errorf(c, "unable to get cache: %v", err)
-		return nil
+		return false
 	}
-	return conferences
+	return true
+}
+
+// setCacheEntity writes the entity to cache unless a newer version is already cached.
+// cached receives the entity currently cached and must be of the same type as entity.
+func setCacheEntity(c context.Context, key string, entity, cached versioned) {
+	var err error
+	for i := 0; i < 3; i++ {
+		var item *memcache.Item
+		item, err = memcache.Gob.Get(c, key, cached)
+
+		switch err {
+		case memcache.ErrCacheMiss:
+			// fails if a concurrent request has cached the entity meanwhile
+			err = memcache.Gob.Add(c, &memcache.Item{
+				Key:        key,
+				Object:     entity,
+				Expiration: cacheExpiration,
+			})
+		case nil:
+			if cached.version() >= entity.version() {
+				// never replace a newer version with an older one
+				return
+			}
+			item.Object = entity
+			item.Expiration = cacheExpiration
+			err = memcache.Gob.CompareAndSwap(c, item)
+		}
+
+		if err == nil {
+			return
+		} else if err != memcache.ErrNotStored && err != memcache.ErrCASConflict {
+			break
+		}
+	}
+
+	// the cached entity is uncertain, remove it
+	log.Errorf(c, "unable to set cache: %v", err)
+	if err := memcache.Delete(c, key); err != nil && err != memcache.ErrCacheMiss {
+		log.Errorf(c, "unable to delete cache: %v", err)
+	}
+}
+
+// entitiesSubscriber refreshes the cached entities concerned by the event.
+func entitiesSubscriber(c context.Context, e *Event) error {
+	if e.ConferenceKey != "" {
+		key, err := datastore.DecodeKey(e.ConferenceKey)
+		if err != nil {
+			return err
+		}
+		conference, err := loadConference(c, key)
+		if err != nil {
+			return err
+		}
+		cacheConference(c, key, conference)
+	}
+
+	if e.ProfileKey != "" {
+		key, err := datastore.DecodeKey(e.ProfileKey)
+		if err != nil {
+			return err
+		}
+		profile := new(Profile)
+		if err = datastore.Get(c, key, profile); err != nil {
+			return err
+		}
+		cacheProfile(c, key, profile)
+	}
+	return nil
+}
+
+// cacheConference writes through the conference once its transaction has committed.
+func cacheConference(c context.Context, key *datastore.Key, conference *Conference) {
+	setCacheEntity(c, conferenceCacheKey(key), conference, new(Conference))
+}
+
+// cacheProfile writes through the profile once its transaction has committed.
+func cacheProfile(c context.Context, key *datastore.Key, profile *Profile) {
+	setCacheEntity(c, profileCacheKey(key), profile, new(Profile))
 }
@@ -0,0 +1,33 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import "testing"
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := &flightGroup{calls: make(map[string]*flight)}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected the panic to reach the caller")
+			}
+		}()
+		g.do("key", func() (*Conferences, error) {
+			var value interface{} = 1
+			return nil, value.(error)
+		})
+	}()
+
+	if len(g.calls) != 0 {
+		t.Fatalf("got %d calls in flight, want 0", len(g.calls))
+	}
+
+	conferences, err := g.do("key", func() (*Conferences, error) {
+		return new(Conferences), nil
+	})
+	if err != nil || conferences == nil {
+		t.Errorf("got:(%v, %v), want a result", conferences, err)
+	}
+}
@@ -0,0 +1,249 @@
+package ud859
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// ticketSignatureSize is the size of the truncated HMAC-SHA256 of a ticket token,
+// kept short for the QR code.
+const ticketSignatureSize = 16
+
+// CheckInForm checks in the attendee of a ticket token at a conference.
+type CheckInForm struct {
+	WebsafeKey string `json:"websafeConferenceKey" endpoints:"req"`
+	Token      string `json:"token" endpoints:"req"`
+}
+
+// CheckIn is returned when an attendee is checked in.
+type CheckIn struct {
+	Email     string    `json:"email"`
+	Ticket    string    `json:"ticket"`
+	CheckedIn time.Time `json:"checkedIn"`
+}
+
+// TicketToken is the signed token of a registration, and its QR code PNG image.
+type TicketToken struct {
+	Token  string `json:"token"`
+	QRCode []byte `json:"qrCode"`
+}
+
+// ticketSecret is the key signing the ticket tokens, created on first use.
+type ticketSecret struct {
+	Key []byte `datastore:",noindex"`
+}
+
+var ticketKey struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+// getTicketSecret returns the key signing the ticket tokens.
+func getTicketSecret(c context.Context) ([]byte, error) {
+	ticketKey.mu.Lock()
+	defer ticketKey.mu.Unlock()
+	if ticketKey.key != nil {
+		return ticketKey.key, nil
+	}
+
+	key := datastore.NewKey(c, "Secret", "ticket", 0, nil)
+	secret := new(ticketSecret)
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		err := datastore.Get(c, key, secret)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		secret.Key = make([]byte, sha256.Size)
+		if _, err := rand.Read(secret.Key); err != nil {
+			return err
+		}
+		_, err = datastore.Put(c, key, secret)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ticketKey.key = secret.Key
+	return ticketKey.key, nil
+}
+
+// ticketSignature signs the websafeKeys of a conference and of a profile.
+func ticketSignature(secret []byte, ckey, pkey string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ckey + "\x00" + pkey))
+	return mac.Sum(nil)[:ticketSignatureSize]
+}
+
+// formatTicketToken returns the token of the profile ID with its signature.
+func formatTicketToken(id string, signature []byte) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + "." +
+		base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// parseTicketToken returns the profile ID and the signature of a token.
+func parseTicketToken(token string) (string, []byte, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("malformed token")
+	}
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(id) == 0 {
+		return "", nil, fmt.Errorf("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed token")
+	}
+	return string(id), signature, nil
+}
+
+// signTicket returns the ticket token of the registration of the profile to the conference.
+func signTicket(c context.Context, ckey, pkey *datastore.Key) (string, error) {
+	secret, err := getTicketSecret(c)
+	if err != nil {
+		return "", err
+	}
+	return formatTicketToken(pkey.StringID(), ticketSignature(secret, ckey.Encode(), pkey.Encode())), nil
+}
+
+// verifyTicket returns the key of the profile of a ticket token to the conference.
+func verifyTicket(c context.Context, ckey *datastore.Key, token string) (*datastore.Key, error) {
+	id, signature, err := parseTicketToken(token)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := getTicketSecret(c)
+	if err != nil {
+		return nil, err
+	}
+
+	pkey := datastore.NewKey(c, "Profile", id, 0, nil)
+	if !hmac.Equal(signature, ticketSignature(secret, ckey.Encode(), pkey.Encode())) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return pkey, nil
+}
+
+// GetTicketToken returns the ticket token of the current user's registration
+// to the specified ConferenceKeyForm.
+func (ConferenceAPI) GetTicketToken(c context.Context, form *ConferenceKeyForm) (*TicketToken, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+
+	if _, _, err := ticketRegistration(c, ckey, pid.key); err != nil {
+		return nil, err
+	}
+
+	token, err := signTicket(c, ckey, pid.key)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to sign ticket")
+	}
+	code, err := renderQR([]byte(token))
+	if err != nil {
+		return nil, errInternalServer(err, "unable to render ticket")
+	}
+	return &TicketToken{Token: token, QRCode: code}, nil
+}
+
+// CheckIn checks in the attendee of a ticket token at a published conference. Only its
+// organizer checks in: the staff scans the tickets at the venue signed in as the organizer.
+// A ticket is checked in once.
+func (ConferenceAPI) CheckIn(c context.Context, form *CheckInForm) (*CheckIn, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return nil, errForbidden("not the organizer of the conference")
+	}
+
+	pkey, err := verifyTicket(c, ckey, form.Token)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid ticket")
+	}
+
+	var checkIn *CheckIn
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		conference, err := loadConference(c, ckey)
+		if err != nil {
+			return errBadRequest(err, "conference does not exist")
+		}
+		if status := conference.status(); status != StatusPublished {
+			return errConflict("conference is " + strings.ToLower(status))
+		}
+
+		key, registration, err := ticketRegistration(c, ckey, pkey)
+		if err != nil {
+			return err
+		}
+		if !registration.CheckedIn.IsZero() {
+			return errConflict("already checked in at " + registration.CheckedIn.UTC().Format(time.RFC3339))
+		}
+
+		registration.CheckedIn = time.Now()
+		_, err = datastore.Put(c, key, registration)
+		if err != nil {
+			return errInternalServer(err, "unable to save registration")
+		}
+
+		checkIn = &CheckIn{
+			Email:     registration.Email,
+			Ticket:    registration.Ticket,
+			CheckedIn: registration.CheckedIn,
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil {
+		return nil, err
+	}
+	return checkIn, nil
+}
+
+// ticketRegistration gets the registration of the profile to the conference, an error
+// when it has been cancelled or transferred since its ticket has been issued.
+func ticketRegistration(c context.Context, ckey, pkey *datastore.Key) (*datastore.Key, *Registration, error) {
+	key := registrationKey(c, ckey, pkey)
+	registration := new(Registration)
+	err := datastore.Get(c, key, registration)
+	if err == datastore.ErrNoSuchEntity {
+		// the registrations made before the ticket types are in the profile only
+		profile := new(Profile)
+		err = datastore.Get(c, pkey, profile)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, nil, errInternalServer(err, "unable to get profile")
+		}
+		if !profile.IsRegistered(ckey.Encode()) {
+			return nil, nil, errConflict("not registered")
+		}
+		registration.ProfileKey, registration.Email, registration.Ticket = pkey, pkey.StringID(), TicketRegular
+	} else if err != nil {
+		return nil, nil, errInternalServer(err, "unable to get registration")
+	}
+
+	if registration.Status == PaymentPending {
+		return nil, nil, errConflict("payment pending")
+	}
+	return key, registration, nil
+}
@@ -0,0 +1,46 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTicketToken(t *testing.T) {
+	secret := []byte("secret")
+	signature := ticketSignature(secret, "conference", "profile")
+	if len(signature) != ticketSignatureSize {
+		t.Fatalf("got:%d, want:%d bytes", len(signature), ticketSignatureSize)
+	}
+
+	// the signature covers both keys and the secret
+	for _, other := range [][]byte{
+		ticketSignature(secret, "other", "profile"),
+		ticketSignature(secret, "conference", "other"),
+		ticketSignature([]byte("other"), "conference", "profile"),
+	} {
+		if bytes.Equal(signature, other) {
+			t.Errorf("got:%x, want another signature", other)
+		}
+	}
+
+	token := formatTicketToken("bob@email", signature)
+	id, parsed, err := parseTicketToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "bob@email" || !bytes.Equal(parsed, signature) {
+		t.Errorf("got:%s %x, want:bob@email %x", id, parsed, signature)
+	}
+	if _, err := encodeQR([]byte(token)); err != nil {
+		t.Errorf("got:%v, want the token in a QR code", err)
+	}
+
+	for _, token := range []string{"", "Ym9i", ".c2ln", "Ym9i.c2ln.c2ln", "Ym9i.c2ln!"} {
+		if _, _, err := parseTicketToken(token); err == nil {
+			t.Errorf("%q got:nil, want malformed", token)
+		}
+	}
+}
@@ -40,17 +40,19 @@ func cleanIndex(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		// the drafts and the private conferences are not indexed
 		conference, err := getConference(c, key)
-		if err != nil {
+		if err != nil || !conference.listed() {
 			if erd := index.Delete(c, id); erd != nil {
 				log.Errorf(c, "could not delete document %v", erd)
 			}
 			continue
 		}
 
-		if !reflect.DeepEqual(fromConferenceDoc(doc), conference) {
-			doc := fromConference(conference)
-			_, erp := index.Put(c, conference.WebsafeKey, doc)
+		// compare the documents, as the conference holds unindexed fields
+		expected := fromConference(conference)
+		if !reflect.DeepEqual(fromConference(fromConferenceDoc(doc)), expected) {
+			_, erp := index.Put(c, conference.WebsafeKey, expected)
 			if erp != nil {
 				log.Errorf(c, "could not update document %v", erp)
 			}
@@ -58,5 +60,5 @@ func cleanIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// clear cache
-	_ = deleteCacheNoFilters.Call(c)
+	invalidateQueries(c)
 }
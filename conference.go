@@ -2,34 +2,67 @@ package ud859
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
 // Conference defines a conference.
 type Conference struct {
 	WebsafeKey     string    `json:"websafeKey" datastore:"-"`
-	Name           string    `json:"name" datastore:",noindex"`
+	Name           string    `json:"name"`
 	Description    string    `json:"description" datastore:",noindex"`
 	Organizer      string    `json:"organizerDisplayName" datastore:",noindex"`
 	Topics         []string  `json:"topics" datastore:",noindex"`
 	City           string    `json:"city" datastore:",noindex"`
+	Address        string    `json:"address,omitempty" datastore:",noindex"`
+	Latitude       float64   `json:"latitude,omitempty" datastore:",noindex"`
+	Longitude      float64   `json:"longitude,omitempty" datastore:",noindex"`
 	StartDate      time.Time `json:"startDate" datastore:"START_DATE"`
 	EndDate        time.Time `json:"endDate" datastore:",noindex"`
-	Month          int       `json:"-" datastore:",noindex"`
+	Month          int       `json:"-"`
 	MaxAttendees   int       `json:"maxAttendees" datastore:",noindex"`
-	SeatsAvailable int       `json:"seatsAvailable" datastore:",noindex"`
+	SeatsAvailable int       `json:"seatsAvailable"`
+	// Tickets are the quotas of the ticket types, SeatsAvailable is their total.
+	Tickets []Ticket `json:"tickets" datastore:",noindex"`
+	// Currency is the ISO 4217 code of the ticket prices.
+	Currency string `json:"currency" datastore:",noindex"`
+	// RefundPolicy gives the refund of the cancellations, fully refunded when empty.
+	RefundPolicy []RefundRule `json:"refundPolicy" datastore:",noindex"`
+	Created      time.Time    `json:"-" datastore:"CREATED"`
+	// The registrations are open from RegistrationOpen until RegistrationClose,
+	// and may be cancelled until CancellationDeadline.
+	RegistrationOpen     time.Time `json:"registrationOpen" datastore:",noindex"`
+	RegistrationClose    time.Time `json:"registrationClose" datastore:",noindex"`
+	CancellationDeadline time.Time `json:"cancellationDeadline" datastore:",noindex"`
+	// Status is one of the conference statuses, StatusPublished when empty.
+	Status string `json:"status"`
+	// Visibility is one of the conference visibilities, VisibilityPublic when empty.
+	Visibility string `json:"visibility" datastore:",noindex"`
+	// ApprovalRequired conferences register the attendees approved by the organizer.
+	ApprovalRequired bool `json:"approvalRequired" datastore:",noindex"`
+	// Version is incremented each time the conference is saved.
+	Version int64 `json:"-" datastore:",noindex"`
+	// CityTokens are the lowercased tokens of City, for the datastore queries.
+	CityTokens []string `json:"-" datastore:"CITY"`
 }
 
 // Conferences is a list of Conferences.
 type Conferences struct {
 	Items []*Conference `json:"items"`
+	// Degraded is true when the search index was unavailable.
+	Degraded bool `json:"degraded,omitempty"`
+	// Plan is reported when the query is explained.
+	Plan *QueryPlan `json:"plan,omitempty"`
+	// Facets count the matching conferences by topic, city, month and available seats.
+	Facets []*Facet `json:"facets,omitempty"`
 }
 
 func (c Conferences) Len() int {
@@ -45,13 +78,36 @@ func (c Conferences) Less(i, j int) bool {
 
 // ConferenceForm gives details about a conference to create.
 type ConferenceForm struct {
-	Name         string   `json:"name" endpoints:"req"`
-	Description  string   `json:"description"`
-	Topics       []string `json:"topics"`
-	City         string   `json:"city"`
-	StartDate    string   `json:"startDate"`
-	EndDate      string   `json:"endDate"`
-	MaxAttendees string   `json:"maxAttendees"`
+	Name        string   `json:"name" endpoints:"req"`
+	Description string   `json:"description"`
+	Topics      []string `json:"topics"`
+	City        string   `json:"city"`
+	Address     string   `json:"address"`
+	// Latitude and Longitude of the venue, geocoded from City when omitted.
+	Latitude  string `json:"latitude"`
+	Longitude string `json:"longitude"`
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+	// RegistrationOpen defaults to the creation, RegistrationClose to the EndDate,
+	// CancellationDeadline to the StartDate.
+	RegistrationOpen     string `json:"registrationOpen"`
+	RegistrationClose    string `json:"registrationClose"`
+	CancellationDeadline string `json:"cancellationDeadline"`
+	MaxAttendees         string `json:"maxAttendees"`
+	// Tickets defaults to a regular ticket for MaxAttendees.
+	Tickets []*TicketForm `json:"tickets"`
+	// Currency of the ticket prices, defaults to USD when a ticket is not free.
+	Currency string `json:"currency"`
+	// RefundPolicy lists the refund rules in the order they end.
+	RefundPolicy []*RefundRuleForm `json:"refundPolicy"`
+	// Status is StatusDraft or StatusPublished, the default.
+	Status string `json:"status"`
+	// Visibility is VisibilityPublic, the default, VisibilityUnlisted or VisibilityInviteOnly.
+	Visibility string `json:"visibility"`
+	// ApprovalRequired is not supported with paid tickets.
+	ApprovalRequired bool `json:"approvalRequired"`
+	// Questions are asked to the attendees when they register.
+	Questions []*QuestionForm `json:"questions"`
 }
 
 // ConferenceKeyForm wraps a conference websafeKey.
@@ -74,8 +130,27 @@ func (ConferenceAPI) GetConference(c context.Context, form *ConferenceKeyForm) (
 	return getConference(c, key)
 }
 
+// getConference reads the conference from cache, or from the datastore on cache miss.
 func getConference(c context.Context, key *datastore.Key) (*Conference, error) {
-	// get the conference
+	conference := new(Conference)
+	if getCacheEntity(c, conferenceCacheKey(key), conference) {
+		conference.WebsafeKey = key.Encode()
+		return conference, nil
+	}
+
+	conference, err := loadConference(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the conference
+	cacheConference(c, key, conference)
+	return conference, nil
+}
+
+// loadConference reads the conference from the datastore.
+// Transactions must use loadConference as the cached conference may be stale.
+func loadConference(c context.Context, key *datastore.Key) (*Conference, error) {
 	conference := new(Conference)
 	err := datastore.Get(c, key, conference)
 	if err != nil {
@@ -86,6 +161,13 @@ func getConference(c context.Context, key *datastore.Key) (*Conference, error) {
 	return conference, nil
 }
 
+// putConference saves the conference in the datastore with a new version.
+func putConference(c context.Context, key *datastore.Key, conference *Conference) (*datastore.Key, error) {
+	conference.Version++
+	conference.CityTokens = tokenize(conference.City)
+	return datastore.Put(c, key, conference)
+}
+
 // CreateConference creates a Conference in the datastore from the specified ConferenceForm.
 func (ConferenceAPI) CreateConference(c context.Context, form *ConferenceForm) (*ConferenceCreated, error) {
 	pid, err := profileID(c)
@@ -98,6 +180,10 @@ func (ConferenceAPI) CreateConference(c context.Context, form *ConferenceForm) (
 	if err != nil {
 		return nil, err
 	}
+	questions, err := fromQuestionForms(form.Questions)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid questions")
+	}
 
 	// get the profile
 	profile, err := getProfile(c, pid)
@@ -105,48 +191,54 @@ func (ConferenceAPI) CreateConference(c context.Context, form *ConferenceForm) (
 		return nil, err
 	}
 	conference.Organizer = profile.DisplayName
+	// the search index keeps the milliseconds
+	conference.Created = time.Now().UTC().Truncate(time.Millisecond)
+	if conference.RegistrationOpen.IsZero() {
+		conference.RegistrationOpen = conference.Created
+	}
 
-	// incomplete conference key
-	ckey := datastore.NewIncompleteKey(c, "Conference", pid.key)
+	var ckey *datastore.Key
+	var events dispatcher
 
 	err = datastore.RunInTransaction(c, func(c context.Context) error {
 		// save the conference
-		key, err := datastore.Put(c, ckey, conference)
+		conference.Version = 0
+		key, err := putConference(c, datastore.NewIncompleteKey(c, "Conference", pid.key), conference)
 		if err != nil {
 			return errInternalServer(err, "unable to create conference")
 		}
+		ckey = key
 		conference.WebsafeKey = key.Encode()
 
-		// create indexation task
-		err = indexConference(c, conference)
+		err = putQuestions(c, key, questions)
 		if err != nil {
-			return errInternalServer(err, "unable to index conference")
+			return errInternalServer(err, "unable to save questions")
 		}
-		return nil
-	}, nil)
 
-	if err != nil {
-		return nil, err
-	}
+		// publish the event
+		events = newDispatcher(key)
+		events.publish(&Event{
+			Name:          EventConferenceCreated,
+			ConferenceKey: conference.WebsafeKey,
+			ProfileKey:    pid.key.Encode(),
+			Email:         profile.Email,
+		})
 
-	// body of the confirmation email
-	body, err := conferenceText(conference)
-	if err != nil {
-		log.Errorf(c, "unable to create conference email: %v", err)
-	} else {
-		// create confirmation task
-		err = sendConfirmation(c, profile.Email, body)
+		err = events.save(c)
 		if err != nil {
-			log.Errorf(c, "unable to send conference email: %v", err)
+			return errInternalServer(err, "unable to publish event")
 		}
-	}
+		return nil
+	}, nil)
 
-	// clear cache
-	err = deleteCacheNoFilters.Call(c)
 	if err != nil {
-		log.Errorf(c, "unable to clear cache: %v", err)
+		return nil, err
 	}
 
+	// cache the conference
+	cacheConference(c, ckey, conference)
+	events.flush(c)
+
 	return &ConferenceCreated{
 		Name:       conference.Name,
 		WebsafeKey: conference.WebsafeKey,
@@ -178,6 +270,27 @@ func fromConferenceForm(form *ConferenceForm) (*Conference, error) {
 		}
 	}
 
+	window := make([]time.Time, 3)
+	for i, value := range []string{form.RegistrationOpen, form.RegistrationClose, form.CancellationDeadline} {
+		if value == "" {
+			continue
+		}
+		window[i], err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errBadRequest(err, "unable to parse registration window")
+		}
+	}
+	registrationOpen, registrationClose, cancellationDeadline := window[0], window[1], window[2]
+	if registrationClose.IsZero() {
+		registrationClose = endDate
+	}
+	if cancellationDeadline.IsZero() {
+		cancellationDeadline = startDate
+	}
+	if !registrationOpen.IsZero() && !registrationClose.IsZero() && !registrationOpen.Before(registrationClose) {
+		return nil, errBadRequest(fmt.Errorf("%v", registrationClose), "registration closes before it opens")
+	}
+
 	if form.MaxAttendees != "" {
 		attendees, err = strconv.Atoi(form.MaxAttendees)
 		if err != nil {
@@ -185,16 +298,91 @@ func fromConferenceForm(form *ConferenceForm) (*Conference, error) {
 		}
 	}
 
+	tickets, err := fromTicketForms(form.Tickets, attendees)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid tickets")
+	}
+	capacity, paid := 0, false
+	for _, ticket := range tickets {
+		capacity += ticket.Capacity
+		paid = paid || ticket.Price > 0
+	}
+	if attendees == 0 {
+		attendees = capacity
+	}
+
+	currency := strings.ToUpper(form.Currency)
+	if currency == "" && paid {
+		currency = defaultCurrency
+	} else if currency != "" && !validCurrency(currency) {
+		return nil, errBadRequest(fmt.Errorf("%q", form.Currency), "invalid currency")
+	}
+
+	if form.ApprovalRequired && paid {
+		return nil, errBadRequest(fmt.Errorf("paid tickets"), "approval is not supported with paid tickets")
+	}
+
+	policy, err := fromRefundRuleForms(form.RefundPolicy)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid refund policy")
+	}
+
+	status := form.Status
+	if status == "" {
+		status = StatusPublished
+	} else if status != StatusDraft && status != StatusPublished {
+		return nil, errBadRequest(fmt.Errorf("%q", status), "invalid status")
+	}
+
+	visibility := form.Visibility
+	if visibility == "" {
+		visibility = VisibilityPublic
+	} else if !validVisibility(visibility) {
+		return nil, errBadRequest(fmt.Errorf("%q", visibility), "invalid visibility")
+	}
+
+	var location appengine.GeoPoint
+	if form.Latitude != "" || form.Longitude != "" {
+		location.Lat, err = strconv.ParseFloat(form.Latitude, 64)
+		if err != nil {
+			return nil, errBadRequest(err, "unable to parse latitude")
+		}
+		location.Lng, err = strconv.ParseFloat(form.Longitude, 64)
+		if err != nil {
+			return nil, errBadRequest(err, "unable to parse longitude")
+		}
+		if !location.Valid() {
+			return nil, errBadRequest(fmt.Errorf("%v", location), "invalid location")
+		}
+	} else {
+		location, _ = geocode(form.City)
+	}
+
 	return &Conference{
-		Name:           form.Name,
-		Description:    form.Description,
-		Topics:         form.Topics,
-		City:           form.City,
-		StartDate:      startDate,
-		EndDate:        endDate,
-		Month:          month,
+		Name:        form.Name,
+		Description: form.Description,
+		Topics:      form.Topics,
+		City:        form.City,
+		Address:     form.Address,
+		Latitude:    location.Lat,
+		Longitude:   location.Lng,
+		StartDate:   startDate,
+		EndDate:     endDate,
+		Month:       month,
+
+		RegistrationOpen:     registrationOpen,
+		RegistrationClose:    registrationClose,
+		CancellationDeadline: cancellationDeadline,
+
 		MaxAttendees:   attendees,
 		SeatsAvailable: attendees,
+		Tickets:        tickets,
+		Currency:       currency,
+		RefundPolicy:   policy,
+		Status:         status,
+		Visibility:     visibility,
+
+		ApprovalRequired: form.ApprovalRequired,
 	}, nil
 }
 
@@ -0,0 +1,143 @@
+package ud859
+
+import (
+	"encoding/json"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Domain events.
+const (
+	EventConferenceCreated     = "ConferenceCreated"
+	EventConferenceUpdated     = "ConferenceUpdated"
+	EventConferenceCancelled   = "ConferenceCancelled"
+	EventRegistrationCreated   = "RegistrationCreated"
+	EventRegistrationCancelled = "RegistrationCancelled"
+	EventProfileSaved          = "ProfileSaved"
+	// EventRegistrationTransferred is published with the Recipient of the registration.
+	EventRegistrationTransferred = "RegistrationTransferred"
+	// EventInvitationIssued is published with the Recipient of the invitation.
+	EventInvitationIssued = "InvitationIssued"
+	// EventApplicationDecided is published when an application is rejected or waitlisted.
+	EventApplicationDecided = "ApplicationDecided"
+)
+
+// Event describes a change committed by the ConferenceAPI.
+type Event struct {
+	Name string `json:"name"`
+	// ConferenceKey is the websafeKey of the conference concerned by the event.
+	ConferenceKey string `json:"conferenceKey,omitempty"`
+	// ProfileKey is the websafeKey of the profile that has made the change.
+	ProfileKey string    `json:"profileKey,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	Time       time.Time `json:"time"`
+	// Recipient is the email of the user receiving a transferred registration,
+	// RecipientKey the websafeKey of its profile.
+	Recipient    string `json:"recipient,omitempty"`
+	RecipientKey string `json:"recipientKey,omitempty"`
+}
+
+// subscriber is notified of the events it has subscribed to.
+// An event may be delivered more than once, a subscriber must be idempotent.
+type subscriber func(c context.Context, e *Event) error
+
+type subscription struct {
+	name   string
+	events []string
+	fn     subscriber
+}
+
+var subscriptions []*subscription
+
+// subscribe registers the subscriber fn under name for the specified events,
+// it must be called at init time.
+func subscribe(name string, fn subscriber, events ...string) {
+	subscriptions = append(subscriptions, &subscription{name, events, fn})
+
+	// deliver the events through the outbox
+	outboxActions[subscriptionAction(name)] = func(c context.Context, payload []byte) error {
+		e := new(Event)
+		if err := json.Unmarshal(payload, e); err != nil {
+			return err
+		}
+		return fn(c, e)
+	}
+}
+
+func subscriptionAction(name string) string {
+	return "event:" + name
+}
+
+func (s *subscription) accepts(name string) bool {
+	for _, event := range s.events {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatcher delivers the events published by a business change to the subscribers.
+type dispatcher interface {
+	// publish records an event.
+	publish(e *Event)
+	// save must be called within the transaction of the change.
+	save(c context.Context) error
+	// flush must be called once the transaction has committed.
+	flush(c context.Context)
+}
+
+// newDispatcher returns the dispatcher of a change to the entity group of parent,
+// the tests may replace it to deliver the events without delay.
+var newDispatcher = func(parent *datastore.Key) dispatcher {
+	return &outboxDispatcher{newOutbox(parent)}
+}
+
+// outboxDispatcher delivers the events with an outbox entry per subscriber,
+// so that a failing subscriber is retried on its own.
+type outboxDispatcher struct {
+	*outbox
+}
+
+func (d *outboxDispatcher) publish(e *Event) {
+	e.Time = time.Now()
+	for _, s := range subscriptions {
+		if s.accepts(e.Name) {
+			d.add(subscriptionAction(s.name), e)
+		}
+	}
+}
+
+func (d *outboxDispatcher) flush(c context.Context) {}
+
+// syncDispatcher delivers the events in memory once the transaction has committed.
+type syncDispatcher struct {
+	events []*Event
+}
+
+func (d *syncDispatcher) publish(e *Event) {
+	e.Time = time.Now()
+	d.events = append(d.events, e)
+}
+
+func (d *syncDispatcher) save(c context.Context) error {
+	return nil
+}
+
+func (d *syncDispatcher) flush(c context.Context) {
+	for _, e := range d.events {
+		for _, s := range subscriptions {
+			if !s.accepts(e.Name) {
+				continue
+			}
+			if err := s.fn(c, e); err != nil {
+				log.Errorf(c, "subscriber %s failed on %s: %v", s.name, e.Name, err)
+			}
+		}
+	}
+	d.events = nil
+}
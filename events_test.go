@@ -0,0 +1,89 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func init() {
+	// the API tests expect the events to be delivered without delay
+	newDispatcher = func(parent *datastore.Key) dispatcher {
+		return new(syncDispatcher)
+	}
+}
+
+func TestOutboxDispatcher(t *testing.T) {
+	ot := newOutboxTest(t)
+	defer ot.close()
+
+	failing, healthy := new(testAction), new(testAction)
+	failing.failures = 1
+
+	saved := subscriptions
+	subscriptions = nil
+	subscribe("failing", func(c context.Context, e *Event) error {
+		return failing.perform(c, []byte(e.Name))
+	}, "TestEvent")
+	subscribe("healthy", func(c context.Context, e *Event) error {
+		return healthy.perform(c, []byte(e.Name))
+	}, "TestEvent", "OtherEvent")
+	defer func() {
+		subscriptions = saved
+		delete(outboxActions, subscriptionAction("failing"))
+		delete(outboxActions, subscriptionAction("healthy"))
+	}()
+
+	err := datastore.RunInTransaction(ot.c, func(c context.Context) error {
+		events := &outboxDispatcher{newOutbox(ot.parent)}
+		events.publish(&Event{Name: "TestEvent"})
+		return events.save(c)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an entry per subscriber
+	var entries []*outboxEntry
+	keys, err := datastore.NewQuery("Outbox").Ancestor(ot.parent).GetAll(ot.c, &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d outbox entries, want 2", len(keys))
+	}
+
+	// the failing subscriber does not block the healthy one
+	dispatchOutbox(ot.c, encodeKeys(keys))
+	if failing.calls != 1 || len(failing.payloads) != 0 {
+		t.Errorf("unexpected failing subscriber %+v", failing)
+	}
+	if healthy.calls != 1 || len(healthy.payloads) != 1 {
+		t.Errorf("unexpected healthy subscriber %+v", healthy)
+	}
+
+	var pending []*outboxEntry
+	keys, err = datastore.NewQuery("Outbox").Ancestor(ot.parent).GetAll(ot.c, &pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Action != subscriptionAction("failing") || pending[0].Attempts != 1 {
+		t.Fatalf("unexpected pending entries %+v", pending)
+	}
+
+	// the failing subscriber is retried on its own
+	ot.clock.advance(outboxMaxBackoff)
+	dispatchOutbox(ot.c, encodeKeys(keys))
+	if failing.calls != 2 || len(failing.payloads) != 1 || failing.payloads[0] != "TestEvent" {
+		t.Errorf("unexpected failing subscriber %+v", failing)
+	}
+	if healthy.calls != 1 {
+		t.Errorf("got %d calls to the healthy subscriber, want 1", healthy.calls)
+	}
+	ot.deleted(t, keys[0])
+}
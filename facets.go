@@ -0,0 +1,163 @@
+package ud859
+
+import (
+	"sort"
+	"strconv"
+
+	"google.golang.org/appengine/search"
+)
+
+// Facet counts the conferences by value of a field.
+type Facet struct {
+	Name   string        `json:"name"`
+	Values []*FacetValue `json:"values"`
+}
+
+// FacetValue is the number of conferences having a value.
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// seatsBuckets are the ranges of available seats.
+var seatsBuckets = []struct {
+	label string
+	rng   search.Range
+}{
+	{"0", search.Range{Start: 0, End: 1}},
+	{"1-9", search.Range{Start: 1, End: 10}},
+	{"10-99", search.Range{Start: 10, End: 100}},
+	{"100+", search.AtLeast(100)},
+}
+
+func seatsBucket(seats int) string {
+	for _, bucket := range seatsBuckets {
+		if float64(seats) >= bucket.rng.Start && float64(seats) < bucket.rng.End {
+			return bucket.label
+		}
+	}
+	return ""
+}
+
+// facets returns the facets of the document: a facet per topic, so that the counts are exact.
+func (doc *conferenceDoc) facets() []search.Facet {
+	facets := make([]search.Facet, 0, len(doc.topics)+3)
+	seen := make(map[string]bool)
+	for _, topic := range doc.topics {
+		if topic != "" && !seen[topic] {
+			seen[topic] = true
+			facets = append(facets, search.Facet{Name: Topics, Value: search.Atom(topic)})
+		}
+	}
+	if doc.City != "" {
+		facets = append(facets, search.Facet{Name: City, Value: search.Atom(doc.City)})
+	}
+	facets = append(facets,
+		search.Facet{Name: Month, Value: search.Atom(strconv.Itoa(int(doc.Month)))},
+		search.Facet{Name: SeatsAvailable, Value: doc.SeatsAvailable})
+	return facets
+}
+
+// facetOptions requests the facets counts to the search index.
+func facetOptions() []search.FacetSearchOption {
+	ranges := make([]interface{}, len(seatsBuckets))
+	for i, bucket := range seatsBuckets {
+		ranges[i] = bucket.rng
+	}
+	return []search.FacetSearchOption{
+		search.FacetDiscovery(Topics),
+		search.FacetDiscovery(City),
+		search.FacetDiscovery(Month),
+		search.FacetDiscovery(SeatsAvailable, ranges...),
+	}
+}
+
+// fromFacetResults converts the facets counted by the search index.
+func fromFacetResults(results [][]search.FacetResult) []*Facet {
+	var facets []*Facet
+	for _, result := range results {
+		if len(result) == 0 {
+			continue
+		}
+
+		facet := &Facet{Name: result[0].Name}
+		for _, r := range result {
+			var value string
+			switch v := r.Value.(type) {
+			case search.Atom:
+				value = string(v)
+			case search.Range:
+				for _, bucket := range seatsBuckets {
+					if bucket.rng == v {
+						value = bucket.label
+					}
+				}
+			}
+			if value != "" && r.Count > 0 {
+				facet.Values = append(facet.Values, &FacetValue{value, r.Count})
+			}
+		}
+		sort.Sort(facetValues(facet.Values))
+		facets = append(facets, facet)
+	}
+	sort.Sort(facetsByName(facets))
+	return facets
+}
+
+// countFacets counts the facets of the conferences, like the search index does.
+func countFacets(conferences []*Conference) []*Facet {
+	counts := map[string]map[string]int{
+		Topics:         {},
+		City:           {},
+		Month:          {},
+		SeatsAvailable: {},
+	}
+
+	for _, conference := range conferences {
+		topics := make(map[string]bool)
+		for _, topic := range conference.Topics {
+			if topic != "" && !topics[topic] {
+				topics[topic] = true
+				counts[Topics][topic]++
+			}
+		}
+		if conference.City != "" {
+			counts[City][conference.City]++
+		}
+		counts[Month][strconv.Itoa(int(conference.StartDate.Month()))]++
+		counts[SeatsAvailable][seatsBucket(conference.SeatsAvailable)]++
+	}
+
+	var facets []*Facet
+	for name, values := range counts {
+		facet := &Facet{Name: name}
+		for value, count := range values {
+			facet.Values = append(facet.Values, &FacetValue{value, count})
+		}
+		sort.Sort(facetValues(facet.Values))
+		if len(facet.Values) > 0 {
+			facets = append(facets, facet)
+		}
+	}
+	sort.Sort(facetsByName(facets))
+	return facets
+}
+
+// facetValues sorts the values by count, the most frequent first.
+type facetValues []*FacetValue
+
+func (v facetValues) Len() int      { return len(v) }
+func (v facetValues) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v facetValues) Less(i, j int) bool {
+	if v[i].Count != v[j].Count {
+		return v[i].Count > v[j].Count
+	}
+	return v[i].Value < v[j].Value
+}
+
+// facetsByName sorts the facets by name.
+type facetsByName []*Facet
+
+func (f facetsByName) Len() int           { return len(f) }
+func (f facetsByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f facetsByName) Less(i, j int) bool { return f[i].Name < f[j].Name }
@@ -0,0 +1,262 @@
+package ud859
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	searchTimeout    = 5 * time.Second
+	breakerThreshold = 3
+	breakerCooldown  = time.Minute
+)
+
+// breaker stops calling a failing service for a while.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	threshold int
+	cooldown  time.Duration
+}
+
+var searchBreaker = &breaker{
+	threshold: breakerThreshold,
+	cooldown:  breakerCooldown,
+}
+
+// allow returns false while the breaker is open. Once the cooldown has elapsed,
+// a call is allowed and another failure opens the breaker again.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.openUntil)
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// filterConferences evaluates the filters of the ConferenceQueryForm against
+// the conferences of the datastore, when the search index is unavailable.
+func filterConferences(c context.Context, form *ConferenceQueryForm) (*Conferences, error) {
+	if err := form.unsupported(); err != nil {
+		return nil, errServiceUnavailable(err, "search index unavailable")
+	}
+
+	by := form.Sort
+	if form.order().backfill && !conferencesBackfilled(c) {
+		// the older conferences lack the property of the order
+		by = SortStartDate
+	}
+
+	all, err := datastoreConferences(c, &ConferenceQueryForm{Sort: by})
+	if err != nil {
+		return nil, err
+	}
+
+	conferences := &Conferences{
+		Degraded: true,
+		Plan:     &QueryPlan{BackendDatastore, "search index unavailable"},
+	}
+	for _, conference := range all.Items {
+		if form.match(conference) {
+			conferences.Items = append(conferences.Items, conference)
+		}
+	}
+	if form.order().distance {
+		// the datastore does not know the distance
+		sort.Stable(byDistance{conferences.Items, form.Near})
+	}
+	conferences.Facets = countFacets(conferences.Items)
+	return conferences, nil
+}
+
+// unsupported returns an error if a filter cannot be evaluated without the search index.
+func (q ConferenceQueryForm) unsupported() error {
+	for _, filter := range q.Filters {
+		if _, _, isTicket := ticketField(filter.Field); isTicket {
+			continue
+		}
+		switch filter.Field {
+		case Key, Name, Description, Organizer, City, Topics, Text,
+			Month, MaxAttendees, SeatsAvailable, StartDate, EndDate, Created, Status,
+			RegistrationOpen, RegistrationClose, CancellationDeadline:
+			continue
+		}
+		return fmt.Errorf("filter on %s is unsupported in fallback", filter.Field)
+	}
+	return nil
+}
+
+// match returns true if the conference satisfies all the filters.
+func (q ConferenceQueryForm) match(conference *Conference) bool {
+	if q.Near != nil && !q.Near.match(conference) {
+		return false
+	}
+	for _, filter := range q.Filters {
+		if !filter.match(conference) {
+			return false
+		}
+	}
+	return true
+}
+
+// match evaluates the filter like the search index does.
+func (f *Filter) match(conference *Conference) bool {
+	var ok bool
+	if typ, capacity, isTicket := ticketField(f.Field); isTicket {
+		for _, ticket := range conference.tickets() {
+			if ticket.Type == typ && capacity {
+				return compareInt(ticket.Capacity, f.Op, f.Value)
+			} else if ticket.Type == typ {
+				return compareInt(ticket.SeatsAvailable, f.Op, f.Value)
+			}
+		}
+		// the ticket type is not offered
+		return compareInt(0, f.Op, f.Value)
+	}
+
+	switch f.Field {
+	case Key:
+		ok = conference.WebsafeKey == f.Value
+	case Name:
+		ok = matchText(conference.Name, f.Value)
+	case Description:
+		ok = matchText(conference.Description, f.Value)
+	case Organizer:
+		ok = matchText(conference.Organizer, f.Value)
+	case City:
+		ok = matchText(conference.City, f.Value)
+	case Topics:
+		ok = matchText(strings.Join(conference.Topics, " "), f.Value)
+	case Text:
+		ok = matchPhrase(conference, f.Value)
+	case Month:
+		return compareInt(int(conference.StartDate.Month()), f.Op, f.Value)
+	case MaxAttendees:
+		return compareInt(conference.MaxAttendees, f.Op, f.Value)
+	case SeatsAvailable:
+		return compareInt(conference.SeatsAvailable, f.Op, f.Value)
+	case StartDate:
+		return compareDate(conference.StartDate, f.Op, f.Value)
+	case EndDate:
+		return compareDate(conference.EndDate, f.Op, f.Value)
+	case Created:
+		return compareDate(conference.Created, f.Op, f.Value)
+	case Status:
+		ok = conference.status() == f.Value
+	case RegistrationOpen, RegistrationClose, CancellationDeadline:
+		open, close, deadline := conference.registrationWindow()
+		window := map[string]time.Time{
+			RegistrationOpen:     open,
+			RegistrationClose:    close,
+			CancellationDeadline: deadline,
+		}
+		return compareDate(window[f.Field], f.Op, f.Value)
+	}
+
+	if f.Op == NE {
+		return !ok
+	}
+	return ok
+}
+
+// matchText returns true if all the tokens of value are tokens of text.
+func matchText(text string, value interface{}) bool {
+	v, ok := value.(string)
+	if !ok {
+		return false
+	}
+
+	tokens := make(map[string]bool)
+	for _, token := range tokenize(text) {
+		tokens[token] = true
+	}
+	for _, token := range tokenize(v) {
+		if !tokens[token] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPhrase returns true if the tokens of value follow each other in a field of the conference.
+func matchPhrase(conference *Conference, value interface{}) bool {
+	v, ok := value.(string)
+	if !ok {
+		return false
+	}
+	phrase := " " + strings.Join(tokenize(v), " ") + " "
+
+	fields := []string{
+		conference.Name, conference.Description, conference.Organizer,
+		strings.Join(conference.Topics, " "), conference.City,
+	}
+	for _, field := range fields {
+		if strings.Contains(" "+strings.Join(tokenize(field), " ")+" ", phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func compareInt(field int, op string, value interface{}) bool {
+	v, ok := value.(int)
+	if !ok {
+		return false
+	}
+	return compare(field-v, op)
+}
+
+// compareDate compares the dates with the precision of the search index: the day.
+func compareDate(field time.Time, op string, value interface{}) bool {
+	v, ok := value.(time.Time)
+	if !ok {
+		return false
+	}
+	const layout = "2006-01-02"
+	return compare(strings.Compare(field.UTC().Format(layout), v.UTC().Format(layout)), op)
+}
+
+// compare applies the operator to the result of a comparison.
+func compare(cmp int, op string) bool {
+	switch op {
+	case EQ:
+		return cmp == 0
+	case LT:
+		return cmp < 0
+	case GT:
+		return cmp > 0
+	case LTE:
+		return cmp <= 0
+	case GTE:
+		return cmp >= 0
+	case NE:
+		return cmp != 0
+	}
+	return false
+}
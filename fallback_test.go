@@ -0,0 +1,235 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestFilterMatch(t *testing.T) {
+	conferences := []*Conference{
+		{
+			WebsafeKey:     "gophercon",
+			Name:           "gophercon",
+			Description:    "The largest event in the world dedicated to the Go programming language",
+			Organizer:      "Gopher Academy",
+			Topics:         []string{"Programming", "Go", "Mountain"},
+			City:           "Denver, Colorado",
+			StartDate:      time.Date(2016, 7, 11, 23, 0, 0, 0, time.UTC),
+			EndDate:        time.Date(2016, 7, 13, 23, 0, 0, 0, time.UTC),
+			MaxAttendees:   10,
+			SeatsAvailable: 10,
+		},
+		{
+			WebsafeKey:     "dotGo",
+			Name:           "dotGo",
+			Description:    "The European Go conference",
+			Organizer:      "dotConferences",
+			Topics:         []string{"Programming", "Go"},
+			City:           "Paris",
+			StartDate:      time.Date(2016, 10, 10, 23, 0, 0, 0, time.UTC),
+			EndDate:        time.Date(2016, 10, 10, 23, 0, 0, 0, time.UTC),
+			MaxAttendees:   1,
+			SeatsAvailable: 1,
+		},
+	}
+
+	type r struct {
+		Field string      `json:"field"`
+		Op    string      `json:"operator"`
+		Value interface{} `json:"value"`
+	}
+
+	tts := []struct {
+		restrictions []r
+		expected     int
+	}{
+		{[]r{{"KEY", EQ, "dotGo"}}, 1},
+		{[]r{{Name, EQ, "dotGo"}}, 1},
+		{[]r{{Name, NE, "dotGo"}}, 1},
+		{[]r{{Name, EQ, "Denver"}}, 0},
+		{[]r{{Description, EQ, "go language"}}, 1},
+		{[]r{{Description, NE, "european"}}, 1},
+		{[]r{{Description, EQ, "Go"}}, 2},
+		{[]r{{Organizer, EQ, "gopher academy"}}, 1},
+		{[]r{{Organizer, NE, "dotConferences"}}, 1},
+		{[]r{{City, EQ, "denver"}}, 1},
+		{[]r{{City, NE, "Denver, Colorado"}}, 1},
+		{[]r{{City, NE, "London"}}, 2},
+		{[]r{{Topics, EQ, "Go Programming"}}, 2},
+		{[]r{{Topics, NE, "Mountain"}}, 1},
+		{[]r{{MaxAttendees, GT, 1}}, 1},
+		{[]r{{MaxAttendees, LTE, 10}}, 2},
+		{[]r{{Month, NE, 7}}, 1},
+		{[]r{{Month, LT, 3}}, 0},
+		{[]r{{SeatsAvailable, GTE, "1"}}, 2},
+		{[]r{{StartDate, GTE, "2016-10-01T23:00:00Z"},
+			{StartDate, LTE, "2016-10-31T23:00:00Z"}}, 1},
+		{[]r{{StartDate, GTE, "2016-10-10T00:00:00Z"}}, 1},
+		{[]r{{City, EQ, "Paris"},
+			{Topics, EQ, "Go"},
+			{StartDate, GT, "2016-11-01T23:00:00Z"}}, 0},
+	}
+
+	for _, tt := range tts {
+		form := new(ConferenceQueryForm)
+		for _, r := range tt.restrictions {
+			data, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter := new(Filter)
+			if err = filter.UnmarshalJSON(data); err != nil {
+				t.Fatal(err)
+			}
+			form.Filters = append(form.Filters, filter)
+		}
+
+		var count int
+		for _, conference := range conferences {
+			if form.match(conference) {
+				count++
+			}
+		}
+		if count != tt.expected {
+			t.Errorf("%v got:%d, want:%d", tt.restrictions, count, tt.expected)
+		}
+	}
+}
+
+func TestFallbackUnsupported(t *testing.T) {
+	form := new(ConferenceQueryForm).
+		Filter(Description, EQ, "go").
+		Filter(Organizer, NE, "bob").
+		Filter("SEATS_STUDENT", GT, 0)
+	if err := form.unsupported(); err != nil {
+		t.Errorf("got:%v, want:nil", err)
+	}
+
+	for _, field := range []string{"PRICE_REGULAR", "CURRENCY", "NAME_PREFIX"} {
+		form := new(ConferenceQueryForm).Filter(field, EQ, 1)
+		if err := form.unsupported(); err == nil {
+			t.Errorf("%s: want an error", field)
+		}
+	}
+}
+
+func TestSearchUnavailable(t *testing.T) {
+	tts := []struct {
+		err         error
+		unavailable bool
+	}{
+		{context.DeadlineExceeded, true},
+		{errors.New("search: TRANSIENT_ERROR: try again"), true},
+		{errors.New("search: INTERNAL_ERROR: failure"), true},
+		{errors.New("search: TIMEOUT: deadline"), true},
+		{errors.New("service unavailable"), true},
+		{errors.New("search: INVALID_REQUEST: Failed to parse search request"), false},
+		{errors.New("search: PERMISSION_DENIED: denied"), false},
+	}
+
+	for _, tt := range tts {
+		if got := searchUnavailable(tt.err); got != tt.unavailable {
+			t.Errorf("%v got:%t, want:%t", tt.err, got, tt.unavailable)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{threshold: 2, cooldown: time.Hour}
+
+	b.failure()
+	if !b.allow() {
+		t.Fatal("breaker should be closed")
+	}
+	b.success()
+	b.failure()
+	if !b.allow() {
+		t.Fatal("breaker should be closed after a success")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("breaker should be open")
+	}
+
+	b.openUntil = time.Now()
+	if !b.allow() {
+		t.Fatal("breaker should allow a call after the cooldown")
+	}
+}
+
+func TestCountFacets(t *testing.T) {
+	conferences := []*Conference{
+		{Topics: []string{"Go", "Go", "Web"}, City: "Paris", StartDate: time.Date(2016, 10, 10, 0, 0, 0, 0, time.UTC), SeatsAvailable: 0},
+		{Topics: []string{"Go"}, City: "Paris", StartDate: time.Date(2016, 10, 20, 0, 0, 0, 0, time.UTC), SeatsAvailable: 150},
+		{Topics: []string{"Web"}, StartDate: time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC), SeatsAvailable: 9},
+	}
+
+	expected := map[string][]FacetValue{
+		City:           {{"Paris", 2}},
+		Month:          {{"10", 2}, {"7", 1}},
+		SeatsAvailable: {{"0", 1}, {"1-9", 1}, {"100+", 1}},
+		Topics:         {{"Go", 2}, {"Web", 2}},
+	}
+
+	facets := countFacets(conferences)
+	if len(facets) != len(expected) {
+		t.Fatalf("got:%d facets, want:%d", len(facets), len(expected))
+	}
+	for _, facet := range facets {
+		want := expected[facet.Name]
+		if len(facet.Values) != len(want) {
+			t.Errorf("%s got:%d values, want:%d", facet.Name, len(facet.Values), len(want))
+			continue
+		}
+		for i, value := range facet.Values {
+			if *value != want[i] {
+				t.Errorf("%s got:%v, want:%v", facet.Name, *value, want[i])
+			}
+		}
+	}
+}
+
+func TestNearMatch(t *testing.T) {
+	paris, _ := geocode("Paris")
+	denver, _ := geocode("Denver, Colorado")
+	conferences := []*Conference{
+		{Name: "dotGo", Latitude: paris.Lat, Longitude: paris.Lng},
+		{Name: "gophercon", Latitude: denver.Lat, Longitude: denver.Lng},
+		{Name: "unknown"},
+	}
+
+	tts := []struct {
+		near     Near
+		expected []string
+	}{
+		{Near{City: "Lyon", Radius: 400}, []string{"dotGo"}},
+		{Near{City: "Lyon", Radius: 380}, nil},
+		{Near{Latitude: 40.015, Longitude: -105.2705, Radius: 100}, []string{"gophercon"}},
+		{Near{City: "London", Radius: 10000}, []string{"dotGo", "gophercon"}},
+	}
+
+	for _, tt := range tts {
+		near := tt.near
+		if err := near.normalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, conference := range conferences {
+			if near.match(conference) {
+				names = append(names, conference.Name)
+			}
+		}
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("%v got:%v, want:%v", tt.near, names, tt.expected)
+		}
+	}
+}
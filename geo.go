@@ -0,0 +1,145 @@
+package ud859
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"google.golang.org/appengine"
+)
+
+// Location is the field of the venue location in the conferenceDoc.
+const Location = "LOCATION"
+
+// earthRadius is the mean radius of the earth in meters.
+const earthRadius = 6371e3
+
+// cities is an offline geocoding table of common conference cities.
+var cities = map[string]appengine.GeoPoint{
+	"amsterdam":     {Lat: 52.3676, Lng: 4.9041},
+	"austin":        {Lat: 30.2672, Lng: -97.7431},
+	"barcelona":     {Lat: 41.3874, Lng: 2.1686},
+	"berlin":        {Lat: 52.5200, Lng: 13.4050},
+	"boston":        {Lat: 42.3601, Lng: -71.0589},
+	"brussels":      {Lat: 50.8503, Lng: 4.3517},
+	"chicago":       {Lat: 41.8781, Lng: -87.6298},
+	"denver":        {Lat: 39.7392, Lng: -104.9903},
+	"dublin":        {Lat: 53.3498, Lng: -6.2603},
+	"geneva":        {Lat: 46.2044, Lng: 6.1432},
+	"lisbon":        {Lat: 38.7223, Lng: -9.1393},
+	"london":        {Lat: 51.5074, Lng: -0.1278},
+	"los angeles":   {Lat: 34.0522, Lng: -118.2437},
+	"lyon":          {Lat: 45.7640, Lng: 4.8357},
+	"madrid":        {Lat: 40.4168, Lng: -3.7038},
+	"marseille":     {Lat: 43.2965, Lng: 5.3698},
+	"milan":         {Lat: 45.4642, Lng: 9.1900},
+	"montreal":      {Lat: 45.5017, Lng: -73.5673},
+	"munich":        {Lat: 48.1351, Lng: 11.5820},
+	"new york":      {Lat: 40.7128, Lng: -74.0060},
+	"paris":         {Lat: 48.8566, Lng: 2.3522},
+	"prague":        {Lat: 50.0755, Lng: 14.4378},
+	"san francisco": {Lat: 37.7749, Lng: -122.4194},
+	"seattle":       {Lat: 47.6062, Lng: -122.3321},
+	"singapore":     {Lat: 1.3521, Lng: 103.8198},
+	"stockholm":     {Lat: 59.3293, Lng: 18.0686},
+	"sydney":        {Lat: -33.8688, Lng: 151.2093},
+	"tokyo":         {Lat: 35.6762, Lng: 139.6503},
+	"toronto":       {Lat: 43.6532, Lng: -79.3832},
+	"zurich":        {Lat: 47.3769, Lng: 8.5417},
+}
+
+// geocode returns the location of a city of the geocoding table,
+// "Denver, Colorado" is found as "denver".
+func geocode(city string) (appengine.GeoPoint, bool) {
+	tokens := tokenize(city)
+	for n := len(tokens); n > 0; n-- {
+		if location, ok := cities[strings.Join(tokens[:n], " ")]; ok {
+			return location, true
+		}
+	}
+	return appengine.GeoPoint{}, false
+}
+
+// Near restricts the conferences to a radius around a location,
+// given by its coordinates or by the name of a city.
+type Near struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	City      string  `json:"city"`
+	// Radius is the distance in kilometers.
+	Radius float64 `json:"radius" endpoints:"req"`
+}
+
+// normalize geocodes the city and checks the coordinates.
+func (n *Near) normalize() error {
+	if n.City != "" {
+		location, ok := geocode(n.City)
+		if !ok {
+			return fmt.Errorf("unknown city %q", n.City)
+		}
+		n.Latitude, n.Longitude, n.City = location.Lat, location.Lng, ""
+	}
+
+	if !(appengine.GeoPoint{Lat: n.Latitude, Lng: n.Longitude}).Valid() {
+		return fmt.Errorf("invalid location %v,%v", n.Latitude, n.Longitude)
+	}
+	if !(n.Radius > 0) || math.IsInf(n.Radius, 0) {
+		return fmt.Errorf("invalid radius %v", n.Radius)
+	}
+	return nil
+}
+
+// distance returns the search expression of the distance to the location.
+func (n *Near) distance() string {
+	return fmt.Sprintf("distance(%s, geopoint(%f, %f))", Location, n.Latitude, n.Longitude)
+}
+
+// restriction returns the search restriction of the radius.
+func (n *Near) restriction() string {
+	return fmt.Sprintf("%s < %f", n.distance(), n.Radius*1000)
+}
+
+// match returns true if the conference is located within the radius.
+func (n *Near) match(conference *Conference) bool {
+	return n.distanceTo(conference) < n.Radius*1000
+}
+
+// haversine returns the distance in meters between two locations.
+func haversine(a, b appengine.GeoPoint) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := rad(b.Lat - a.Lat)
+	dLng := rad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// location returns the location of the venue, if it is known.
+func (conference *Conference) location() (appengine.GeoPoint, bool) {
+	if conference.Latitude == 0 && conference.Longitude == 0 {
+		return appengine.GeoPoint{}, false
+	}
+	return appengine.GeoPoint{Lat: conference.Latitude, Lng: conference.Longitude}, true
+}
+
+// byDistance sorts the conferences by distance from the location.
+type byDistance struct {
+	items []*Conference
+	near  *Near
+}
+
+func (d byDistance) Len() int      { return len(d.items) }
+func (d byDistance) Swap(i, j int) { d.items[i], d.items[j] = d.items[j], d.items[i] }
+func (d byDistance) Less(i, j int) bool {
+	return d.near.distanceTo(d.items[i]) < d.near.distanceTo(d.items[j])
+}
+
+// distanceTo returns the distance in meters to the conference.
+func (n *Near) distanceTo(conference *Conference) float64 {
+	location, ok := conference.location()
+	if !ok {
+		return math.Inf(1)
+	}
+	return haversine(location, appengine.GeoPoint{Lat: n.Latitude, Lng: n.Longitude})
+}
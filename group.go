@@ -0,0 +1,221 @@
+package ud859
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// maxGroupSize is the largest group registered at once: a cross-group transaction
+// spans the conference and the profiles of the group, 25 entity groups at most.
+const maxGroupSize = 20
+
+// GroupSeat is a seat booked for an attendee of a group.
+type GroupSeat struct {
+	Email  string `json:"email"`
+	Ticket string `json:"ticket"`
+}
+
+// GroupSeats is a list of GroupSeats.
+type GroupSeats struct {
+	Items []*GroupSeat `json:"items"`
+}
+
+// checkManager returns an error unless the registration is the one of the current user,
+// or has been booked by the current user.
+func (registration *Registration) checkManager(pid *identity) error {
+	if registration.ProfileKey.Equal(pid.key) {
+		return nil
+	}
+	if registration.Booker != nil && registration.Booker.Equal(pid.key) {
+		return nil
+	}
+	return errForbidden("not the booker of the registration")
+}
+
+// groupIDs returns the identities of the attendees of a group.
+func groupIDs(c context.Context, pid *identity, emails []string) ([]*identity, error) {
+	if len(emails) > maxGroupSize {
+		return nil, fmt.Errorf("more than %d attendees", maxGroupSize)
+	}
+
+	var attendees []*identity
+	seen := make(map[string]bool)
+	for _, email := range emails {
+		attendee, err := emailID(c, pid, email)
+		if err != nil {
+			return nil, err
+		}
+		if seen[attendee.key.StringID()] {
+			return nil, fmt.Errorf("duplicate attendee %s", attendee.email)
+		}
+		seen[attendee.key.StringID()] = true
+		attendees = append(attendees, attendee)
+	}
+	return attendees, nil
+}
+
+// registerGroup reserves the seats of the attendees of the RegistrationForm, all or none,
+// and registers each attendee with the current user as booker.
+func registerGroup(c context.Context, pid *identity, ckey *datastore.Key, form *RegistrationForm) error {
+	attendees, err := groupIDs(c, pid, form.Attendees)
+	if err != nil {
+		return errBadRequest(err, "invalid attendees")
+	}
+
+	var profiles []*Profile
+	var conference *Conference
+	var events dispatcher
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		var err error
+		conference, err = loadConference(c, ckey)
+		if err != nil {
+			return errBadRequest(err, "conference does not exist")
+		}
+
+		now := time.Now()
+		if err := conference.checkRegistration(now); err != nil {
+			return err
+		}
+		if conference.ApprovalRequired {
+			return errConflict("registration requires approval")
+		}
+		ticket, err := conference.ticket(form.Ticket)
+		if err != nil {
+			return err
+		}
+		if ticket.Price > 0 {
+			return errBadRequest(fmt.Errorf("%s", ticket.Type), "paid tickets are registered one at a time")
+		}
+		if ticket.SeatsAvailable < len(attendees) {
+			return errConflict(fmt.Sprintf("only %d %s seats available",
+				ticket.SeatsAvailable, strings.ToLower(ticket.Type)))
+		}
+		typ := ticket.Type
+		// the attendees of the group are given the same answers
+		answers, err := registrationAnswers(c, ckey, form.Answers)
+		if err != nil {
+			return err
+		}
+
+		events = newDispatcher(ckey)
+		profiles = make([]*Profile, len(attendees))
+		for i, attendee := range attendees {
+			profile, err := loadProfile(c, attendee)
+			if err != nil {
+				return err
+			}
+			if profile.IsRegistered(conference.WebsafeKey) {
+				return errConflict(attendee.email + " already registered")
+			}
+			if err := checkInvitation(c, ckey, conference, attendee, ""); err != nil {
+				return err
+			}
+
+			// a pending checkout holds a seat already
+			rkey := registrationKey(c, ckey, attendee.key)
+			err = datastore.Get(c, rkey, new(Registration))
+			if err == nil {
+				return errConflict(attendee.email + " has a pending checkout")
+			} else if err != datastore.ErrNoSuchEntity {
+				return errInternalServer(err, "unable to get registration")
+			}
+
+			if err := conference.reserve(typ); err != nil {
+				return err
+			}
+
+			if profile.Version == 0 {
+				// until its user saves it
+				profile.Pending = true
+			}
+			profile.register(conference.WebsafeKey)
+			_, err = putProfile(c, attendee.key, profile)
+			if err != nil {
+				return errInternalServer(err, "unable to save profile")
+			}
+			profiles[i] = profile
+
+			registration := &Registration{
+				ProfileKey:  attendee.key,
+				Email:       attendee.email,
+				Ticket:      typ,
+				Created:     now,
+				Status:      PaymentConfirmed,
+				Booker:      pid.key,
+				BookerEmail: pid.email,
+				Answers:     answers,
+			}
+			_, err = datastore.Put(c, rkey, registration)
+			if err != nil {
+				return errInternalServer(err, "unable to save registration")
+			}
+
+			events.publish(&Event{
+				Name:          EventRegistrationCreated,
+				ConferenceKey: conference.WebsafeKey,
+				ProfileKey:    attendee.key.Encode(),
+				Email:         attendee.email,
+			})
+		}
+
+		_, err = putConference(c, ckey, conference)
+		if err != nil {
+			return errInternalServer(err, "unable to save conference")
+		}
+
+		err = events.save(c)
+		if err != nil {
+			return errInternalServer(err, "unable to publish event")
+		}
+		return nil
+
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil {
+		return err
+	}
+
+	// cache the entities
+	for i, attendee := range attendees {
+		cacheProfile(c, attendee.key, profiles[i])
+	}
+	cacheConference(c, ckey, conference)
+	events.flush(c)
+	return nil
+}
+
+// GroupRegistrations returns the seats booked by the current user to the specified ConferenceKeyForm.
+func (ConferenceAPI) GroupRegistrations(c context.Context, form *ConferenceKeyForm) (*GroupSeats, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+
+	var registrations []*Registration
+	_, err = datastore.NewQuery("Registration").
+		Ancestor(ckey).
+		Filter("Booker =", pid.key).
+		GetAll(c, &registrations)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to query registrations")
+	}
+
+	seats := &GroupSeats{Items: make([]*GroupSeat, 0, len(registrations))}
+	for _, registration := range registrations {
+		seats.Items = append(seats.Items, &GroupSeat{
+			Email:  registration.Email,
+			Ticket: registration.Ticket,
+		})
+	}
+	return seats, nil
+}
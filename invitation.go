@@ -0,0 +1,336 @@
+package ud859
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Conference visibilities.
+const (
+	// VisibilityPublic conferences are listed and searchable.
+	VisibilityPublic = "PUBLIC"
+	// VisibilityUnlisted conferences are open to anyone with their key.
+	VisibilityUnlisted = "UNLISTED"
+	// VisibilityInviteOnly conferences are unlisted and open to the invited users only.
+	VisibilityInviteOnly = "INVITE_ONLY"
+)
+
+// maxInvitations is the largest number of invitations issued at once.
+const maxInvitations = 100
+
+// Invitation invites a user to an invite-only conference, its key is named
+// after the lowercased email and is a child of the conference key.
+type Invitation struct {
+	Email string `json:"email" datastore:",noindex"`
+	// Token lets the invitee register with another email, once.
+	Token   string    `json:"token"`
+	Created time.Time `json:"created" datastore:",noindex"`
+	// UsedBy is the key of the profile registered with the invitation.
+	UsedBy *datastore.Key `json:"-" datastore:",noindex"`
+	Used   bool           `json:"used" datastore:"-"`
+}
+
+// InvitationForm invites the users of the emails to a conference.
+type InvitationForm struct {
+	WebsafeKey string   `json:"websafeConferenceKey" endpoints:"req"`
+	Emails     []string `json:"emails" endpoints:"req"`
+}
+
+// RevocationForm revokes the invitation of the user of the email.
+type RevocationForm struct {
+	WebsafeKey string `json:"websafeConferenceKey" endpoints:"req"`
+	Email      string `json:"email" endpoints:"req"`
+}
+
+// Invitations is a list of Invitations.
+type Invitations struct {
+	Items []*Invitation `json:"items"`
+}
+
+func init() {
+	subscribe("invitation", invitationSubscriber, EventInvitationIssued)
+}
+
+func validVisibility(visibility string) bool {
+	return visibility == VisibilityPublic || visibility == VisibilityUnlisted || visibility == VisibilityInviteOnly
+}
+
+// visibility returns the visibility of the conference, the conferences created
+// before the visibilities are public.
+func (conference *Conference) visibility() string {
+	if conference.Visibility == "" {
+		return VisibilityPublic
+	}
+	return conference.Visibility
+}
+
+// listed returns true if the conference is searchable and listed by the queries.
+func (conference *Conference) listed() bool {
+	return conference.status() != StatusDraft && conference.visibility() == VisibilityPublic
+}
+
+func invitationKey(c context.Context, ckey *datastore.Key, email string) *datastore.Key {
+	return datastore.NewKey(c, "Invitation", strings.ToLower(email), 0, ckey)
+}
+
+// newToken returns a random invitation token.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkInvitation returns an error unless the attendee is invited to an invite-only
+// conference, by its email or by the token of an invitation, within the transaction
+// of the registration. The invitation is marked as used by the attendee.
+func checkInvitation(c context.Context, ckey *datastore.Key, conference *Conference,
+	attendee *identity, token string) error {
+
+	if conference.visibility() != VisibilityInviteOnly {
+		return nil
+	}
+
+	key := invitationKey(c, ckey, attendee.email)
+	invitation := new(Invitation)
+	err := datastore.Get(c, key, invitation)
+	if err == datastore.ErrNoSuchEntity && token != "" {
+		var invitations []*Invitation
+		keys, err := datastore.NewQuery("Invitation").
+			Ancestor(ckey).
+			Filter("Token =", token).
+			Limit(1).
+			GetAll(c, &invitations)
+		if err != nil {
+			return errInternalServer(err, "unable to query invitations")
+		}
+		if len(keys) == 0 {
+			return errForbidden("invalid invitation")
+		}
+		key, invitation = keys[0], invitations[0]
+	} else if err == datastore.ErrNoSuchEntity {
+		return errForbidden("not invited to the conference")
+	} else if err != nil {
+		return errInternalServer(err, "unable to get invitation")
+	}
+
+	if invitation.UsedBy != nil {
+		if invitation.UsedBy.Equal(attendee.key) {
+			return nil
+		}
+		return errForbidden("invitation already used")
+	}
+	invitation.UsedBy = attendee.key
+	_, err = datastore.Put(c, key, invitation)
+	if err != nil {
+		return errInternalServer(err, "unable to save invitation")
+	}
+	return nil
+}
+
+// InviteAttendees invites users to a conference created by the current user,
+// and emails them their invitation. The existing invitations are sent again.
+func (ConferenceAPI) InviteAttendees(c context.Context, form *InvitationForm) (*Invitations, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return nil, errForbidden("not the organizer of the conference")
+	}
+	if len(form.Emails) > maxInvitations {
+		return nil, errBadRequest(fmt.Errorf("more than %d emails", maxInvitations), "invalid emails")
+	}
+
+	var emails []string
+	seen := make(map[string]bool)
+	for _, email := range form.Emails {
+		invitee, err := emailID(c, pid, email)
+		if err != nil {
+			return nil, errBadRequest(err, "invalid email")
+		}
+		if !seen[strings.ToLower(invitee.email)] {
+			seen[strings.ToLower(invitee.email)] = true
+			emails = append(emails, invitee.email)
+		}
+	}
+
+	var invitations []*Invitation
+	var events dispatcher
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		conference, err := loadConference(c, ckey)
+		if err != nil {
+			return errBadRequest(err, "conference does not exist")
+		}
+		if conference.visibility() != VisibilityInviteOnly {
+			return errConflict("conference is not invite-only")
+		}
+
+		keys := make([]*datastore.Key, len(emails))
+		for i, email := range emails {
+			keys[i] = invitationKey(c, ckey, email)
+		}
+		invitations = make([]*Invitation, len(emails))
+		for i := range invitations {
+			invitations[i] = new(Invitation)
+		}
+		missing := make([]bool, len(emails))
+		err = datastore.GetMulti(c, keys, invitations)
+		if multi, ok := err.(appengine.MultiError); ok {
+			for i, err := range multi {
+				if err == datastore.ErrNoSuchEntity {
+					missing[i] = true
+				} else if err != nil {
+					return errInternalServer(err, "unable to get invitations")
+				}
+			}
+		} else if err != nil {
+			return errInternalServer(err, "unable to get invitations")
+		}
+
+		now := time.Now()
+		events = newDispatcher(ckey)
+		for i, email := range emails {
+			if missing[i] {
+				token, err := newToken()
+				if err != nil {
+					return errInternalServer(err, "unable to create invitation token")
+				}
+				invitations[i] = &Invitation{Email: email, Token: token, Created: now}
+			}
+			invitations[i].Used = invitations[i].UsedBy != nil
+
+			events.publish(&Event{
+				Name:          EventInvitationIssued,
+				ConferenceKey: conference.WebsafeKey,
+				ProfileKey:    pid.key.Encode(),
+				Email:         pid.email,
+				Recipient:     email,
+			})
+		}
+
+		_, err = datastore.PutMulti(c, keys, invitations)
+		if err != nil {
+			return errInternalServer(err, "unable to save invitations")
+		}
+
+		err = events.save(c)
+		if err != nil {
+			return errInternalServer(err, "unable to publish event")
+		}
+		return nil
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+	events.flush(c)
+	return &Invitations{Items: invitations}, nil
+}
+
+// RevokeInvitation deletes an invitation to a conference created by the current user,
+// an invitation used already does not cancel the registration.
+func (ConferenceAPI) RevokeInvitation(c context.Context, form *RevocationForm) error {
+	pid, err := profileID(c)
+	if err != nil {
+		return err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return errForbidden("not the organizer of the conference")
+	}
+
+	key := invitationKey(c, ckey, strings.TrimSpace(form.Email))
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		err := datastore.Get(c, key, new(Invitation))
+		if err == datastore.ErrNoSuchEntity {
+			return errNotFound(fmt.Errorf("%s", form.Email), "invitation not found")
+		} else if err != nil {
+			return errInternalServer(err, "unable to get invitation")
+		}
+
+		err = datastore.Delete(c, key)
+		if err != nil {
+			return errInternalServer(err, "unable to delete invitation")
+		}
+		return nil
+	}, nil)
+	return err
+}
+
+// Invitations returns the invitations to a conference created by the current user.
+func (ConferenceAPI) Invitations(c context.Context, form *ConferenceKeyForm) (*Invitations, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return nil, errForbidden("not the organizer of the conference")
+	}
+
+	invitations := make([]*Invitation, 0)
+	_, err = datastore.NewQuery("Invitation").
+		Ancestor(ckey).
+		GetAll(c, &invitations)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to query invitations")
+	}
+	for _, invitation := range invitations {
+		invitation.Used = invitation.UsedBy != nil
+	}
+	return &Invitations{Items: invitations}, nil
+}
+
+// invitationSubscriber emails an invitation to its recipient.
+func invitationSubscriber(c context.Context, e *Event) error {
+	key, err := datastore.DecodeKey(e.ConferenceKey)
+	if err != nil {
+		return err
+	}
+	conference, err := loadConference(c, key)
+	if err != nil {
+		return err
+	}
+
+	invitation := new(Invitation)
+	err = datastore.Get(c, invitationKey(c, key, e.Recipient), invitation)
+	if err == datastore.ErrNoSuchEntity {
+		// revoked before it has been sent
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	body, err := conferenceText(conference)
+	if err != nil {
+		return err
+	}
+	// one task per invitation, so that a redelivered event sends no duplicate
+	name := taskName("invitation", e.ConferenceKey, e.Recipient, e.Time.String())
+	return sendMail(c, name, e.Recipient,
+		"You are invited to a Conference",
+		"Hi, "+e.Email+" invites you to the following conference:\n"+body+
+			"\n\tConference key: "+conference.WebsafeKey+
+			"\n\tInvitation: "+invitation.Token+"\n")
+}
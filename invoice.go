@@ -0,0 +1,194 @@
+package ud859
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Invoice is the receipt of a paid registration. Its key is a child of the
+// organizer profile key, with the Number as ID.
+type Invoice struct {
+	WebsafeKey string `json:"websafeKey" datastore:"-"`
+	// Number is sequential per organizer.
+	Number         int64     `json:"number" datastore:",noindex"`
+	Issued         time.Time `json:"issued" datastore:",noindex"`
+	ConferenceKey  string    `json:"websafeConferenceKey" datastore:",noindex"`
+	ConferenceName string    `json:"conferenceName" datastore:",noindex"`
+	Organizer      string    `json:"organizerDisplayName" datastore:",noindex"`
+	DisplayName    string    `json:"displayName" datastore:",noindex"`
+	Email          string    `json:"email" datastore:",noindex"`
+	Ticket         string    `json:"ticket" datastore:",noindex"`
+	// Amount is the Price paid, less the Discount.
+	Price     int64  `json:"price" datastore:",noindex"`
+	Discount  int64  `json:"discount" datastore:",noindex"`
+	Amount    int64  `json:"amount" datastore:",noindex"`
+	Currency  string `json:"currency" datastore:",noindex"`
+	PaymentID string `json:"paymentId" datastore:",noindex"`
+
+	// the renderings of the invoice.
+	HTML string `json:"html" datastore:",noindex"`
+	PDF  []byte `json:"pdf" datastore:",noindex"`
+}
+
+// invoiceCounter is the number of the last invoice of an organizer.
+type invoiceCounter struct {
+	Last int64 `datastore:",noindex"`
+}
+
+// issueInvoice numbers, renders and saves the invoice of a paid registration,
+// within the transaction of the registration.
+func issueInvoice(c context.Context, ckey *datastore.Key, conference *Conference,
+	profile *Profile, registration *Registration) (*datastore.Key, error) {
+
+	// the conference and the invoices of the organizer are in the same entity group
+	okey := ckey.Parent()
+	counterKey := datastore.NewKey(c, "InvoiceCounter", "invoice", 0, okey)
+	counter := new(invoiceCounter)
+	err := datastore.Get(c, counterKey, counter)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	counter.Last++
+	_, err = datastore.Put(c, counterKey, counter)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice := &Invoice{
+		Number:         counter.Last,
+		Issued:         time.Now(),
+		ConferenceKey:  conference.WebsafeKey,
+		ConferenceName: conference.Name,
+		Organizer:      conference.Organizer,
+		DisplayName:    profile.DisplayName,
+		Email:          profile.Email,
+		Ticket:         registration.Ticket,
+		Price:          registration.Amount + registration.Discount,
+		Discount:       registration.Discount,
+		Amount:         registration.Amount,
+		Currency:       conference.Currency,
+		PaymentID:      registration.PaymentID,
+	}
+	err = invoice.render()
+	if err != nil {
+		return nil, err
+	}
+
+	key := datastore.NewKey(c, "Invoice", "", invoice.Number, okey)
+	return datastore.Put(c, key, invoice)
+}
+
+// GetInvoice returns the invoice of the current user's registration to the specified ConferenceKeyForm.
+func (ConferenceAPI) GetInvoice(c context.Context, form *ConferenceKeyForm) (*Invoice, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+
+	registration := new(Registration)
+	err = datastore.Get(c, registrationKey(c, ckey, pid.key), registration)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, errInternalServer(err, "unable to get registration")
+	}
+	if registration.InvoiceKey == nil {
+		return nil, errNotFound(fmt.Errorf("%s", form.WebsafeKey), "invoice not found")
+	}
+
+	invoice, err := loadInvoice(c, registration.InvoiceKey)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to get invoice")
+	}
+	return invoice, nil
+}
+
+func loadInvoice(c context.Context, key *datastore.Key) (*Invoice, error) {
+	invoice := new(Invoice)
+	err := datastore.Get(c, key, invoice)
+	if err != nil {
+		return nil, err
+	}
+	invoice.WebsafeKey = key.Encode()
+	return invoice, nil
+}
+
+// filename returns the name of the invoice file with the extension.
+func (invoice *Invoice) filename(ext string) string {
+	return fmt.Sprintf("invoice-%06d.%s", invoice.Number, ext)
+}
+
+// render renders the invoice as HTML and PDF.
+func (invoice *Invoice) render() error {
+	buf := new(bytes.Buffer)
+	if err := invoiceHTMLTemplate.Execute(buf, invoice); err != nil {
+		return err
+	}
+	invoice.HTML = buf.String()
+
+	buf.Reset()
+	if err := invoiceTextTemplate.Execute(buf, invoice); err != nil {
+		return err
+	}
+	invoice.PDF = renderPDF(strings.Split(strings.TrimSpace(buf.String()), "\n"))
+	return nil
+}
+
+// formatAmount formats an amount in the smallest unit of the currency.
+func formatAmount(amount int64, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, amount/100, amount%100, currency)
+}
+
+var invoiceFuncs = map[string]interface{}{
+	"amount": func(invoice *Invoice, amount int64) string {
+		return formatAmount(amount, invoice.Currency)
+	},
+	"date": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02")
+	},
+	"lower": strings.ToLower,
+}
+
+var invoiceHTMLTemplate = template.Must(template.New("html").Funcs(invoiceFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Invoice {{printf "%06d" .Number}}</title></head>
+<body>
+<h1>Invoice {{printf "%06d" .Number}}</h1>
+<p>Issued on {{date .Issued}} by {{.Organizer}}</p>
+<p>Billed to {{.DisplayName}} &lt;{{.Email}}&gt;</p>
+<table>
+<tr><td>{{.ConferenceName}}, {{lower .Ticket}} ticket</td><td>{{amount . .Price}}</td></tr>
+{{if .Discount}}<tr><td>Discount</td><td>-{{amount . .Discount}}</td></tr>
+{{end}}<tr><th>Total paid</th><th>{{amount . .Amount}}</th></tr>
+</table>
+<p>Payment {{.PaymentID}}</p>
+</body>
+</html>
+`))
+
+var invoiceTextTemplate = texttemplate.Must(texttemplate.New("text").Funcs(invoiceFuncs).Parse(`
+Invoice {{printf "%06d" .Number}}
+
+Issued on {{date .Issued}} by {{.Organizer}}
+Billed to {{.DisplayName}} <{{.Email}}>
+
+{{.ConferenceName}}, {{lower .Ticket}} ticket: {{amount . .Price}}
+{{if .Discount}}Discount: -{{amount . .Discount}}
+{{end}}Total paid: {{amount . .Amount}}
+
+Payment {{.PaymentID}}
+`))
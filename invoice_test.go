@@ -0,0 +1,92 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatAmount(t *testing.T) {
+	for amount, want := range map[int64]string{
+		5000: "50.00 EUR",
+		1999: "19.99 EUR",
+		5:    "0.05 EUR",
+		-250: "-2.50 EUR",
+	} {
+		if got := formatAmount(amount, "EUR"); got != want {
+			t.Errorf("got:%s, want:%s", got, want)
+		}
+	}
+}
+
+func TestRenderInvoice(t *testing.T) {
+	invoice := &Invoice{
+		Number:         42,
+		Issued:         time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC),
+		ConferenceName: "Gophers (Paris)",
+		Organizer:      "Gopher",
+		DisplayName:    "Bob <script>",
+		Ticket:         TicketStudent,
+		Price:          5000,
+		Discount:       1000,
+		Amount:         4000,
+		Currency:       "EUR",
+	}
+	if err := invoice.render(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"Invoice 000042", "2016-06-01", "Bob &lt;script&gt;",
+		"student ticket", "50.00 EUR", "-10.00 EUR", "40.00 EUR"} {
+		if !strings.Contains(invoice.HTML, want) {
+			t.Errorf("got:%s, want:%s", invoice.HTML, want)
+		}
+	}
+	for _, want := range []string{"(Invoice 000042) '", `(Gophers \(Paris\), student ticket: 50.00 EUR) '`} {
+		if !bytes.Contains(invoice.PDF, []byte(want)) {
+			t.Errorf("got:%s, want:%s", invoice.PDF, want)
+		}
+	}
+	if invoice.filename("pdf") != "invoice-000042.pdf" {
+		t.Errorf("got:%s, want:invoice-000042.pdf", invoice.filename("pdf"))
+	}
+}
+
+func TestRenderPDF(t *testing.T) {
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %d, é€", i))
+	}
+	pdf := renderPDF(lines)
+
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatalf("got:%q, want a PDF", pdf)
+	}
+	if !bytes.Contains(pdf, []byte(`(line 0, \351?) '`)) {
+		t.Errorf("got:%s, want the Latin-1 characters escaped", pdf)
+	}
+	if !bytes.Contains(pdf, []byte("/Count 3")) {
+		t.Errorf("got:%s, want 3 pages", pdf)
+	}
+
+	// the offsets of the cross-reference table point to the objects
+	m := regexp.MustCompile(`startxref\n(\d+)`).FindSubmatch(pdf)
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("got:%q, want xref", pdf[xref:])
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n`).FindAllSubmatch(pdf[xref:], -1)
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%d 0 obj", i+1); !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Errorf("got:%q, want:%s", pdf[offset:offset+10], want)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package ud859
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/mail"
 	"google.golang.org/appengine/taskqueue"
@@ -15,33 +19,166 @@ import (
 
 func init() {
 	http.HandleFunc("/tasks/send_confirmation_email", sendConfirmationEmail)
+
+	subscribe("confirmation", confirmationSubscriber, EventConferenceCreated)
+	subscribe("registration", registrationSubscriber, EventRegistrationCreated)
 }
 
-func sendConfirmation(c context.Context, email, body string) error {
-	task := taskqueue.NewPOSTTask("/tasks/send_confirmation_email",
-		url.Values{
-			"email": {email},
-			"body":  {body},
-		})
+// confirmationSubscriber sends the details of the created conference to its organizer.
+func confirmationSubscriber(c context.Context, e *Event) error {
+	key, err := datastore.DecodeKey(e.ConferenceKey)
+	if err != nil {
+		return err
+	}
+	conference, err := loadConference(c, key)
+	if err != nil {
+		return err
+	}
+
+	// body of the confirmation email
+	body, err := conferenceText(conference)
+	if err != nil {
+		return err
+	}
+	// one task per conference, so that a redelivered event sends no duplicate
+	return sendConfirmation(c, taskName("confirmation", e.ConferenceKey), e.Email, body)
+}
+
+// registrationSubscriber sends the details of the conference to the registered attendee,
+// with the invoice of a paid registration.
+func registrationSubscriber(c context.Context, e *Event) error {
+	ckey, err := datastore.DecodeKey(e.ConferenceKey)
+	if err != nil {
+		return err
+	}
+	pkey, err := datastore.DecodeKey(e.ProfileKey)
+	if err != nil {
+		return err
+	}
+	conference, err := loadConference(c, ckey)
+	if err != nil {
+		return err
+	}
+
+	registration := new(Registration)
+	err = datastore.Get(c, registrationKey(c, ckey, pkey), registration)
+	if err == datastore.ErrNoSuchEntity {
+		// the registration has been cancelled
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	body, err := conferenceText(conference)
+	if err != nil {
+		return err
+	}
+	token, err := signTicket(c, ckey, pkey)
+	if err != nil {
+		return err
+	}
+	values := url.Values{
+		"email":   {e.Email},
+		"subject": {"You are registered to a Conference!"},
+		"body":    {"Hi, you are registered to the following conference:\n" + body + ticketText(token)},
+		"ticket":  {token},
+	}
+	if registration.InvoiceKey != nil {
+		values.Set("invoice", registration.InvoiceKey.Encode())
+	}
+
+	// one task per registration, a registration made again is notified again
+	name := taskName("registration", e.ConferenceKey, e.ProfileKey, registration.Created.String())
+	return queueMail(c, name, values)
+}
+
+func sendConfirmation(c context.Context, name, email, body string) error {
+	return sendMail(c, name, email, "You created a new Conference!",
+		"Hi, you have created the following conference:\n"+body)
+}
+
+// ticketText presents the ticket token attached as a QR code.
+func ticketText(token string) string {
+	return "\nShow the attached QR code at the venue, or your ticket: " + token + "\n"
+}
+
+// sendMail queues an email, a named task is sent only once.
+func sendMail(c context.Context, name, email, subject, body string) error {
+	return queueMail(c, name, url.Values{
+		"email":   {email},
+		"subject": {subject},
+		"body":    {body},
+	})
+}
+
+// queueMail queues an email with the parameters of sendConfirmationEmail,
+// the "invoice" parameter attaches the invoice of that key, the "ticket"
+// parameter attaches the QR code of that ticket token.
+func queueMail(c context.Context, name string, values url.Values) error {
+	task := taskqueue.NewPOSTTask("/tasks/send_confirmation_email", values)
+	task.Name = name
+
 	_, err := taskqueue.Add(c, task, "")
+	if err == taskqueue.ErrTaskAlreadyAdded {
+		return nil
+	}
 	return err
 }
 
-// sends an email to the user who has just created a conference.
+// taskName returns a task name unique to the parts.
+func taskName(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return parts[0] + "-" + hex.EncodeToString(sum[:])
+}
+
+// sends an email queued by sendMail.
 func sendConfirmationEmail(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
 	email := r.FormValue("email")
+	subject := r.FormValue("subject")
 	body := r.FormValue("body")
 	if email == "" || body == "" {
 		return
 	}
+	if subject == "" {
+		// queued before the subject was a parameter
+		subject = "You created a new Conference!"
+		body = "Hi, you have created the following conference:\n" + body
+	}
 
 	msg := &mail.Message{
 		Sender:  fmt.Sprintf("noreply@%s.appspotmail.com", appengine.AppID(c)),
 		To:      []string{email},
-		Subject: "You created a new Conference!",
-		Body:    "Hi, you have created the following conference:\n" + body,
+		Subject: subject,
+		Body:    body,
+	}
+
+	if value := r.FormValue("invoice"); value != "" {
+		key, err := datastore.DecodeKey(value)
+		if err != nil {
+			log.Errorf(c, "invalid invoice key: %v", err)
+			return
+		}
+		invoice, err := loadInvoice(c, key)
+		if err != nil {
+			log.Errorf(c, "could not get invoice: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		msg.Attachments = []mail.Attachment{
+			{Name: invoice.filename("pdf"), Data: invoice.PDF},
+			{Name: invoice.filename("html"), Data: []byte(invoice.HTML)},
+		}
+	}
+
+	if token := r.FormValue("ticket"); token != "" {
+		code, err := renderQR([]byte(token))
+		if err != nil {
+			log.Errorf(c, "could not render ticket: %v", err)
+			return
+		}
+		msg.Attachments = append(msg.Attachments, mail.Attachment{Name: "ticket.png", Data: code})
 	}
 
 	if err := mail.Send(c, msg); err != nil {
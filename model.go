@@ -3,6 +3,7 @@ package ud859
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -21,7 +22,10 @@ const (
 
 // Conference query fields.
 const (
+	Key            = "KEY"
 	Name           = "NAME"
+	Description    = "DESCRIPTION"
+	Organizer      = "ORGANIZER"
 	City           = "CITY"
 	Topics         = "TOPIC"
 	StartDate      = "START_DATE"
@@ -29,12 +33,24 @@ const (
 	Month          = "MONTH"
 	MaxAttendees   = "MAX_ATTENDEES"
 	SeatsAvailable = "SEATS_AVAILABLE"
+	Created        = "CREATED"
+	Status         = "STATUS"
+	// The registration window.
+	RegistrationOpen     = "REGISTRATION_OPEN"
+	RegistrationClose    = "REGISTRATION_CLOSE"
+	CancellationDeadline = "CANCELLATION_DEADLINE"
+	// Text matches a phrase in any field.
+	Text = "TEXT"
 )
 
 func errConflict(message string) error {
 	return endpoints.NewConflictError("ud859: %s", message)
 }
 
+func errForbidden(message string) error {
+	return endpoints.NewForbiddenError("ud859: %s", message)
+}
+
 func errInternalServer(cause error, message string) error {
 	return endpoints.NewInternalServerError("ud859: %s (%v)", message, cause)
 }
@@ -51,6 +67,11 @@ func errNotFound(cause error, message string) error {
 	return endpoints.NewNotFoundError("ud859: %s (%v)", message, cause)
 }
 
+func errServiceUnavailable(cause error, message string) error {
+	return endpoints.NewAPIError("Service Unavailable",
+		fmt.Sprintf("ud859: %s (%v)", message, cause), http.StatusServiceUnavailable)
+}
+
 // MarshalJSON marshals the Filter as JSON data.
 func (f *Filter) MarshalJSON() ([]byte, error) {
 	m := make(map[string]interface{})
@@ -83,18 +104,9 @@ func (f *Filter) UnmarshalJSON(data []byte) error {
 	if !ok {
 		return errParse(err)
 	}
-	if err = f.setOp(); err != nil {
-		return errParse(err)
-	}
 
 	f.Value = m["value"]
-	if f.Field == Month || f.Field == MaxAttendees || f.Field == SeatsAvailable {
-		err = f.setValueInt()
-
-	} else if f.Field == StartDate || f.Field == EndDate {
-		err = f.setValueTime()
-	}
-	if err != nil {
+	if err = f.normalize(); err != nil {
 		return errParse(err)
 	}
 	return nil
@@ -146,6 +158,10 @@ func (f *Filter) setValueTime() (err error) {
 	case time.Time:
 	case string:
 		f.Value, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			// or a date only
+			f.Value, err = time.Parse("2006-01-02", v)
+		}
 		if err != nil {
 			err = fmt.Errorf("invalid value: %v", err)
 		}
@@ -0,0 +1,321 @@
+package ud859
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	outboxLease       = time.Minute
+	outboxMaxAttempts = 10
+	outboxMaxBackoff  = time.Hour
+	outboxSweepLimit  = 100
+)
+
+func init() {
+	http.HandleFunc("/tasks/dispatch_outbox", sweepOutbox)
+	http.HandleFunc("/admin/outbox", deadLetters)
+}
+
+// outboxEntry defines a side effect to perform once the transaction
+// that has written it has committed.
+type outboxEntry struct {
+	Action      string    `json:"action" datastore:",noindex"`
+	Payload     []byte    `json:"payload" datastore:",noindex"`
+	Created     time.Time `json:"created" datastore:",noindex"`
+	Attempts    int       `json:"attempts" datastore:",noindex"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError" datastore:",noindex"`
+	// Dead is true when the entry has been given up after too many attempts.
+	Dead bool `json:"dead"`
+}
+
+// outboxAction performs a side effect from the payload of an outboxEntry.
+// An action may be performed more than once and must be idempotent.
+type outboxAction func(c context.Context, payload []byte) error
+
+var outboxActions = make(map[string]outboxAction)
+
+// outboxNow returns the current time of the outbox, the tests may replace it.
+var outboxNow = time.Now
+
+// outbox collects the side effects of a transaction.
+type outbox struct {
+	parent  *datastore.Key
+	entries []*outboxEntry
+	err     error
+}
+
+// newOutbox returns an outbox whose entries belong to the entity group of parent.
+func newOutbox(parent *datastore.Key) *outbox {
+	return &outbox{parent: parent}
+}
+
+// add appends an action to the outbox, the first error is returned by save.
+func (o *outbox) add(action string, payload interface{}) {
+	if o.err != nil {
+		return
+	}
+	if _, ok := outboxActions[action]; !ok {
+		o.err = fmt.Errorf("unknown action %s", action)
+		return
+	}
+
+	var data []byte
+	if payload != nil {
+		data, o.err = json.Marshal(payload)
+		if o.err != nil {
+			return
+		}
+	}
+
+	now := outboxNow()
+	o.entries = append(o.entries, &outboxEntry{
+		Action:      action,
+		Payload:     data,
+		Created:     now,
+		NextAttempt: now,
+	})
+}
+
+// save writes the entries of the outbox and enqueues their dispatch,
+// it must be called within the transaction of the business change.
+func (o *outbox) save(c context.Context) error {
+	if o.err != nil {
+		return o.err
+	}
+	if len(o.entries) == 0 {
+		return nil
+	}
+
+	keys := make([]*datastore.Key, len(o.entries))
+	for i := range keys {
+		keys[i] = datastore.NewIncompleteKey(c, "Outbox", o.parent)
+	}
+
+	keys, err := datastore.PutMulti(c, keys, o.entries)
+	if err != nil {
+		return err
+	}
+
+	// the task is enqueued only if the transaction commits
+	return dispatchOutboxDelay.Call(c, encodeKeys(keys))
+}
+
+func encodeKeys(keys []*datastore.Key) []string {
+	safeKeys := make([]string, len(keys))
+	for i, key := range keys {
+		safeKeys[i] = key.Encode()
+	}
+	return safeKeys
+}
+
+var dispatchOutboxDelay *delay.Function
+
+func init() {
+	// dispatchOutbox refers to dispatchOutboxDelay for its retries
+	dispatchOutboxDelay = delay.Func("dispatch_outbox", dispatchOutbox)
+}
+
+// dispatchOutbox performs the actions of the specified entries,
+// the failed entries are dispatched again later with an exponential backoff.
+func dispatchOutbox(c context.Context, safeKeys []string) {
+	var retry []string
+	var backoff time.Duration
+
+	for _, safeKey := range safeKeys {
+		key, err := datastore.DecodeKey(safeKey)
+		if err != nil {
+			log.Errorf(c, "invalid outbox key %s: %v", safeKey, err)
+			continue
+		}
+
+		next, err := dispatchEntry(c, key)
+		if err != nil {
+			log.Errorf(c, "unable to dispatch outbox entry %s: %v", safeKey, err)
+		}
+		if next > 0 {
+			retry = append(retry, safeKey)
+			if backoff == 0 || next < backoff {
+				backoff = next
+			}
+		}
+	}
+
+	if len(retry) == 0 {
+		return
+	}
+
+	task, err := dispatchOutboxDelay.Task(retry)
+	if err == nil {
+		task.Delay = backoff
+		_, err = taskqueue.Add(c, task, "")
+	}
+	if err != nil {
+		// the entries are left to the sweeper
+		log.Errorf(c, "unable to schedule outbox dispatch: %v", err)
+	}
+}
+
+// dispatchEntry performs the action of the entry at key,
+// it returns the delay before the next attempt when the action has failed.
+func dispatchEntry(c context.Context, key *datastore.Key) (time.Duration, error) {
+	entry := new(outboxEntry)
+	var wait time.Duration
+
+	// lease the entry
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		err := datastore.Get(c, key, entry)
+		if err != nil {
+			return err
+		}
+		if entry.Dead {
+			// given up
+			wait = 0
+			return errLeased
+		}
+		if wait = entry.NextAttempt.Sub(outboxNow()); wait > 0 {
+			// already leased, or not due yet
+			return errLeased
+		}
+
+		entry.Attempts++
+		entry.NextAttempt = outboxNow().Add(outboxLease)
+		_, err = datastore.Put(c, key, entry)
+		return err
+	}, nil)
+
+	if err == datastore.ErrNoSuchEntity {
+		// already dispatched
+		return 0, nil
+	} else if err == errLeased {
+		// check again once the lease has expired
+		return wait, nil
+	} else if err != nil {
+		return outboxLease, err
+	}
+
+	action, ok := outboxActions[entry.Action]
+	if ok {
+		err = action(c, entry.Payload)
+	} else {
+		err = fmt.Errorf("unknown action %s", entry.Action)
+	}
+
+	if err == nil {
+		// done
+		return 0, datastore.Delete(c, key)
+	}
+
+	// schedule the next attempt, or give up
+	backoff := time.Duration(1<<uint(entry.Attempts)) * 10 * time.Second
+	if backoff > outboxMaxBackoff || backoff <= 0 {
+		backoff = outboxMaxBackoff
+	}
+	entry.LastError = err.Error()
+	entry.NextAttempt = outboxNow().Add(backoff)
+	entry.Dead = entry.Attempts >= outboxMaxAttempts
+
+	if _, erp := datastore.Put(c, key, entry); erp != nil {
+		log.Errorf(c, "unable to save outbox entry: %v", erp)
+	}
+	if entry.Dead {
+		log.Criticalf(c, "outbox entry %s is dead: %v", key.Encode(), err)
+		return 0, err
+	}
+	return backoff, err
+}
+
+var errLeased = errors.New("outbox entry is leased")
+
+// dispatches the entries whose task has been lost.
+func sweepOutbox(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	keys, err := datastore.NewQuery("Outbox").
+		Filter("Dead =", false).
+		Filter("NextAttempt <", outboxNow().Add(-outboxLease)).
+		KeysOnly().
+		Limit(outboxSweepLimit).
+		GetAll(c, nil)
+
+	if err != nil {
+		log.Errorf(c, "could not query outbox: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	dispatchOutbox(c, encodeKeys(keys))
+}
+
+// deadLetter is an outboxEntry given up after too many attempts.
+type deadLetter struct {
+	Key string `json:"key"`
+	*outboxEntry
+}
+
+// lists the dead entries to the admins, or dispatches again the entry posted with key.
+func deadLetters(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method == "POST" {
+		key, err := datastore.DecodeKey(r.FormValue("key"))
+		if err != nil {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+
+		err = datastore.RunInTransaction(c, func(c context.Context) error {
+			entry := new(outboxEntry)
+			if err := datastore.Get(c, key, entry); err != nil {
+				return err
+			}
+			entry.Dead = false
+			entry.Attempts = 0
+			entry.NextAttempt = outboxNow()
+			_, err := datastore.Put(c, key, entry)
+			return err
+		}, nil)
+
+		if err != nil {
+			log.Errorf(c, "could not revive outbox entry: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		dispatchOutbox(c, []string{key.Encode()})
+		return
+	}
+
+	var entries []*outboxEntry
+	keys, err := datastore.NewQuery("Outbox").
+		Filter("Dead =", true).
+		GetAll(c, &entries)
+
+	if err != nil {
+		log.Errorf(c, "could not query outbox: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	letters := make([]*deadLetter, len(entries))
+	for i, entry := range entries {
+		letters[i] = &deadLetter{keys[i].Encode(), entry}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(letters); err != nil {
+		log.Errorf(c, "could not encode dead letters: %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+// testAction is an outboxAction that fails the first failures calls.
+type testAction struct {
+	failures int
+	calls    int
+	payloads []string
+}
+
+func (a *testAction) perform(c context.Context, payload []byte) error {
+	a.calls++
+	if a.failures > 0 {
+		a.failures--
+		return errors.New("action failure")
+	}
+	a.payloads = append(a.payloads, string(payload))
+	return nil
+}
+
+// testClock is the clock of the outbox during a test.
+type testClock struct {
+	now time.Time
+}
+
+func (t *testClock) advance(d time.Duration) {
+	t.now = t.now.Add(d)
+}
+
+type outboxTest struct {
+	inst   aetest.Instance
+	c      context.Context
+	clock  *testClock
+	action *testAction
+	parent *datastore.Key
+}
+
+func newOutboxTest(t *testing.T) *outboxTest {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		_ = inst.Close()
+		t.Fatal(err)
+	}
+	c := appengine.NewContext(r)
+
+	ot := &outboxTest{
+		inst:   inst,
+		c:      c,
+		clock:  &testClock{time.Date(2016, 7, 11, 10, 0, 0, 0, time.UTC)},
+		action: new(testAction),
+		parent: datastore.NewKey(c, "Profile", "outbox", 0, nil),
+	}
+	outboxNow = func() time.Time { return ot.clock.now }
+	outboxActions["test"] = ot.action.perform
+	return ot
+}
+
+func (ot *outboxTest) close() {
+	outboxNow = time.Now
+	delete(outboxActions, "test")
+	_ = ot.inst.Close()
+}
+
+// save commits an outbox with a test action, and returns the key of its entry.
+func (ot *outboxTest) save(t *testing.T, payload interface{}) *datastore.Key {
+	err := datastore.RunInTransaction(ot.c, func(c context.Context) error {
+		o := newOutbox(ot.parent)
+		o.add("test", payload)
+		return o.save(c)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := datastore.NewQuery("Outbox").Ancestor(ot.parent).KeysOnly().GetAll(ot.c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("got %d outbox entries, want 1", len(keys))
+	}
+	return keys[0]
+}
+
+func (ot *outboxTest) entry(t *testing.T, key *datastore.Key) *outboxEntry {
+	entry := new(outboxEntry)
+	if err := datastore.Get(ot.c, key, entry); err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func (ot *outboxTest) deleted(t *testing.T, key *datastore.Key) {
+	err := datastore.Get(ot.c, key, new(outboxEntry))
+	if err != datastore.ErrNoSuchEntity {
+		t.Errorf("got:%v, want the entry to be deleted", err)
+	}
+}
+
+// serve serves the request with the outbox handler h.
+func (ot *outboxTest) serve(t *testing.T, h http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	r, err := ot.inst.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	ot := newOutboxTest(t)
+	defer ot.close()
+
+	ot.action.failures = 2
+	key := ot.save(t, "hello")
+
+	// first attempt fails
+	wait, err := dispatchEntry(ot.c, key)
+	if err == nil || wait != 20*time.Second {
+		t.Fatalf("got:(%v, %v), want:(%v, action failure)", wait, err, 20*time.Second)
+	}
+	entry := ot.entry(t, key)
+	if entry.Attempts != 1 || entry.LastError != "action failure" || entry.Dead {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if !entry.NextAttempt.Equal(ot.clock.now.Add(wait)) {
+		t.Errorf("got:%v, want:%v", entry.NextAttempt, ot.clock.now.Add(wait))
+	}
+
+	// not due yet
+	ot.clock.advance(5 * time.Second)
+	wait, err = dispatchEntry(ot.c, key)
+	if err != nil || wait != 15*time.Second {
+		t.Fatalf("got:(%v, %v), want:(%v, nil)", wait, err, 15*time.Second)
+	}
+	if ot.action.calls != 1 {
+		t.Errorf("got %d calls, want 1", ot.action.calls)
+	}
+
+	// second attempt fails with a longer backoff
+	ot.clock.advance(wait)
+	wait, err = dispatchEntry(ot.c, key)
+	if err == nil || wait != 40*time.Second {
+		t.Fatalf("got:(%v, %v), want:(%v, action failure)", wait, err, 40*time.Second)
+	}
+
+	// third attempt succeeds
+	ot.clock.advance(wait)
+	wait, err = dispatchEntry(ot.c, key)
+	if err != nil || wait != 0 {
+		t.Fatalf("got:(%v, %v), want:(0, nil)", wait, err)
+	}
+	ot.deleted(t, key)
+
+	if ot.action.calls != 3 || len(ot.action.payloads) != 1 || ot.action.payloads[0] != `"hello"` {
+		t.Errorf("unexpected action %+v", ot.action)
+	}
+
+	// dispatched already
+	wait, err = dispatchEntry(ot.c, key)
+	if err != nil || wait != 0 || ot.action.calls != 3 {
+		t.Errorf("got:(%v, %v, %d calls), want:(0, nil, 3 calls)", wait, err, ot.action.calls)
+	}
+}
+
+func TestOutboxLease(t *testing.T) {
+	ot := newOutboxTest(t)
+	defer ot.close()
+
+	key := ot.save(t, nil)
+
+	// an instance has leased the entry, and died before performing it
+	err := datastore.RunInTransaction(ot.c, func(c context.Context) error {
+		entry := new(outboxEntry)
+		if err := datastore.Get(c, key, entry); err != nil {
+			return err
+		}
+		entry.Attempts++
+		entry.NextAttempt = ot.clock.now.Add(outboxLease)
+		_, err := datastore.Put(c, key, entry)
+		return err
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leased
+	wait, err := dispatchEntry(ot.c, key)
+	if err != nil || wait != outboxLease {
+		t.Fatalf("got:(%v, %v), want:(%v, nil)", wait, err, outboxLease)
+	}
+
+	// the sweeper leaves the leased entry
+	w := ot.serve(t, sweepOutbox, "GET", "/tasks/dispatch_outbox", "")
+	if w.Code != http.StatusOK || ot.action.calls != 0 {
+		t.Fatalf("got:(%d, %d calls), want:(%d, 0 calls)", w.Code, ot.action.calls, http.StatusOK)
+	}
+
+	// the sweeper dispatches the entry once its lease has expired
+	ot.clock.advance(2*outboxLease + time.Second)
+	w = ot.serve(t, sweepOutbox, "GET", "/tasks/dispatch_outbox", "")
+	if w.Code != http.StatusOK || ot.action.calls != 1 {
+		t.Fatalf("got:(%d, %d calls), want:(%d, 1 call)", w.Code, ot.action.calls, http.StatusOK)
+	}
+	ot.deleted(t, key)
+}
+
+func TestOutboxDeadLetter(t *testing.T) {
+	ot := newOutboxTest(t)
+	defer ot.close()
+
+	ot.action.failures = outboxMaxAttempts
+	key := ot.save(t, "hello")
+
+	for i := 1; i <= outboxMaxAttempts; i++ {
+		wait, err := dispatchEntry(ot.c, key)
+		if err == nil {
+			t.Fatalf("attempt %d: want an error", i)
+		}
+		if i < outboxMaxAttempts && wait == 0 {
+			t.Fatalf("attempt %d: want a backoff", i)
+		}
+		if i == outboxMaxAttempts && wait != 0 {
+			t.Fatalf("attempt %d: got backoff %v, want 0", i, wait)
+		}
+		ot.clock.advance(outboxMaxBackoff)
+	}
+
+	entry := ot.entry(t, key)
+	if !entry.Dead || entry.Attempts != outboxMaxAttempts {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	// a dead entry is not attempted anymore
+	wait, err := dispatchEntry(ot.c, key)
+	if err != nil || wait != 0 || ot.action.calls != outboxMaxAttempts {
+		t.Fatalf("got:(%v, %v, %d calls), want:(0, nil, %d calls)",
+			wait, err, ot.action.calls, outboxMaxAttempts)
+	}
+
+	// nor swept
+	ot.serve(t, sweepOutbox, "GET", "/tasks/dispatch_outbox", "")
+	if ot.action.calls != outboxMaxAttempts {
+		t.Fatalf("got %d calls, want %d", ot.action.calls, outboxMaxAttempts)
+	}
+
+	// listed to the admins
+	w := ot.serve(t, deadLetters, "GET", "/admin/outbox", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	var letters []struct {
+		Key       string `json:"key"`
+		Action    string `json:"action"`
+		Attempts  int    `json:"attempts"`
+		LastError string `json:"lastError"`
+	}
+	if err = json.NewDecoder(w.Body).Decode(&letters); err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Key != key.Encode() || letters[0].Action != "test" ||
+		letters[0].Attempts != outboxMaxAttempts || letters[0].LastError != "action failure" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+
+	// revived
+	form := url.Values{"key": {key.Encode()}}.Encode()
+	w = ot.serve(t, deadLetters, "POST", "/admin/outbox", form)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	if ot.action.calls != outboxMaxAttempts+1 || len(ot.action.payloads) != 1 {
+		t.Fatalf("unexpected action %+v", ot.action)
+	}
+	ot.deleted(t, key)
+
+	w = ot.serve(t, deadLetters, "GET", "/admin/outbox", "")
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("got:%s, want:[]", w.Body.String())
+	}
+}
+
+func TestOutboxReviveInvalid(t *testing.T) {
+	ot := newOutboxTest(t)
+	defer ot.close()
+
+	w := ot.serve(t, deadLetters, "POST", "/admin/outbox", "key=invalid")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got:%d, want:%d", w.Code, http.StatusBadRequest)
+	}
+
+	missing := datastore.NewKey(ot.c, "Outbox", "", 1, ot.parent)
+	form := url.Values{"key": {missing.Encode()}}.Encode()
+	w = ot.serve(t, deadLetters, "POST", "/admin/outbox", form)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got:%d, want:%d", w.Code, http.StatusInternalServerError)
+	}
+}
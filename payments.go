@@ -0,0 +1,610 @@
+package ud859
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Payment statuses of a registration.
+const (
+	// PaymentPending holds a seat until the payment is confirmed.
+	PaymentPending   = "PENDING"
+	PaymentConfirmed = "CONFIRMED"
+)
+
+const (
+	// paymentHold is how long a seat is held for a pending payment.
+	paymentHold = 15 * time.Minute
+	// paymentGrace is how long after its hold a pending payment is released,
+	// so that the confirmations started before the hold has expired are over.
+	paymentGrace = time.Minute
+	// defaultCurrency is the currency of the conferences selling tickets.
+	defaultCurrency = "USD"
+)
+
+// errPaymentDeclined is returned by a PaymentProvider which declines a payment.
+var errPaymentDeclined = errors.New("payment declined")
+
+// Charge is the amount to pay for a registration.
+type Charge struct {
+	// Reference identifies the charge, a provider creates one checkout per reference.
+	Reference   string
+	Amount      int64
+	Currency    string
+	Email       string
+	Description string
+}
+
+// PaymentProvider processes the payments of the registrations. The provider is
+// never called within a transaction, which may be retried or fail after the call.
+type PaymentProvider interface {
+	// CreateCheckout creates a checkout for the charge and returns its id,
+	// creating again the checkout of a reference returns the same id.
+	CreateCheckout(c context.Context, charge *Charge) (string, error)
+	// Confirm confirms the payment of a checkout with the token given by the payer,
+	// or returns errPaymentDeclined. Confirming twice a checkout is not an error.
+	Confirm(c context.Context, id, token string) error
+	// Status returns PaymentConfirmed once the payment of a checkout is confirmed,
+	// PaymentPending otherwise.
+	Status(c context.Context, id string) (string, error)
+	// Refund refunds an amount of a confirmed payment and returns the id of the refund,
+	// refunding again a reference returns the same id.
+	Refund(c context.Context, id string, amount int64, reference string) (string, error)
+}
+
+// payments is the PaymentProvider of the ConferenceAPI,
+// a real provider replaces the fake one at init time.
+var payments PaymentProvider = fakeProvider{}
+
+// fakeProvider is a deterministic PaymentProvider charging nobody: the checkout ids
+// are derived from the charges, and the payments are declined with fakeDeclinedToken.
+type fakeProvider struct{}
+
+// fakeConfirmed records the checkouts confirmed by the fakeProvider in the instance.
+var fakeConfirmed = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+const (
+	fakeCheckoutPrefix = "fake_"
+	fakeRefundPrefix   = "fake_re_"
+	fakeDeclinedToken  = "tok_declined"
+)
+
+func (fakeProvider) CreateCheckout(c context.Context, charge *Charge) (string, error) {
+	if charge.Amount <= 0 {
+		return "", fmt.Errorf("invalid amount %d", charge.Amount)
+	}
+	sum := sha1.Sum([]byte(strings.Join([]string{
+		charge.Reference, strconv.FormatInt(charge.Amount, 10), charge.Currency}, "|")))
+	return fakeCheckoutPrefix + hex.EncodeToString(sum[:10]), nil
+}
+
+func (fakeProvider) Confirm(c context.Context, id, token string) error {
+	if !strings.HasPrefix(id, fakeCheckoutPrefix) {
+		return fmt.Errorf("unknown checkout %q", id)
+	}
+	if token == "" || token == fakeDeclinedToken {
+		return errPaymentDeclined
+	}
+
+	fakeConfirmed.Lock()
+	fakeConfirmed.ids[id] = true
+	fakeConfirmed.Unlock()
+	return nil
+}
+
+func (fakeProvider) Status(c context.Context, id string) (string, error) {
+	if !strings.HasPrefix(id, fakeCheckoutPrefix) {
+		return "", fmt.Errorf("unknown checkout %q", id)
+	}
+
+	fakeConfirmed.Lock()
+	defer fakeConfirmed.Unlock()
+	if fakeConfirmed.ids[id] {
+		return PaymentConfirmed, nil
+	}
+	return PaymentPending, nil
+}
+
+func (fakeProvider) Refund(c context.Context, id string, amount int64, reference string) (string, error) {
+	if !strings.HasPrefix(id, fakeCheckoutPrefix) {
+		return "", fmt.Errorf("unknown checkout %q", id)
+	}
+	if amount <= 0 {
+		return "", fmt.Errorf("invalid amount %d", amount)
+	}
+	sum := sha1.Sum([]byte(strings.Join([]string{id, strconv.FormatInt(amount, 10), reference}, "|")))
+	return fakeRefundPrefix + hex.EncodeToString(sum[:10]), nil
+}
+
+// validCurrency returns true if currency looks like an ISO 4217 code.
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Checkout is a seat held until its payment is confirmed by GotoConference.
+type Checkout struct {
+	WebsafeKey string    `json:"websafeConferenceKey"`
+	Ticket     string    `json:"ticket"`
+	PaymentID  string    `json:"paymentId"`
+	Amount     int64     `json:"amount"`
+	Currency   string    `json:"currency"`
+	Expires    time.Time `json:"expires"`
+}
+
+func init() {
+	http.HandleFunc("/tasks/release_holds", releaseHolds)
+}
+
+// CheckoutConference holds a seat of a paid ticket of the specified RegistrationForm,
+// until GotoConference confirms its payment. The pending registration is committed
+// before the checkout is created by the PaymentProvider.
+func (ConferenceAPI) CheckoutConference(c context.Context, form *RegistrationForm) (*Checkout, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+
+	now := time.Now()
+	rkey := registrationKey(c, ckey, pid.key)
+	pending, err := pendingCheckout(c, rkey)
+	if err != nil {
+		return nil, err
+	}
+
+	var conference *Conference
+	var charge *Charge
+	var checkout *Checkout
+	var events dispatcher
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		profile, err := loadProfile(c, pid)
+		if err != nil {
+			return err
+		}
+		conference, err = loadConference(c, ckey)
+		if err != nil {
+			return errBadRequest(err, "conference does not exist")
+		}
+
+		if profile.IsRegistered(conference.WebsafeKey) {
+			return errConflict("already registered")
+		}
+		if err := conference.checkRegistration(now); err != nil {
+			return err
+		}
+		if err := checkInvitation(c, ckey, conference, pid, form.Invitation); err != nil {
+			return err
+		}
+
+		// a new checkout replaces the pending one, whose payment is not confirmed
+		registration := new(Registration)
+		err = datastore.Get(c, rkey, registration)
+		if err == nil && registration.Status == PaymentPending {
+			if registration.PaymentID != pending {
+				return errConflict("checkout has changed, checkout again")
+			}
+			if err := releaseRegistration(c, ckey, conference, registration); err != nil {
+				return err
+			}
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return errInternalServer(err, "unable to get registration")
+		}
+
+		ticket, err := conference.ticket(form.Ticket)
+		if err != nil {
+			return err
+		}
+		price, discount, err := ticketPrice(c, ckey, ticket, form.PromoCode, now)
+		if err != nil {
+			return err
+		}
+		if price == 0 && discount > 0 {
+			return errBadRequest(fmt.Errorf("%s", form.PromoCode), "ticket is free with the promo code")
+		} else if price == 0 {
+			return errBadRequest(fmt.Errorf("%s", ticket.Type), "ticket is free")
+		}
+		typ := ticket.Type
+		answers, err := registrationAnswers(c, ckey, form.Answers)
+		if err != nil {
+			return err
+		}
+		if err := conference.reserve(typ); err != nil {
+			return err
+		}
+
+		// the reference is the same when the transaction is retried
+		charge = &Charge{
+			Reference:   rkey.Encode() + ":" + strconv.FormatInt(now.UnixNano(), 10),
+			Amount:      price,
+			Currency:    conference.Currency,
+			Email:       pid.email,
+			Description: conference.Name + " - " + strings.ToLower(typ) + " ticket",
+		}
+
+		registration = &Registration{
+			ProfileKey:       pid.key,
+			Email:            pid.email,
+			Ticket:           typ,
+			Created:          now,
+			Status:           PaymentPending,
+			PaymentReference: charge.Reference,
+			Amount:           price,
+			HoldUntil:        now.Add(paymentHold),
+			Answers:          answers,
+		}
+		if discount > 0 {
+			registration.PromoCode = normalizeCode(form.PromoCode)
+			registration.Discount = discount
+		}
+		_, err = datastore.Put(c, rkey, registration)
+		if err != nil {
+			return errInternalServer(err, "unable to save registration")
+		}
+		_, err = putConference(c, ckey, conference)
+		if err != nil {
+			return errInternalServer(err, "unable to save conference")
+		}
+
+		// publish the event
+		events = newDispatcher(ckey)
+		events.publish(&Event{
+			Name:          EventConferenceUpdated,
+			ConferenceKey: conference.WebsafeKey,
+			ProfileKey:    pid.key.Encode(),
+			Email:         pid.email,
+		})
+
+		err = events.save(c)
+		if err != nil {
+			return errInternalServer(err, "unable to publish event")
+		}
+
+		checkout = &Checkout{
+			WebsafeKey: conference.WebsafeKey,
+			Ticket:     typ,
+			Amount:     price,
+			Currency:   conference.Currency,
+			Expires:    registration.HoldUntil,
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the conference
+	cacheConference(c, ckey, conference)
+	events.flush(c)
+
+	// the seat is held until it expires, or until a new checkout replaces it
+	checkout.PaymentID, err = payments.CreateCheckout(c, charge)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to create checkout")
+	}
+	err = attachCheckout(c, rkey, charge.Reference, checkout.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	return checkout, nil
+}
+
+// attachCheckout records the checkout created for the reference in the pending registration.
+func attachCheckout(c context.Context, rkey *datastore.Key, reference, id string) error {
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		registration := new(Registration)
+		err := datastore.Get(c, rkey, registration)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return errInternalServer(err, "unable to get registration")
+		}
+		if err != nil || registration.Status != PaymentPending || registration.PaymentReference != reference {
+			return errConflict("checkout has been replaced or released")
+		}
+
+		registration.PaymentID = id
+		_, err = datastore.Put(c, rkey, registration)
+		if err != nil {
+			return errInternalServer(err, "unable to save registration")
+		}
+		return nil
+	}, nil)
+}
+
+// pendingCheckout returns the id of the payment of the pending registration at rkey,
+// if any, once the provider has not confirmed it: the registration may be replaced.
+// A payment confirmed meanwhile is settled instead. It must not be called within
+// a transaction.
+func pendingCheckout(c context.Context, rkey *datastore.Key) (string, error) {
+	registration := new(Registration)
+	err := datastore.Get(c, rkey, registration)
+	if err == datastore.ErrNoSuchEntity {
+		return "", nil
+	} else if err != nil {
+		return "", errInternalServer(err, "unable to get registration")
+	}
+	if registration.Status != PaymentPending || registration.PaymentID == "" {
+		return "", nil
+	}
+
+	status, err := payments.Status(c, registration.PaymentID)
+	if err != nil {
+		return "", errInternalServer(err, "unable to get payment status")
+	}
+	if status == PaymentConfirmed {
+		if err := settleHold(c, rkey, registration.PaymentID); err != nil {
+			return "", errInternalServer(err, "unable to settle payment")
+		}
+		return "", errConflict("already registered, the payment of the checkout is confirmed")
+	}
+	return registration.PaymentID, nil
+}
+
+// confirmCheckout confirms the payment of the pending registration at rkey, if any,
+// and returns the id of the payment confirmed. It must not be called within a transaction.
+func confirmCheckout(c context.Context, rkey *datastore.Key, form *RegistrationForm, now time.Time) (string, error) {
+	registration := new(Registration)
+	err := datastore.Get(c, rkey, registration)
+	if err == datastore.ErrNoSuchEntity {
+		return "", nil
+	} else if err != nil {
+		return "", errInternalServer(err, "unable to get registration")
+	}
+	if registration.Status != PaymentPending {
+		return "", nil
+	}
+
+	if registration.PaymentID == "" {
+		return "", errConflict("checkout is not complete, checkout again")
+	}
+	if !now.Before(registration.HoldUntil) {
+		return "", errConflict("payment hold has expired")
+	}
+	if form.Ticket != "" && form.Ticket != registration.Ticket {
+		return "", errBadRequest(fmt.Errorf("%s", form.Ticket), "ticket differs from the checkout")
+	}
+
+	err = payments.Confirm(c, registration.PaymentID, form.PaymentToken)
+	if err == errPaymentDeclined {
+		return "", errConflict("payment declined")
+	} else if err != nil {
+		return "", errInternalServer(err, "unable to confirm payment")
+	}
+	return registration.PaymentID, nil
+}
+
+// completePayment registers the pending registration whose payment has been confirmed,
+// within the transaction of the registration.
+func completePayment(c context.Context, ckey *datastore.Key, conference *Conference,
+	profile *Profile, registration *Registration) error {
+
+	registration.Status = PaymentConfirmed
+	registration.HoldUntil = time.Time{}
+
+	var err error
+	registration.InvoiceKey, err = issueInvoice(c, ckey, conference, profile, registration)
+	if err != nil {
+		return errInternalServer(err, "unable to issue invoice")
+	}
+	return nil
+}
+
+// releaseRegistration gives back the seat and the promo code use of a pending registration.
+func releaseRegistration(c context.Context, ckey *datastore.Key, conference *Conference, registration *Registration) error {
+	if err := conference.release(registration.Ticket); err != nil {
+		return err
+	}
+	if registration.PromoCode == "" {
+		return nil
+	}
+	err := releasePromoCode(c, ckey, registration.PromoCode, registration.Discount)
+	if err != nil {
+		return errInternalServer(err, "unable to release promo code")
+	}
+	return nil
+}
+
+// releaseHolds releases the seats held for the payments never confirmed.
+func releaseHolds(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	keys, err := datastore.NewQuery("Registration").
+		Filter("Status =", PaymentPending).
+		Filter("HoldUntil <", time.Now().Add(-paymentGrace)).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		log.Errorf(c, "unable to query registrations: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	for _, key := range keys {
+		if err := releaseHold(c, key); err != nil {
+			log.Errorf(c, "unable to release hold %s: %v", key.Encode(), err)
+		}
+	}
+}
+
+// releaseHold deletes the pending registration and gives back its seat, to the oldest
+// waitlisted application if any, unless the payment has been confirmed meanwhile.
+func releaseHold(c context.Context, rkey *datastore.Key) error {
+	ckey := rkey.Parent()
+
+	pending := new(Registration)
+	err := datastore.Get(c, rkey, pending)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if pending.Status != PaymentPending {
+		return nil
+	}
+	if pending.PaymentID != "" {
+		// the provider may have confirmed a payment whose registration has failed
+		status, err := payments.Status(c, pending.PaymentID)
+		if err != nil {
+			return err
+		}
+		if status == PaymentConfirmed {
+			return settleHold(c, rkey, pending.PaymentID)
+		}
+	}
+
+	var conference *Conference
+	var promoted *identity
+	var profile *Profile
+	var events dispatcher
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		conference, promoted = nil, nil
+
+		registration := new(Registration)
+		err := datastore.Get(c, rkey, registration)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		now := time.Now()
+		if registration.Status != PaymentPending || registration.PaymentID != pending.PaymentID ||
+			now.Before(registration.HoldUntil) {
+			return nil
+		}
+
+		conference, err = loadConference(c, ckey)
+		if err != nil {
+			return err
+		}
+		if err := releaseRegistration(c, ckey, conference, registration); err != nil {
+			return err
+		}
+		events = newDispatcher(ckey)
+		promoted, profile, err = promoteWaitlisted(c, ckey, conference, registration.Ticket, now, events)
+		if err != nil {
+			return err
+		}
+		_, err = putConference(c, ckey, conference)
+		if err != nil {
+			return err
+		}
+		err = datastore.Delete(c, rkey)
+		if err != nil {
+			return err
+		}
+
+		// publish the event
+		events.publish(&Event{
+			Name:          EventConferenceUpdated,
+			ConferenceKey: conference.WebsafeKey,
+		})
+		return events.save(c)
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil || conference == nil {
+		return err
+	}
+
+	// cache the entities
+	if promoted != nil {
+		cacheProfile(c, promoted.key, profile)
+	}
+	cacheConference(c, ckey, conference)
+	events.flush(c)
+	return nil
+}
+
+// settleHold registers the pending registration whose payment has been confirmed by the provider.
+func settleHold(c context.Context, rkey *datastore.Key, paymentID string) error {
+	ckey := rkey.Parent()
+
+	var pid *identity
+	var profile *Profile
+	var conference *Conference
+	var events dispatcher
+
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		profile = nil
+
+		registration := new(Registration)
+		err := datastore.Get(c, rkey, registration)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if registration.Status != PaymentPending || registration.PaymentID != paymentID {
+			return nil
+		}
+
+		pid = &identity{key: registration.ProfileKey, email: registration.Email}
+		profile, err = loadProfile(c, pid)
+		if err != nil {
+			return err
+		}
+		conference, err = loadConference(c, ckey)
+		if err != nil {
+			return err
+		}
+
+		if err := completePayment(c, ckey, conference, profile, registration); err != nil {
+			return err
+		}
+		profile.register(conference.WebsafeKey)
+		_, err = putProfile(c, pid.key, profile)
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(c, rkey, registration)
+		if err != nil {
+			return err
+		}
+
+		// publish the event
+		events = newDispatcher(ckey)
+		events.publish(&Event{
+			Name:          EventRegistrationCreated,
+			ConferenceKey: conference.WebsafeKey,
+			ProfileKey:    pid.key.Encode(),
+			Email:         pid.email,
+		})
+		return events.save(c)
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil || profile == nil {
+		return err
+	}
+
+	log.Warningf(c, "registration %s confirmed by its payment %s", rkey.Encode(), paymentID)
+	cacheProfile(c, pid.key, profile)
+	events.flush(c)
+	return nil
+}
@@ -0,0 +1,184 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestFakeProvider(t *testing.T) {
+	c := context.Background()
+	charge := &Charge{Reference: "registration:1", Amount: 5000, Currency: "EUR"}
+
+	id, err := payments.CreateCheckout(c, charge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := payments.CreateCheckout(c, charge)
+	if again != id {
+		t.Errorf("got:%s, want:%s", again, id)
+	}
+	other, _ := payments.CreateCheckout(c, &Charge{Reference: "registration:2", Amount: 5000, Currency: "EUR"})
+	if other == id {
+		t.Errorf("got:%s for two references", other)
+	}
+
+	if err := payments.Confirm(c, id, fakeDeclinedToken); err != errPaymentDeclined {
+		t.Errorf("got:%v, want:%v", err, errPaymentDeclined)
+	}
+	if status, err := payments.Status(c, id); err != nil || status != PaymentPending {
+		t.Errorf("got:%s %v, want:%s", status, err, PaymentPending)
+	}
+	if err := payments.Confirm(c, id, "tok_visa"); err != nil {
+		t.Error(err)
+	}
+	if status, err := payments.Status(c, id); err != nil || status != PaymentConfirmed {
+		t.Errorf("got:%s %v, want:%s", status, err, PaymentConfirmed)
+	}
+	if err := payments.Confirm(c, "ch_unknown", "tok_visa"); err == nil {
+		t.Error("confirmed an unknown checkout")
+	}
+	refund, err := payments.Refund(c, id, 2500, "refund:1")
+	if err != nil || !strings.HasPrefix(refund, fakeRefundPrefix) {
+		t.Errorf("got:%s %v, want a refund", refund, err)
+	}
+	if again, _ := payments.Refund(c, id, 2500, "refund:1"); again != refund {
+		t.Errorf("got:%s, want:%s", again, refund)
+	}
+}
+
+func TestReleaseHold(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := appengine.NewContext(r)
+
+	okey := datastore.NewKey(c, "Profile", "organizer@email", 0, nil)
+	ckey := datastore.NewKey(c, "Conference", "", 1, okey)
+	_, err = datastore.Put(c, ckey, &Conference{
+		Name:         "paidGo",
+		StartDate:    time.Now().AddDate(1, 0, 0),
+		MaxAttendees: 2,
+		Tickets:      []Ticket{{TicketRegular, 2, 0, 5000}},
+		Currency:     "EUR",
+		Status:       StatusPublished,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hold puts an expired pending registration, whose payment is confirmed with token
+	hold := func(email, token string) *datastore.Key {
+		pkey := datastore.NewKey(c, "Profile", email, 0, nil)
+		rkey := registrationKey(c, ckey, pkey)
+
+		id, err := payments.CreateCheckout(c, &Charge{Reference: rkey.Encode(), Amount: 5000, Currency: "EUR"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			if err = payments.Confirm(c, id, token); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = datastore.Put(c, rkey, &Registration{
+			ProfileKey: pkey,
+			Email:      email,
+			Ticket:     TicketRegular,
+			Status:     PaymentPending,
+			PaymentID:  id,
+			Amount:     5000,
+			HoldUntil:  time.Now().Add(-paymentHold),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rkey
+	}
+	paid := hold("alice@email", "tok_visa")
+	unpaid := hold("carol@email", "")
+
+	for _, rkey := range []*datastore.Key{paid, unpaid} {
+		if err = releaseHold(c, rkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the confirmed payment is registered
+	registration := new(Registration)
+	if err = datastore.Get(c, paid, registration); err != nil {
+		t.Fatal(err)
+	}
+	if registration.Status != PaymentConfirmed || registration.InvoiceKey == nil {
+		t.Errorf("got:%s %v, want:%s with an invoice", registration.Status, registration.InvoiceKey, PaymentConfirmed)
+	}
+	profile := new(Profile)
+	if err = datastore.Get(c, registration.ProfileKey, profile); err != nil {
+		t.Fatal(err)
+	}
+	if !profile.IsRegistered(ckey.Encode()) {
+		t.Errorf("alice should be registered")
+	}
+
+	// the unconfirmed payment is released
+	if err = datastore.Get(c, unpaid, new(Registration)); err != datastore.ErrNoSuchEntity {
+		t.Errorf("got:%v, want:%v", err, datastore.ErrNoSuchEntity)
+	}
+	conference, err := loadConference(c, ckey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conference.SeatsAvailable != 1 || conference.Tickets[0].SeatsAvailable != 1 {
+		t.Errorf("got:%d %v, want:1 seat available", conference.SeatsAvailable, conference.Tickets)
+	}
+
+	// the pending checkout is replaced once its payment is not confirmed
+	unpaid = hold("dave@email", "")
+	registration = new(Registration)
+	if err = datastore.Get(c, unpaid, registration); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := pendingCheckout(c, unpaid); err != nil || id != registration.PaymentID {
+		t.Errorf("got:(%s, %v), want:(%s, nil)", id, err, registration.PaymentID)
+	}
+
+	// or settled
+	paid = hold("erin@email", "tok_visa")
+	if _, err = pendingCheckout(c, paid); err == nil {
+		t.Errorf("got:nil, want:already registered")
+	}
+	registration = new(Registration)
+	if err = datastore.Get(c, paid, registration); err != nil {
+		t.Fatal(err)
+	}
+	if registration.Status != PaymentConfirmed {
+		t.Errorf("got:%s, want:%s", registration.Status, PaymentConfirmed)
+	}
+}
+
+func TestValidCurrency(t *testing.T) {
+	for currency, valid := range map[string]bool{
+		"USD": true, "EUR": true, "usd": false, "EURO": false, "U$D": false, "": false,
+	} {
+		if validCurrency(currency) != valid {
+			t.Errorf("%q got:%t, want:%t", currency, !valid, valid)
+		}
+	}
+}
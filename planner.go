@@ -0,0 +1,172 @@
+package ud859
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Query backends.
+const (
+	BackendDatastore = "DATASTORE"
+	BackendSearch    = "SEARCH"
+)
+
+// QueryPlan reports how a ConferenceQueryForm has been performed.
+type QueryPlan struct {
+	Backend string `json:"backend"`
+	Reason  string `json:"reason"`
+}
+
+// plan chooses the backend of the query: the datastore is strongly consistent
+// but only answers a few filters, the search index answers all the filters.
+// Until the conferences are backfilled, the datastore misses the older ones
+// in the queries on the properties indexed since.
+func (q ConferenceQueryForm) plan(backfilled bool) *QueryPlan {
+	order := q.order()
+	if order.scored {
+		return &QueryPlan{BackendSearch, "relevance ranking"}
+	}
+	if q.Near != nil {
+		return &QueryPlan{BackendSearch, "distance from a location"}
+	}
+
+	if len(q.Filters) == 0 {
+		if order.backfill && !backfilled {
+			return &QueryPlan{BackendSearch, "sort by " + order.expr + " not backfilled"}
+		}
+		return &QueryPlan{BackendDatastore, "no filters"}
+	}
+
+	for _, filter := range q.Filters {
+		if reason := filter.unplannable(backfilled); reason != "" {
+			return &QueryPlan{BackendSearch, reason}
+		}
+	}
+
+	for _, filter := range q.Filters {
+		if filter.Field == Key {
+			return &QueryPlan{BackendDatastore, "key lookup"}
+		}
+	}
+
+	// the composite indexes only sort the filtered conferences by START_DATE
+	if order.expr != StartDate {
+		return &QueryPlan{BackendSearch, "sort by " + order.expr + " with filters"}
+	}
+	return &QueryPlan{BackendDatastore, "indexed filters"}
+}
+
+// unplannable returns why the filter can not be answered by the datastore.
+func (f *Filter) unplannable(backfilled bool) string {
+	switch f.Field {
+	case Key:
+		if f.Op != EQ {
+			return "inequality on " + f.Field
+		}
+	case StartDate:
+		if f.Op == NE {
+			return "inequality on " + f.Field
+		}
+	case City:
+		if f.Op != EQ {
+			return "inequality on " + f.Field
+		}
+		if !backfilled {
+			return f.Field + " not backfilled"
+		}
+		if v, ok := f.Value.(string); !ok || len(tokenize(v)) == 0 {
+			return "no tokens in " + f.Field
+		}
+	case Month:
+		if f.Op != EQ {
+			return "inequality on " + f.Field
+		}
+		if !backfilled {
+			return f.Field + " not backfilled"
+		}
+	default:
+		return "full text search on " + f.Field
+	}
+	return ""
+}
+
+// datastoreConferences performs the query with the datastore.
+func datastoreConferences(c context.Context, form *ConferenceQueryForm) (*Conferences, error) {
+	for _, filter := range form.Filters {
+		if filter.Field == Key && filter.Op == EQ {
+			return lookupConference(c, form, filter.Value)
+		}
+	}
+
+	query := datastore.NewQuery("Conference")
+	for _, filter := range form.Filters {
+		switch filter.Field {
+		case StartDate:
+			query = filterDate(query, "START_DATE", filter.Op, filter.Value.(time.Time))
+		case City:
+			// the conferences whose city contains all the tokens
+			for _, token := range tokenize(filter.Value.(string)) {
+				query = query.Filter("CITY =", token)
+			}
+		case Month:
+			query = query.Filter("Month =", filter.Value)
+		}
+	}
+
+	items := make([]*Conference, 0)
+	keys, err := query.Order(form.order().property).GetAll(c, &items)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to query conference")
+	}
+
+	// the drafts and the private conferences are not listed
+	listed := make([]*Conference, 0, len(items))
+	for i := 0; i < len(items); i++ {
+		items[i].WebsafeKey = keys[i].Encode()
+		if items[i].listed() {
+			listed = append(listed, items[i])
+		}
+	}
+	return &Conferences{Items: listed}, nil
+}
+
+// filterDate restricts the property with the precision of the search index: the day.
+func filterDate(query *datastore.Query, property, op string, value time.Time) *datastore.Query {
+	year, month, day := value.UTC().Date()
+	first := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	next := first.AddDate(0, 0, 1)
+
+	switch op {
+	case EQ:
+		return query.Filter(property+" >=", first).Filter(property+" <", next)
+	case LT:
+		return query.Filter(property+" <", first)
+	case GT:
+		return query.Filter(property+" >=", next)
+	case LTE:
+		return query.Filter(property+" <", next)
+	case GTE:
+		return query.Filter(property+" >=", first)
+	}
+	return query
+}
+
+// lookupConference gets the conference by key and evaluates the other filters.
+func lookupConference(c context.Context, form *ConferenceQueryForm, value interface{}) (*Conferences, error) {
+	items := make([]*Conference, 0)
+
+	safeKey, _ := value.(string)
+	key, err := datastore.DecodeKey(safeKey)
+	if err != nil {
+		return &Conferences{Items: items}, nil
+	}
+
+	conference, err := getConference(c, key)
+	if err == nil && conference.listed() && form.match(conference) {
+		items = append(items, conference)
+	}
+	return &Conferences{Items: items}, nil
+}
@@ -1,6 +1,9 @@
 package ud859
 
 import (
+	"net/mail"
+	"strings"
+
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine/datastore"
@@ -15,6 +18,10 @@ type Profile struct {
 	TeeShirtSize string `json:"teeShirtSize"`
 	// Conferences is a list of conferences WebsafeKey.
 	Conferences []string `json:"conferenceKeysToAttend"`
+	// Pending is true for a profile created by a transfer, until its user saves it.
+	Pending bool `json:"pending,omitempty" datastore:",noindex"`
+	// Version is incremented each time the profile is saved.
+	Version int64 `json:"-" datastore:",noindex"`
 }
 
 // ProfileForm gives details about a Profile to create or update.
@@ -26,6 +33,19 @@ type ProfileForm struct {
 type identity struct {
 	key   *datastore.Key
 	email string
+	// domain is the authentication domain of the user.
+	domain string
+}
+
+// profileName returns the name of the profile of the email. The user service
+// names the users of the authentication domain without their domain, and the
+// emails are case insensitive.
+func profileName(email, domain string) string {
+	email = strings.ToLower(email)
+	if domain != "" && strings.HasSuffix(email, "@"+strings.ToLower(domain)) {
+		return email[:len(email)-len(domain)-1]
+	}
+	return email
 }
 
 func profileID(c context.Context) (*identity, error) {
@@ -34,8 +54,26 @@ func profileID(c context.Context) (*identity, error) {
 		return nil, errUnauthorized(err, "signin required")
 	}
 	return &identity{
-		key:   datastore.NewKey(c, "Profile", u.String(), 0, nil),
-		email: u.Email,
+		key:    datastore.NewKey(c, "Profile", profileName(u.Email, u.AuthDomain), 0, nil),
+		email:  u.Email,
+		domain: u.AuthDomain,
+	}, nil
+}
+
+// emailID returns the identity of the user of the email, the current user for its own email.
+// The profiles of the other users are named after their email as the profile of the current user.
+func emailID(c context.Context, pid *identity, email string) (*identity, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(address.Address, pid.email) {
+		return pid, nil
+	}
+	return &identity{
+		key:    datastore.NewKey(c, "Profile", profileName(address.Address, pid.domain), 0, nil),
+		email:  strings.ToLower(address.Address),
+		domain: pid.domain,
 	}, nil
 }
 
@@ -48,8 +86,29 @@ func (ConferenceAPI) GetProfile(c context.Context) (*Profile, error) {
 	return getProfile(c, pid)
 }
 
+// getProfile reads the profile from cache, or from the datastore on cache miss.
 func getProfile(c context.Context, pid *identity) (*Profile, error) {
-	// get the profile
+	profile := new(Profile)
+	if getCacheEntity(c, profileCacheKey(pid.key), profile) {
+		profile.Email = pid.email
+		return profile, nil
+	}
+
+	profile, err := loadProfile(c, pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the profile, unless it is not saved yet
+	if profile.Version > 0 {
+		cacheProfile(c, pid.key, profile)
+	}
+	return profile, nil
+}
+
+// loadProfile reads the profile from the datastore.
+// Transactions must use loadProfile as the cached profile may be stale.
+func loadProfile(c context.Context, pid *identity) (*Profile, error) {
 	profile := new(Profile)
 	err := datastore.Get(c, pid.key, profile)
 	if err != nil && err != datastore.ErrNoSuchEntity {
@@ -60,6 +119,12 @@ func getProfile(c context.Context, pid *identity) (*Profile, error) {
 	return profile, nil
 }
 
+// putProfile saves the profile in the datastore with a new version.
+func putProfile(c context.Context, key *datastore.Key, profile *Profile) (*datastore.Key, error) {
+	profile.Version++
+	return datastore.Put(c, key, profile)
+}
+
 // SaveProfile saves the current user's Profile in the datastore from the specified ProfileForm.
 func (ConferenceAPI) SaveProfile(c context.Context, form *ProfileForm) error {
 	pid, err := profileID(c)
@@ -67,9 +132,13 @@ func (ConferenceAPI) SaveProfile(c context.Context, form *ProfileForm) error {
 		return err
 	}
 
-	return datastore.RunInTransaction(c, func(c context.Context) error {
+	var profile *Profile
+	var events dispatcher
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
 		// get the profile
-		profile, err := getProfile(c, pid)
+		var err error
+		profile, err = loadProfile(c, pid)
 		if err != nil {
 			return err
 		}
@@ -77,11 +146,34 @@ func (ConferenceAPI) SaveProfile(c context.Context, form *ProfileForm) error {
 		// set the form values
 		profile.DisplayName = form.DisplayName
 		profile.TeeShirtSize = form.TeeShirtSize
+		profile.Pending = false
 
-		_, err = datastore.Put(c, pid.key, profile)
+		_, err = putProfile(c, pid.key, profile)
 		if err != nil {
 			return errInternalServer(err, "unable to save profile")
 		}
+
+		// publish the event
+		events = newDispatcher(pid.key)
+		events.publish(&Event{
+			Name:       EventProfileSaved,
+			ProfileKey: pid.key.Encode(),
+			Email:      pid.email,
+		})
+
+		err = events.save(c)
+		if err != nil {
+			return errInternalServer(err, "unable to publish event")
+		}
 		return nil
 	}, nil)
+
+	if err != nil {
+		return err
+	}
+
+	// cache the profile
+	cacheProfile(c, pid.key, profile)
+	events.flush(c)
+	return nil
 }
@@ -0,0 +1,25 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import "testing"
+
+func TestProfileName(t *testing.T) {
+	tts := []struct {
+		email, domain string
+		name          string
+	}{
+		// the users of the authentication domain are named without it
+		{"alice@gmail.com", "gmail.com", "alice"},
+		{"Alice@GMail.com", "gmail.com", "alice"},
+		{"bob@example.com", "gmail.com", "bob@example.com"},
+		{"Bob@Example.com", "", "bob@example.com"},
+	}
+
+	for _, tt := range tts {
+		if name := profileName(tt.email, tt.domain); name != tt.name {
+			t.Errorf("profileName(%q, %q) got:%q, want:%q", tt.email, tt.domain, name, tt.name)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package ud859
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// maxPromoCodeLength is the length of the longest promo code.
+const maxPromoCodeLength = 32
+
+// PromoCode is a discount on the tickets of a conference, its key is named
+// after the code and is a child of the conference key.
+type PromoCode struct {
+	Code string `json:"code" datastore:"-"`
+	// Percent or Amount, in the currency of the conference, is discounted.
+	Percent int   `json:"percent,omitempty" datastore:",noindex"`
+	Amount  int64 `json:"amount,omitempty" datastore:",noindex"`
+	// MaxUses limits the redemptions of the code, 0 is unlimited.
+	MaxUses int `json:"maxUses" datastore:",noindex"`
+	// The code is valid from ValidFrom until ValidUntil, when not zero.
+	ValidFrom  time.Time `json:"validFrom" datastore:",noindex"`
+	ValidUntil time.Time `json:"validUntil" datastore:",noindex"`
+	// Tickets restricts the code to ticket types, all when empty.
+	Tickets []string  `json:"tickets" datastore:",noindex"`
+	Created time.Time `json:"-" datastore:",noindex"`
+
+	// Uses counts the redemptions, including the seats held by a checkout.
+	Uses int `json:"uses" datastore:",noindex"`
+	// Discounted is the total amount discounted.
+	Discounted int64 `json:"discounted" datastore:",noindex"`
+}
+
+// PromoCodeForm creates a PromoCode.
+type PromoCodeForm struct {
+	WebsafeKey string   `json:"websafeConferenceKey" endpoints:"req"`
+	Code       string   `json:"code" endpoints:"req"`
+	Percent    int      `json:"percent"`
+	Amount     int64    `json:"amount"`
+	MaxUses    int      `json:"maxUses"`
+	ValidFrom  string   `json:"validFrom"`
+	ValidUntil string   `json:"validUntil"`
+	Tickets    []string `json:"tickets"`
+}
+
+// PromoCodes is a list of PromoCodes with their redemption stats.
+type PromoCodes struct {
+	Items []*PromoCode `json:"items"`
+}
+
+// normalizeCode returns the canonical form of a promo code.
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func promoCodeKey(c context.Context, ckey *datastore.Key, code string) *datastore.Key {
+	return datastore.NewKey(c, "PromoCode", normalizeCode(code), 0, ckey)
+}
+
+// fromPromoCodeForm creates a new PromoCode from a PromoCodeForm.
+func fromPromoCodeForm(form *PromoCodeForm) (*PromoCode, error) {
+	code := normalizeCode(form.Code)
+	if code == "" || len(code) > maxPromoCodeLength {
+		return nil, fmt.Errorf("invalid code %q", form.Code)
+	}
+	for _, r := range code {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return nil, fmt.Errorf("invalid code %q", form.Code)
+		}
+	}
+
+	if (form.Percent == 0) == (form.Amount == 0) {
+		return nil, fmt.Errorf("either a percent or an amount is discounted")
+	}
+	if form.Percent < 0 || form.Percent > 100 || form.Amount < 0 {
+		return nil, fmt.Errorf("invalid discount")
+	}
+	if form.MaxUses < 0 {
+		return nil, fmt.Errorf("invalid max uses %d", form.MaxUses)
+	}
+
+	window := make([]time.Time, 2)
+	for i, value := range []string{form.ValidFrom, form.ValidUntil} {
+		if value == "" {
+			continue
+		}
+		var err error
+		window[i], err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !window[0].IsZero() && !window[1].IsZero() && !window[0].Before(window[1]) {
+		return nil, fmt.Errorf("code expires before it is valid")
+	}
+
+	for _, typ := range form.Tickets {
+		if !validTicketType(typ) {
+			return nil, fmt.Errorf("invalid ticket type %q", typ)
+		}
+	}
+
+	return &PromoCode{
+		Code:       code,
+		Percent:    form.Percent,
+		Amount:     form.Amount,
+		MaxUses:    form.MaxUses,
+		ValidFrom:  window[0],
+		ValidUntil: window[1],
+		Tickets:    form.Tickets,
+	}, nil
+}
+
+// discount returns the amount discounted from the price of the ticket at now.
+func (promo *PromoCode) discount(ticket *Ticket, now time.Time) (int64, error) {
+	if !promo.ValidFrom.IsZero() && now.Before(promo.ValidFrom) {
+		return 0, errConflict("promo code is not valid yet")
+	}
+	if !promo.ValidUntil.IsZero() && !now.Before(promo.ValidUntil) {
+		return 0, errConflict("promo code has expired")
+	}
+	if promo.MaxUses > 0 && promo.Uses >= promo.MaxUses {
+		return 0, errConflict("promo code has been used up")
+	}
+
+	if len(promo.Tickets) > 0 {
+		valid := false
+		for _, typ := range promo.Tickets {
+			valid = valid || typ == ticket.Type
+		}
+		if !valid {
+			return 0, errBadRequest(fmt.Errorf("%s", ticket.Type), "promo code not valid for ticket type")
+		}
+	}
+
+	if promo.Percent > 0 {
+		return ticket.Price * int64(promo.Percent) / 100, nil
+	}
+	if promo.Amount > ticket.Price {
+		return ticket.Price, nil
+	}
+	return promo.Amount, nil
+}
+
+// CreatePromoCode creates a promo code of a conference created by the current user.
+func (ConferenceAPI) CreatePromoCode(c context.Context, form *PromoCodeForm) (*PromoCode, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return nil, errForbidden("not the organizer of the conference")
+	}
+
+	promo, err := fromPromoCodeForm(form)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid promo code")
+	}
+	promo.Created = time.Now()
+
+	key := promoCodeKey(c, ckey, promo.Code)
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		if _, err := loadConference(c, ckey); err != nil {
+			return errBadRequest(err, "conference does not exist")
+		}
+
+		err := datastore.Get(c, key, new(PromoCode))
+		if err == nil {
+			return errConflict("promo code already exists")
+		} else if err != datastore.ErrNoSuchEntity {
+			return errInternalServer(err, "unable to get promo code")
+		}
+
+		_, err = datastore.Put(c, key, promo)
+		if err != nil {
+			return errInternalServer(err, "unable to save promo code")
+		}
+		return nil
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+	return promo, nil
+}
+
+// PromoCodes returns the promo codes of a conference created by the current user,
+// with their redemption stats.
+func (ConferenceAPI) PromoCodes(c context.Context, form *ConferenceKeyForm) (*PromoCodes, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return nil, errForbidden("not the organizer of the conference")
+	}
+
+	promos := make([]*PromoCode, 0)
+	keys, err := datastore.NewQuery("PromoCode").
+		Ancestor(ckey).
+		GetAll(c, &promos)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to query promo codes")
+	}
+	for i, key := range keys {
+		promos[i].Code = key.StringID()
+	}
+	return &PromoCodes{Items: promos}, nil
+}
+
+// redeemPromoCode counts a use of the promo code for the ticket and returns
+// the amount discounted, within the transaction of the registration.
+func redeemPromoCode(c context.Context, ckey *datastore.Key, code string, ticket *Ticket, now time.Time) (int64, error) {
+	key := promoCodeKey(c, ckey, code)
+	promo := new(PromoCode)
+	err := datastore.Get(c, key, promo)
+	if err == datastore.ErrNoSuchEntity {
+		return 0, errBadRequest(fmt.Errorf("%q", code), "unknown promo code")
+	} else if err != nil {
+		return 0, errInternalServer(err, "unable to get promo code")
+	}
+
+	discount, err := promo.discount(ticket, now)
+	if err != nil {
+		return 0, err
+	}
+	promo.Uses++
+	promo.Discounted += discount
+
+	_, err = datastore.Put(c, key, promo)
+	if err != nil {
+		return 0, errInternalServer(err, "unable to save promo code")
+	}
+	return discount, nil
+}
+
+// ticketPrice returns the price to pay for the ticket and the amount discounted by
+// the promo code, if any, within the transaction of the registration. The tickets
+// with a price to pay are registered by CheckoutConference, the others by GotoConference.
+func ticketPrice(c context.Context, ckey *datastore.Key, ticket *Ticket, code string, now time.Time) (int64, int64, error) {
+	if code == "" || ticket.Price == 0 {
+		return ticket.Price, 0, nil
+	}
+	discount, err := redeemPromoCode(c, ckey, code, ticket, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ticket.Price - discount, discount, nil
+}
+
+// releasePromoCode gives back the use of the promo code by a released seat.
+func releasePromoCode(c context.Context, ckey *datastore.Key, code string, discount int64) error {
+	key := promoCodeKey(c, ckey, code)
+	promo := new(PromoCode)
+	err := datastore.Get(c, key, promo)
+	if err != nil {
+		return err
+	}
+
+	// the uses released twice, or never counted, are not given back
+	if promo.Uses > 0 {
+		promo.Uses--
+	}
+	promo.Discounted -= discount
+	if promo.Discounted < 0 {
+		promo.Discounted = 0
+	}
+	_, err = datastore.Put(c, key, promo)
+	return err
+}
@@ -0,0 +1,71 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFromPromoCodeForm(t *testing.T) {
+	tts := []struct {
+		form  PromoCodeForm
+		valid bool
+	}{
+		{PromoCodeForm{Code: " early-bird ", Percent: 20}, true},
+		{PromoCodeForm{Code: "GOPHERS", Amount: 500, MaxUses: 10, Tickets: []string{TicketStudent}}, true},
+		{PromoCodeForm{Code: "", Percent: 20}, false},
+		{PromoCodeForm{Code: "EARLY BIRD", Percent: 20}, false},
+		{PromoCodeForm{Code: "EARLY"}, false},
+		{PromoCodeForm{Code: "EARLY", Percent: 20, Amount: 500}, false},
+		{PromoCodeForm{Code: "EARLY", Percent: 120}, false},
+		{PromoCodeForm{Code: "EARLY", Percent: 20, MaxUses: -1}, false},
+		{PromoCodeForm{Code: "EARLY", Percent: 20, Tickets: []string{"VIP"}}, false},
+		{PromoCodeForm{Code: "EARLY", Percent: 20,
+			ValidFrom: "2017-01-01T00:00:00Z", ValidUntil: "2016-01-01T00:00:00Z"}, false},
+	}
+
+	for _, tt := range tts {
+		promo, err := fromPromoCodeForm(&tt.form)
+		if (err == nil) != tt.valid {
+			t.Errorf("%+v got:%v, want valid:%t", tt.form, err, tt.valid)
+		}
+		if err == nil && promo.Code != normalizeCode(tt.form.Code) {
+			t.Errorf("got:%s, want:%s", promo.Code, normalizeCode(tt.form.Code))
+		}
+	}
+}
+
+func TestDiscount(t *testing.T) {
+	now := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	regular := &Ticket{TicketRegular, 10, 10, 1000}
+	student := &Ticket{TicketStudent, 10, 10, 400}
+
+	tts := []struct {
+		promo    PromoCode
+		ticket   *Ticket
+		discount int64
+		valid    bool
+	}{
+		{PromoCode{Percent: 25}, regular, 250, true},
+		{PromoCode{Amount: 500}, regular, 500, true},
+		{PromoCode{Amount: 500}, student, 400, true},
+		{PromoCode{Percent: 25, MaxUses: 2, Uses: 1}, regular, 250, true},
+		{PromoCode{Percent: 25, MaxUses: 2, Uses: 2}, regular, 0, false},
+		{PromoCode{Percent: 25, ValidFrom: now.Add(time.Hour)}, regular, 0, false},
+		{PromoCode{Percent: 25, ValidUntil: now}, regular, 0, false},
+		{PromoCode{Percent: 25, Tickets: []string{TicketStudent}}, student, 100, true},
+		{PromoCode{Percent: 25, Tickets: []string{TicketStudent}}, regular, 0, false},
+	}
+
+	for _, tt := range tts {
+		discount, err := tt.promo.discount(tt.ticket, now)
+		if (err == nil) != tt.valid {
+			t.Errorf("%+v got:%v, want valid:%t", tt.promo, err, tt.valid)
+		}
+		if discount != tt.discount {
+			t.Errorf("%+v got:%d, want:%d", tt.promo, discount, tt.discount)
+		}
+	}
+}
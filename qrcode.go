@@ -0,0 +1,496 @@
+package ud859
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// The QR codes are encoded in byte mode with the error correction level M,
+// up to version 10: 213 bytes.
+const (
+	qrMaxVersion = 10
+	// qrQuietZone and qrScale are the border and the size of a module in pixels.
+	qrQuietZone = 4
+	qrScale     = 8
+)
+
+// qrBlocks gives, by version, the error correction codewords of each block
+// and the data codewords of the blocks: the first group, then the second group.
+var qrBlocks = [qrMaxVersion + 1]struct {
+	ec     int
+	blocks []int
+}{
+	1:  {10, []int{16}},
+	2:  {16, []int{28}},
+	3:  {26, []int{44}},
+	4:  {18, []int{32, 32}},
+	5:  {24, []int{43, 43}},
+	6:  {16, []int{27, 27, 27, 27}},
+	7:  {18, []int{31, 31, 31, 31}},
+	8:  {22, []int{38, 38, 39, 39}},
+	9:  {22, []int{36, 36, 36, 37, 37}},
+	10: {26, []int{43, 43, 43, 43, 44}},
+}
+
+// qrAlignments gives, by version, the centers of the alignment patterns.
+var qrAlignments = [qrMaxVersion + 1][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+// qrCode is a matrix of modules, true is dark.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// renderQR renders the data as a QR code PNG image.
+func renderQR(data []byte) ([]byte, error) {
+	qr, err := encodeQR(data)
+	if err != nil {
+		return nil, err
+	}
+
+	side := (qr.size + 2*qrQuietZone) * qrScale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < qrScale; dy++ {
+				for dx := 0; dx < qrScale; dx++ {
+					img.SetGray((x+qrQuietZone)*qrScale+dx, (y+qrQuietZone)*qrScale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeQR encodes the data in the smallest version, with the mask of the lowest penalty.
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 1
+	for ; version <= qrMaxVersion; version++ {
+		if len(data) <= qrCapacity(version) {
+			break
+		}
+	}
+	if version > qrMaxVersion {
+		return nil, fmt.Errorf("%d bytes do not fit in a QR code", len(data))
+	}
+
+	codewords := qrCodewords(version, data)
+	var best *qrCode
+	bestPenalty := 0
+	for mask := 0; mask < 8; mask++ {
+		qr := newQRCode(version)
+		qr.drawCodewords(codewords)
+		qr.applyMask(mask)
+		qr.drawFormat(mask)
+		if penalty := qr.penalty(); best == nil || penalty < bestPenalty {
+			best, bestPenalty = qr, penalty
+		}
+	}
+	return best, nil
+}
+
+// qrCapacity returns the number of bytes encoded by the version.
+func qrCapacity(version int) int {
+	total := 0
+	for _, n := range qrBlocks[version].blocks {
+		total += n
+	}
+	// the mode indicator and the character count
+	if version < 10 {
+		return total - 2
+	}
+	return total - 3
+}
+
+// qrCodewords returns the data and error correction codewords of the data,
+// interleaved by block.
+func qrCodewords(version int, data []byte) []byte {
+	capacity := 0
+	for _, n := range qrBlocks[version].blocks {
+		capacity += n
+	}
+
+	// the byte mode segment, terminated and padded
+	var bits qrBits
+	bits.append(0x4, 4)
+	if version < 10 {
+		bits.append(len(data), 8)
+	} else {
+		bits.append(len(data), 16)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity*8; i++ {
+		bits.append(0, 1)
+	}
+	for len(bits)%8 != 0 {
+		bits.append(0, 1)
+	}
+	for pad := 0xec; len(bits) < capacity*8; pad ^= 0xec ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := bits.bytes()
+
+	// split in blocks and compute their error correction
+	ec := qrBlocks[version].ec
+	divisor := rsDivisor(ec)
+	var blocks, ecBlocks [][]byte
+	for _, n := range qrBlocks[version].blocks {
+		blocks = append(blocks, codewords[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(codewords[:n], divisor))
+		codewords = codewords[n:]
+	}
+
+	var result []byte
+	longest := len(blocks[len(blocks)-1])
+	for i := 0; i < longest; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < ec; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// qrBits is a sequence of bits.
+type qrBits []bool
+
+// append appends the n lower bits of value, the most significant first.
+func (bits *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bits = append(*bits, value>>uint(i)&1 == 1)
+	}
+}
+
+func (bits qrBits) bytes() []byte {
+	result := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			result[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return result
+}
+
+// rsMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func rsMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ (z>>7)*0x11d
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the degree,
+// the coefficients from the highest power, the leading 1 omitted.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = rsMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = rsMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords of the data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= rsMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// newQRCode returns a QR code of the version with its function patterns.
+func newQRCode(version int) *qrCode {
+	size := 4*version + 17
+	qr := &qrCode{size: size}
+	qr.modules = make([][]bool, size)
+	qr.function = make([][]bool, size)
+	for i := range qr.modules {
+		qr.modules[i] = make([]bool, size)
+		qr.function[i] = make([]bool, size)
+	}
+
+	// timing patterns
+	for i := 0; i < size; i++ {
+		qr.set(6, i, i%2 == 0)
+		qr.set(i, 6, i%2 == 0)
+	}
+
+	// finder patterns with their separators
+	for _, center := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					dist := qrDistance(dx, dy)
+					qr.set(x, y, dist != 2 && dist != 4)
+				}
+			}
+		}
+	}
+
+	// alignment patterns, but over the finder patterns
+	positions := qrAlignments[version]
+	last := len(positions) - 1
+	for i, cx := range positions {
+		for j, cy := range positions {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.set(cx+dx, cy+dy, qrDistance(dx, dy) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format areas, then draw the version
+	qr.drawFormat(0)
+	if version >= 7 {
+		bits := qrVersionBits(version)
+		for i := 0; i < 18; i++ {
+			bit := bits>>uint(i)&1 == 1
+			a, b := size-11+i%3, i/3
+			qr.set(a, b, bit)
+			qr.set(b, a, bit)
+		}
+	}
+	return qr
+}
+
+// set sets the function module at column x and row y.
+func (qr *qrCode) set(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+// qrFormatBits returns the format information of the level M and the mask.
+func qrFormatBits(mask int) int {
+	data := 0<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// qrVersionBits returns the version information.
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ (rem>>11)*0x1f25
+	}
+	return version<<12 | rem
+}
+
+// drawFormat draws both copies of the format information.
+func (qr *qrCode) drawFormat(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool {
+		return bits>>uint(i)&1 == 1
+	}
+
+	for i := 0; i < 6; i++ {
+		qr.set(8, i, bit(i))
+	}
+	qr.set(8, 7, bit(6))
+	qr.set(8, 8, bit(7))
+	qr.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.set(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.set(8, qr.size-15+i, bit(i))
+	}
+	// the dark module
+	qr.set(8, qr.size-8, true)
+}
+
+// drawCodewords places the codewords in zigzag, from the bottom right corner.
+func (qr *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// skip the vertical timing pattern
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < qr.size; vert++ {
+			y := vert
+			if upward {
+				y = qr.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if qr.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				qr.modules[y][x] = codewords[i/8]>>uint(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the mask.
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.function[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the patterns which make the QR code harder to read.
+func (qr *qrCode) penalty() int {
+	penalty := 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return qr.modules[x][y]
+		}
+		return qr.modules[y][x]
+	}
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < qr.size; y++ {
+			// runs of the same color
+			run := 1
+			for x := 1; x < qr.size; x++ {
+				if at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				penalty += run - 2
+			}
+
+			// patterns like the finder patterns
+			for x := 0; x+11 <= qr.size; x++ {
+				var pattern int
+				for i := 0; i < 11; i++ {
+					pattern <<= 1
+					if at(x+i, y, vertical) {
+						pattern |= 1
+					}
+				}
+				if pattern == 0x5d0 || pattern == 0x05d {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	// blocks of the same color
+	dark := 0
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := qr.modules[y][x]
+				if c == qr.modules[y-1][x] && c == qr.modules[y][x-1] && c == qr.modules[y-1][x-1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	// the balance of dark and light modules
+	total := qr.size * qr.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return penalty + k*10
+}
+
+// qrDistance returns the distance of a module to the center of a pattern.
+func qrDistance(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,99 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// HELLO WORLD in alphanumeric mode, version 1-M
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got:%v, want:%v", got, want)
+	}
+}
+
+func TestQRFormatBits(t *testing.T) {
+	for mask, want := range []string{
+		"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+		"100010111111001", "100000011001110", "100111110010111", "100101010100000",
+	} {
+		if got := fmt.Sprintf("%015b", qrFormatBits(mask)); got != want {
+			t.Errorf("mask %d got:%s, want:%s", mask, got, want)
+		}
+	}
+	if got := fmt.Sprintf("%018b", qrVersionBits(7)); got != "000111110010010100" {
+		t.Errorf("got:%s, want:000111110010010100", got)
+	}
+}
+
+func TestQRBlocks(t *testing.T) {
+	for version := 1; version <= qrMaxVersion; version++ {
+		// the modules which are not function patterns hold the codewords
+		qr := newQRCode(version)
+		modules := 0
+		for y := range qr.function {
+			for x := range qr.function[y] {
+				if !qr.function[y][x] {
+					modules++
+				}
+			}
+		}
+
+		blocks := qrBlocks[version]
+		total := 0
+		for _, n := range blocks.blocks {
+			total += n + blocks.ec
+		}
+		if total != modules/8 {
+			t.Errorf("version %d got:%d, want:%d codewords", version, total, modules/8)
+		}
+		if got := len(qrCodewords(version, nil)); got != total {
+			t.Errorf("version %d got:%d, want:%d codewords", version, got, total)
+		}
+	}
+}
+
+func TestRenderQR(t *testing.T) {
+	for size, version := range map[int]int{14: 1, 15: 2, 100: 6, 213: 10} {
+		qr, err := encodeQR([]byte(strings.Repeat("a", size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if qr.size != 4*version+17 {
+			t.Errorf("%d bytes got:%d, want:%d modules", size, qr.size, 4*version+17)
+		}
+	}
+	if _, err := encodeQR(make([]byte, 214)); err == nil {
+		t.Errorf("got:nil, want too large")
+	}
+
+	image, err := renderQR([]byte("ticket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if side := (21 + 2*qrQuietZone) * qrScale; img.Bounds().Dx() != side {
+		t.Errorf("got:%d, want:%d pixels", img.Bounds().Dx(), side)
+	}
+
+	// the top left module of the finder pattern is dark, the quiet zone is light
+	corner := qrQuietZone * qrScale
+	if r, _, _, _ := img.At(corner, corner).RGBA(); r != 0 {
+		t.Errorf("got:%d, want a dark module", r)
+	}
+	if r, _, _, _ := img.At(corner-1, corner).RGBA(); r == 0 {
+		t.Errorf("got:%d, want a light module", r)
+	}
+}
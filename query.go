@@ -1,15 +1,28 @@
 package ud859
 
 import (
+	"fmt"
+	"time"
+
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
 // ConferenceQueryForm wraps a list of filters.
 type ConferenceQueryForm struct {
 	Filters []*Filter `json:"filters"`
+	// Query is a query string like `city:London month>=6 "cloud native"`,
+	// compiled to filters.
+	Query string `json:"query"`
+	// Explain reports the QueryPlan in the response.
+	Explain bool `json:"explain"`
+	// Sort is one of the Sort orders, SortStartDate by default.
+	Sort string `json:"sort"`
+	// Near restricts the conferences to a radius around a location.
+	Near *Near `json:"near"`
+	// RegistrationOpen restricts the conferences to those open for registration today.
+	RegistrationOpen bool `json:"registrationOpen"`
 }
 
 // Filter describes a query restriction.
@@ -27,35 +40,56 @@ func (q *ConferenceQueryForm) Filter(field string, op string, value interface{})
 
 // QueryConferences searches for Conferences with the specified ConferenceQueryForm.
 func (ConferenceAPI) QueryConferences(c context.Context, form *ConferenceQueryForm) (*Conferences, error) {
-	// perform search on index
-	if len(form.Filters) > 0 {
-		return searchConferences(c, form)
+	if _, ok := sortOrders[form.Sort]; !ok && form.Sort != "" {
+		return nil, errBadRequest(fmt.Errorf("invalid sort %q", form.Sort), "invalid query")
 	}
-
-	// get the conferences from cache
-	conferences := getCacheNoFilters(c)
-	if conferences != nil {
-		return conferences, nil
+	if form.Near != nil {
+		if err := form.Near.normalize(); err != nil {
+			return nil, errBadRequest(err, "invalid query")
+		}
+	} else if form.Sort == SortDistance {
+		return nil, errBadRequest(fmt.Errorf("sort %s without location", form.Sort), "invalid query")
 	}
-
-	items := make([]*Conference, 0)
-	keys, err := datastore.NewQuery("Conference").Order(StartDate).GetAll(c, &items)
-	if err != nil {
-		return nil, errInternalServer(err, "unable to query conference")
+	if form.RegistrationOpen {
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		form.Filter(RegistrationOpen, LTE, today).
+			Filter(RegistrationClose, GTE, today).
+			Filter(Status, EQ, StatusPublished)
+		form.RegistrationOpen = false
 	}
-
-	for i := 0; i < len(items); i++ {
-		items[i].WebsafeKey = keys[i].Encode()
+	if form.Query != "" {
+		filters, err := parseQueryString(form.Query)
+		if err != nil {
+			return nil, errBadRequest(err, "invalid query")
+		}
+		form.Filters = append(form.Filters, filters...)
+		form.Query = ""
 	}
-	conferences = &Conferences{Items: items}
 
-	// cache the conferences
-	err = setCacheNoFilters.Call(c, conferences)
+	conferences, err := getCacheQuery(c, form, func() (*Conferences, error) {
+		plan := form.plan(conferencesBackfilled(c))
+		if plan.Backend == BackendSearch {
+			return searchConferences(c, form)
+		}
+
+		conferences, err := datastoreConferences(c, form)
+		if err != nil {
+			return nil, err
+		}
+		conferences.Plan = plan
+		conferences.Facets = countFacets(conferences.Items)
+		return conferences, nil
+	})
 	if err != nil {
-		log.Errorf(c, "unable to set cache: %v", err)
+		return nil, err
 	}
 
-	return conferences, nil
+	// the conferences may be shared with concurrent requests
+	result := *conferences
+	if !form.Explain {
+		result.Plan = nil
+	}
+	return &result, nil
 }
 
 // ConferencesCreated returns the Conferences created by the current user.
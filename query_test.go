@@ -0,0 +1,341 @@
+//go:build go1.18
+// +build go1.18
+
+package ud859
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	reRestriction = regexp.MustCompile(`^(NOT )?([A-Z_]+) (=|<|>|<=|>=) `)
+	reNumber      = regexp.MustCompile(`^-?[0-9]+`)
+	reDate        = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}`)
+)
+
+// parseQuery checks that the query is made of well formed restrictions
+// on whitelisted fields, and returns their count.
+func parseQuery(query string) (int, error) {
+	var count int
+	for query != "" {
+		if count > 0 {
+			if !strings.HasPrefix(query, " ") {
+				return count, fmt.Errorf("missing separator: %s", query)
+			}
+			query = query[1:]
+		}
+
+		// a phrase in any field
+		if phrase := strings.TrimPrefix(query, "NOT "); strings.HasPrefix(phrase, `"`) {
+			var err error
+			query, err = parseQuoted(phrase)
+			if err != nil {
+				return count, err
+			}
+			count++
+			continue
+		}
+
+		m := reRestriction.FindStringSubmatch(query)
+		if m == nil {
+			return count, fmt.Errorf("invalid restriction: %s", query)
+		}
+		typ, ok := searchFields[m[2]]
+		if !ok {
+			return count, fmt.Errorf("invalid field: %s", m[2])
+		}
+		if !typ.accepts(m[3]) {
+			return count, fmt.Errorf("invalid operator: %s", m[0])
+		}
+		query = query[len(m[0]):]
+
+		var err error
+		switch typ {
+		case atomField:
+			query, err = parseQuoted(query)
+		case textField:
+			query, err = parseTokens(query)
+		case numberField:
+			query, err = parseRegexp(reNumber, query)
+		case dateField:
+			query, err = parseRegexp(reDate, query)
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func parseRegexp(re *regexp.Regexp, query string) (string, error) {
+	loc := re.FindStringIndex(query)
+	if loc == nil {
+		return query, fmt.Errorf("invalid value: %s", query)
+	}
+	return query[loc[1]:], nil
+}
+
+// parseQuoted consumes a quoted string.
+func parseQuoted(query string) (string, error) {
+	if !strings.HasPrefix(query, `"`) {
+		return query, fmt.Errorf("unquoted value: %s", query)
+	}
+	for i := 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case '"':
+			return query[i+1:], nil
+		}
+	}
+	return query, fmt.Errorf("unterminated value: %s", query)
+}
+
+// parseTokens consumes a list of quoted tokens.
+func parseTokens(query string) (string, error) {
+	if !strings.HasPrefix(query, "(") {
+		return query, fmt.Errorf("missing parenthesis: %s", query)
+	}
+	query = query[1:]
+
+	for {
+		var err error
+		query, err = parseQuoted(query)
+		if err != nil {
+			return query, err
+		}
+		if strings.HasPrefix(query, ")") {
+			return query[1:], nil
+		}
+		if !strings.HasPrefix(query, " ") {
+			return query, fmt.Errorf("missing separator: %s", query)
+		}
+		query = query[1:]
+	}
+}
+
+func TestQueryInjection(t *testing.T) {
+	values := []string{
+		`Paris`,
+		`Paris") OR NAME = ("x`,
+		`x" OR KEY = "y`,
+		`\" OR \\`,
+		`"`,
+		`\`,
+		"new\nline",
+		`a) OR (b`,
+		`NOT`,
+	}
+
+	for _, field := range []string{Key, Name, City, Topics, Text} {
+		for _, value := range values {
+			for _, op := range []string{EQ, NE} {
+				filter := &Filter{Field: field, Op: op, Value: value}
+				if err := filter.normalize(); err != nil {
+					t.Fatalf("%s %s %q: %v", field, op, value, err)
+				}
+
+				form := &ConferenceQueryForm{Filters: []*Filter{filter, filter}}
+				query, err := form.query()
+				if err != nil && searchFields[field] != atomField && len(tokenize(value)) == 0 {
+					// a text without tokens can not be searched
+					continue
+				} else if err != nil {
+					t.Fatalf("%s %s %q: %v", field, op, value, err)
+				}
+
+				count, err := parseQuery(query)
+				if err != nil {
+					t.Errorf("%s %s %q: %v", field, op, value, err)
+				} else if count != 2 {
+					t.Errorf("%s %s %q: got:%d restrictions, want:2", field, op, value, count)
+				}
+			}
+		}
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	tts := []Filter{
+		{"FOO", EQ, "x"},
+		{"name", EQ, "x"},
+		{"NOT NAME", EQ, "x"},
+		{City, LT, "Paris"},
+		{Topics, GTE, "Go"},
+		{Key, GT, "x"},
+		{Name, EQ, 10},
+		{Month, EQ, "June"},
+		{StartDate, EQ, 2016},
+		{City, "~", "Paris"},
+	}
+
+	for _, tt := range tts {
+		data, err := json.Marshal(&tt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = new(Filter).UnmarshalJSON(data); err == nil {
+			t.Errorf("%s should be invalid", data)
+		}
+	}
+}
+
+func FuzzFilterUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(`{"field":"CITY","operator":"EQ","value":"Paris"}`))
+	f.Add([]byte(`{"field":"KEY","operator":"=","value":"a\"b"}`))
+	f.Add([]byte(`{"field":"MONTH","operator":"GTEQ","value":"7"}`))
+	f.Add([]byte(`{"field":"START_DATE","operator":"<","value":"2016-10-01T23:00:00Z"}`))
+	f.Add([]byte(`{"field":"SEATS_AVAILABLE","operator":"!=","value":1e300}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		filter := new(Filter)
+		if err := filter.UnmarshalJSON(data); err != nil {
+			return
+		}
+
+		query, err := (&ConferenceQueryForm{Filters: []*Filter{filter}}).query()
+		if err != nil {
+			// only a text without tokens may not be searched
+			if typ := searchFields[filter.Field]; typ != textField && typ != phraseField {
+				t.Fatalf("%s: %v", data, err)
+			}
+			return
+		}
+
+		count, err := parseQuery(query)
+		if err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if count != 1 {
+			t.Fatalf("%s: got:%d restrictions, want:1", data, count)
+		}
+	})
+}
+
+func FuzzQuery(f *testing.F) {
+	f.Add(City, EQ, "Paris", Month, "7")
+	f.Add(Name, NE, `x") OR (y`, StartDate, "2016-10-01T23:00:00Z")
+	f.Add(Key, EQ, `\"`, SeatsAvailable, "-1")
+
+	f.Fuzz(func(t *testing.T, field, op, value, field2, value2 string) {
+		var filters []*Filter
+		for _, filter := range []*Filter{
+			{Field: field, Op: op, Value: value},
+			{Field: field2, Op: GTE, Value: value2},
+		} {
+			if filter.normalize() == nil {
+				filters = append(filters, filter)
+			}
+		}
+
+		query, err := (&ConferenceQueryForm{Filters: filters}).query()
+		if err != nil {
+			return
+		}
+
+		count, err := parseQuery(query)
+		if err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		if count != len(filters) {
+			t.Fatalf("%q: got:%d restrictions, want:%d", query, count, len(filters))
+		}
+	})
+}
+
+func TestParseQueryString(t *testing.T) {
+	tts := []struct {
+		query   string
+		filters []Filter
+	}{
+		{``, nil},
+		{`city:London`, []Filter{{City, EQ, "London"}}},
+		{`CITY=London -topic:go`, []Filter{{City, EQ, "London"}, {Topics, NE, "go"}}},
+		{`month>=6 seats>0`, []Filter{{Month, GTE, 6}, {SeatsAvailable, GT, 0}}},
+		{`max<=10 attendees!=1`, []Filter{{MaxAttendees, LTE, 10}, {MaxAttendees, NE, 1}}},
+		{`name:"dot go" "cloud native"`, []Filter{{Name, EQ, "dot go"}, {Text, EQ, "cloud native"}}},
+		{`-"a \"b\"" go-lang`, []Filter{{Text, NE, `a "b"`}, {Text, EQ, "go-lang"}}},
+	}
+
+	for _, tt := range tts {
+		filters, err := parseQueryString(tt.query)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if len(filters) != len(tt.filters) {
+			t.Errorf("%s got:%d filters, want:%d", tt.query, len(filters), len(tt.filters))
+			continue
+		}
+		for i, filter := range filters {
+			if *filter != tt.filters[i] {
+				t.Errorf("%s got:%v, want:%v", tt.query, *filter, tt.filters[i])
+			}
+		}
+	}
+
+	errors := []struct {
+		query, message string
+	}{
+		{`foo:bar`, `unknown field "foo" at column 1`},
+		{`city:Paris month>=june`, `at column 19`},
+		{`city:Paris start>2016-13-45`, `at column 18`},
+		{`seats>=ten`, `at column 8`},
+		{`-created:"last week"`, `at column 10`},
+		{`city:`, `missing value at column 6`},
+		{`city:Paris -month>6`, `negation of operator > at column 12`},
+		{`city:"Paris`, `unterminated string at column 6`},
+		{`city<Paris`, `invalid operator < on field CITY at column 1`},
+	}
+
+	for _, tt := range errors {
+		_, err := parseQueryString(tt.query)
+		if err == nil {
+			t.Errorf("%s should be invalid", tt.query)
+		} else if !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%s got:%v, want:%s", tt.query, err, tt.message)
+		}
+	}
+}
+
+func TestPlanBackfill(t *testing.T) {
+	tts := []struct {
+		form       *ConferenceQueryForm
+		before     string
+		backfilled string
+	}{
+		{new(ConferenceQueryForm), BackendDatastore, BackendDatastore},
+		{&ConferenceQueryForm{Sort: SortStartDateDesc}, BackendDatastore, BackendDatastore},
+		{&ConferenceQueryForm{Sort: SortName}, BackendSearch, BackendDatastore},
+		{&ConferenceQueryForm{Sort: SortSeatsAvailable}, BackendSearch, BackendDatastore},
+		{&ConferenceQueryForm{Sort: SortCreated}, BackendSearch, BackendDatastore},
+		{new(ConferenceQueryForm).Filter(City, EQ, "Paris"), BackendSearch, BackendDatastore},
+		{new(ConferenceQueryForm).Filter(Month, EQ, 6), BackendSearch, BackendDatastore},
+		{new(ConferenceQueryForm).Filter(Key, EQ, "key"), BackendDatastore, BackendDatastore},
+	}
+
+	for _, tt := range tts {
+		if plan := tt.form.plan(false); plan.Backend != tt.before {
+			t.Errorf("%s %v got:%s, want:%s before the backfill", tt.form.Sort, tt.form.Filters, plan.Backend, tt.before)
+		}
+		if plan := tt.form.plan(true); plan.Backend != tt.backfilled {
+			t.Errorf("%s %v got:%s, want:%s", tt.form.Sort, tt.form.Filters, plan.Backend, tt.backfilled)
+		}
+	}
+}
+
+func TestSortDefaults(t *testing.T) {
+	for name, order := range sortOrders {
+		if order.defaultVal == nil {
+			t.Errorf("%s has no default", name)
+		}
+	}
+	if got := sortDate(minDate); got != "0" {
+		t.Errorf("got:%s, want:0", got)
+	}
+}
@@ -0,0 +1,218 @@
+package ud859
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/search"
+)
+
+// fieldType defines how a field of the conferenceDoc is searched.
+type fieldType int
+
+const (
+	atomField fieldType = iota + 1
+	textField
+	numberField
+	dateField
+	// phraseField is the type of the Text pseudo field.
+	phraseField
+)
+
+// accepts returns true if the operator applies to the type of field.
+func (t fieldType) accepts(op string) bool {
+	switch t {
+	case atomField, textField, phraseField:
+		return op == EQ || op == NE
+	case numberField, dateField:
+		return true
+	}
+	return false
+}
+
+// searchFields whitelists the fields of the conferenceDoc schema.
+var searchFields = schemaFields(reflect.TypeOf(conferenceDoc{}))
+
+func init() {
+	searchFields[Text] = phraseField
+}
+
+// schemaFields returns the type of the fields of a search document by name.
+func schemaFields(doc reflect.Type) map[string]fieldType {
+	fields := make(map[string]fieldType)
+	for i := 0; i < doc.NumField(); i++ {
+		field := doc.Field(i)
+
+		name := strings.Split(field.Tag.Get("search"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		switch field.Type {
+		case reflect.TypeOf(search.Atom("")):
+			fields[name] = atomField
+		case reflect.TypeOf(""), reflect.TypeOf(search.HTML("")):
+			fields[name] = textField
+		case reflect.TypeOf(float64(0)):
+			fields[name] = numberField
+		case reflect.TypeOf(time.Time{}):
+			fields[name] = dateField
+		}
+	}
+	return fields
+}
+
+// fieldType returns the type of the field, if the operator applies to it.
+func (f *Filter) fieldType() (fieldType, error) {
+	typ, ok := searchFields[f.Field]
+	if !ok {
+		return 0, fmt.Errorf("invalid field %q", f.Field)
+	}
+	if !typ.accepts(f.Op) {
+		return 0, fmt.Errorf("invalid operator %s on field %s", f.Op, f.Field)
+	}
+	return typ, nil
+}
+
+// normalize checks the field and the operator of the filter against the schema,
+// and converts the value to the type of the field.
+func (f *Filter) normalize() error {
+	if err := f.setOp(); err != nil {
+		return err
+	}
+
+	typ, err := f.fieldType()
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case numberField:
+		return f.setValueInt()
+	case dateField:
+		return f.setValueTime()
+	default:
+		if _, ok := f.Value.(string); !ok {
+			return fmt.Errorf("invalid type of value")
+		}
+	}
+	return nil
+}
+
+// query returns the query string to apply to the search index.
+func (q ConferenceQueryForm) query() (string, error) {
+	b := new(queryBuilder)
+	for _, filter := range q.Filters {
+		if err := b.add(filter); err != nil {
+			return "", err
+		}
+	}
+	if q.Near != nil {
+		b.restrictions = append(b.restrictions, q.Near.restriction())
+	}
+	return b.String(), nil
+}
+
+// queryBuilder builds a search query from normalized filters,
+// the values are escaped so that they can not alter the query.
+type queryBuilder struct {
+	restrictions []string
+}
+
+func (b *queryBuilder) add(f *Filter) error {
+	typ, err := f.fieldType()
+	if err != nil {
+		return err
+	}
+
+	if typ == phraseField {
+		return b.addPhrase(f)
+	}
+
+	field, op := f.Field, f.Op
+	if op == NE {
+		field, op = "NOT "+field, EQ
+	}
+
+	var value string
+	switch v := f.Value.(type) {
+	case string:
+		if typ == atomField {
+			value = quote(v)
+			break
+		}
+		if typ != textField {
+			return fmt.Errorf("invalid type of value for field %s", f.Field)
+		}
+
+		// all the tokens of the value
+		tokens := tokenize(v)
+		if len(tokens) == 0 {
+			return fmt.Errorf("empty value for field %s", f.Field)
+		}
+		for i, token := range tokens {
+			tokens[i] = quote(token)
+		}
+		value = "(" + strings.Join(tokens, " ") + ")"
+
+	case int:
+		if typ != numberField {
+			return fmt.Errorf("invalid type of value for field %s", f.Field)
+		}
+		value = strconv.Itoa(v)
+
+	case time.Time:
+		if typ != dateField {
+			return fmt.Errorf("invalid type of value for field %s", f.Field)
+		}
+		value = v.UTC().Format("2006-01-02")
+
+	default:
+		return fmt.Errorf("invalid type of value for field %s", f.Field)
+	}
+
+	b.restrictions = append(b.restrictions, field+" "+op+" "+value)
+	return nil
+}
+
+// addPhrase adds a global restriction on the tokens of the value.
+func (b *queryBuilder) addPhrase(f *Filter) error {
+	v, ok := f.Value.(string)
+	if !ok {
+		return fmt.Errorf("invalid type of value for field %s", f.Field)
+	}
+
+	tokens := tokenize(v)
+	if len(tokens) == 0 {
+		return fmt.Errorf("empty value for field %s", f.Field)
+	}
+
+	restriction := quote(strings.Join(tokens, " "))
+	if f.Op == NE {
+		restriction = "NOT " + restriction
+	}
+	b.restrictions = append(b.restrictions, restriction)
+	return nil
+}
+
+func (b *queryBuilder) String() string {
+	return strings.Join(b.restrictions, " ")
+}
+
+// quote returns a quoted string of the search grammar.
+func quote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,203 @@
+package ud859
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// queryFields maps the field names of the query language to the query fields.
+var queryFields = map[string]string{
+	"key":       Key,
+	"name":      Name,
+	"city":      City,
+	"topic":     Topics,
+	"topics":    Topics,
+	"start":     StartDate,
+	"end":       EndDate,
+	"month":     Month,
+	"max":       MaxAttendees,
+	"attendees": MaxAttendees,
+	"seats":     SeatsAvailable,
+	"created":   Created,
+	"status":    Status,
+	"opens":     RegistrationOpen,
+	"closes":    RegistrationClose,
+}
+
+// queryOperators maps the operators of the query language to the query operators,
+// the longest operators first.
+var queryOperators = []struct {
+	token, op string
+}{
+	{"<=", LTE},
+	{">=", GTE},
+	{"!=", NE},
+	{":", EQ},
+	{"=", EQ},
+	{"<", LT},
+	{">", GT},
+}
+
+// parseQueryString compiles a query like `city:London topic:go month>=6 seats>0 "cloud native"`
+// to a list of filters. A term without field matches any field, a term prefixed by '-' is negated.
+func parseQueryString(query string) ([]*Filter, error) {
+	p := &queryParser{input: []rune(query)}
+
+	var filters []*Filter
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			return filters, nil
+		}
+
+		filter, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+}
+
+type queryParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *queryParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *queryParser) peek() rune {
+	return p.input[p.pos]
+}
+
+func (p *queryParser) skipSpaces() {
+	for !p.eof() && unicode.IsSpace(p.peek()) {
+		p.pos++
+	}
+}
+
+// errorf returns an error pointing at the column of the offending token.
+func (p *queryParser) errorf(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at column %d", fmt.Sprintf(format, args...), pos+1)
+}
+
+// parseTerm parses: ['-'] [field operator] value
+func (p *queryParser) parseTerm() (*Filter, error) {
+	start := p.pos
+
+	negated := p.peek() == '-'
+	if negated {
+		p.pos++
+	}
+
+	filter := &Filter{Field: Text, Op: EQ}
+
+	// a field is followed by an operator
+	fieldPos := p.pos
+	name := p.scanIdentifier()
+	if name != "" {
+		if op, ok := p.scanOperator(); ok {
+			field, ok := queryFields[strings.ToLower(name)]
+			if !ok {
+				if _, ok = searchFields[strings.ToUpper(name)]; !ok {
+					return nil, p.errorf(fieldPos, "unknown field %q", name)
+				}
+				field = strings.ToUpper(name)
+			}
+			filter.Field, filter.Op = field, op
+
+		} else {
+			// a word of text
+			p.pos = fieldPos
+		}
+	}
+
+	valuePos := p.pos
+	value, err := p.scanValue()
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, p.errorf(valuePos, "missing value")
+	}
+	filter.Value = value
+
+	if negated {
+		if filter.Op != EQ {
+			return nil, p.errorf(start, "negation of operator %s", filter.Op)
+		}
+		filter.Op = NE
+	}
+
+	if err := filter.normalize(); err != nil {
+		if _, erf := filter.fieldType(); erf != nil {
+			// the operator does not apply to the field
+			return nil, p.errorf(start, "%v", err)
+		}
+		return nil, p.errorf(valuePos, "%v", err)
+	}
+	return filter, nil
+}
+
+func (p *queryParser) scanIdentifier() string {
+	start := p.pos
+	for !p.eof() {
+		r := p.peek()
+		if !unicode.IsLetter(r) && r != '_' {
+			break
+		}
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+func (p *queryParser) scanOperator() (string, bool) {
+	rest := string(p.input[p.pos:])
+	for _, o := range queryOperators {
+		if strings.HasPrefix(rest, o.token) {
+			p.pos += len([]rune(o.token))
+			return o.op, true
+		}
+	}
+	return "", false
+}
+
+// scanValue scans a quoted string, or a word up to the next space.
+func (p *queryParser) scanValue() (string, error) {
+	if p.eof() {
+		return "", nil
+	}
+
+	if p.peek() != '"' {
+		start := p.pos
+		for !p.eof() && !unicode.IsSpace(p.peek()) {
+			p.pos++
+		}
+		return string(p.input[start:p.pos]), nil
+	}
+
+	start := p.pos
+	p.pos++
+
+	var value []rune
+	for !p.eof() {
+		r := p.peek()
+		p.pos++
+
+		switch r {
+		case '\\':
+			if p.eof() {
+				return "", p.errorf(start, "unterminated string")
+			}
+			value = append(value, p.peek())
+			p.pos++
+		case '"':
+			return string(value), nil
+		default:
+			value = append(value, r)
+		}
+	}
+	return "", p.errorf(start, "unterminated string")
+}
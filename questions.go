@@ -0,0 +1,241 @@
+package ud859
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Question types.
+const (
+	QuestionText           = "TEXT"
+	QuestionSingleChoice   = "SINGLE_CHOICE"
+	QuestionMultipleChoice = "MULTIPLE_CHOICE"
+)
+
+const (
+	// maxQuestions is the largest number of questions of a conference.
+	maxQuestions = 20
+	// maxAnswerLength is the length of the longest text answer.
+	maxAnswerLength = 1000
+)
+
+// Question is asked to the attendees when they register to a conference, its key
+// is a child of the conference key, with its position as ID.
+type Question struct {
+	ID   int64  `json:"id" datastore:"-"`
+	Text string `json:"text" datastore:",noindex"`
+	Type string `json:"type" datastore:",noindex"`
+	// Choices are the answers of the choice questions.
+	Choices  []string `json:"choices,omitempty" datastore:",noindex"`
+	Required bool     `json:"required" datastore:",noindex"`
+}
+
+// QuestionForm gives a Question, a text question by default.
+type QuestionForm struct {
+	Text     string   `json:"text" endpoints:"req"`
+	Type     string   `json:"type"`
+	Choices  []string `json:"choices"`
+	Required bool     `json:"required"`
+}
+
+// Questions is a list of Questions.
+type Questions struct {
+	Items []*Question `json:"items"`
+}
+
+// Answer is the answer to a question, a multiple choice is answered once per choice.
+type Answer struct {
+	QuestionID int64  `json:"questionId"`
+	Value      string `json:"value"`
+}
+
+// AnswerForm answers a question with a Text or with Choices.
+type AnswerForm struct {
+	QuestionID int64    `json:"questionId" endpoints:"req"`
+	Text       string   `json:"text"`
+	Choices    []string `json:"choices"`
+}
+
+// fromQuestionForms creates the questions of a conference.
+func fromQuestionForms(forms []*QuestionForm) ([]*Question, error) {
+	if len(forms) > maxQuestions {
+		return nil, fmt.Errorf("more than %d questions", maxQuestions)
+	}
+
+	questions := make([]*Question, len(forms))
+	for i, form := range forms {
+		text := strings.TrimSpace(form.Text)
+		if text == "" {
+			return nil, fmt.Errorf("question %d has no text", i+1)
+		}
+
+		typ := form.Type
+		if typ == "" {
+			typ = QuestionText
+		}
+		switch typ {
+		case QuestionText:
+			if len(form.Choices) > 0 {
+				return nil, fmt.Errorf("text question %q has choices", text)
+			}
+		case QuestionSingleChoice, QuestionMultipleChoice:
+			if len(form.Choices) == 0 {
+				return nil, fmt.Errorf("choice question %q has no choices", text)
+			}
+			seen := make(map[string]bool)
+			for _, choice := range form.Choices {
+				if strings.TrimSpace(choice) == "" || seen[choice] {
+					return nil, fmt.Errorf("invalid choice %q of question %q", choice, text)
+				}
+				seen[choice] = true
+			}
+		default:
+			return nil, fmt.Errorf("invalid question type %q", form.Type)
+		}
+
+		questions[i] = &Question{
+			ID:       int64(i + 1),
+			Text:     text,
+			Type:     typ,
+			Choices:  form.Choices,
+			Required: form.Required,
+		}
+	}
+	return questions, nil
+}
+
+// fromAnswerForms validates the AnswerForms against the questions,
+// and returns the answers in the order of the questions.
+func fromAnswerForms(questions []*Question, forms []*AnswerForm) ([]Answer, error) {
+	byID := make(map[int64]*AnswerForm)
+	for _, form := range forms {
+		if byID[form.QuestionID] != nil {
+			return nil, fmt.Errorf("question %d answered twice", form.QuestionID)
+		}
+		byID[form.QuestionID] = form
+	}
+
+	var answers []Answer
+	for _, question := range questions {
+		form := byID[question.ID]
+		delete(byID, question.ID)
+
+		var values []string
+		if form != nil {
+			var err error
+			values, err = question.values(form)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(values) == 0 && question.Required {
+			return nil, fmt.Errorf("question %q is required", question.Text)
+		}
+		for _, value := range values {
+			answers = append(answers, Answer{question.ID, value})
+		}
+	}
+
+	for id := range byID {
+		return nil, fmt.Errorf("invalid question %d", id)
+	}
+	return answers, nil
+}
+
+// values returns the values of the answer to the question.
+func (question *Question) values(form *AnswerForm) ([]string, error) {
+	if question.Type == QuestionText {
+		text := strings.TrimSpace(form.Text)
+		if len(form.Choices) > 0 || len(text) > maxAnswerLength {
+			return nil, fmt.Errorf("invalid answer to question %q", question.Text)
+		}
+		if text == "" {
+			return nil, nil
+		}
+		return []string{text}, nil
+	}
+
+	if form.Text != "" || question.Type == QuestionSingleChoice && len(form.Choices) > 1 {
+		return nil, fmt.Errorf("invalid answer to question %q", question.Text)
+	}
+	seen := make(map[string]bool)
+	for _, choice := range form.Choices {
+		if seen[choice] || !question.hasChoice(choice) {
+			return nil, fmt.Errorf("invalid choice %q to question %q", choice, question.Text)
+		}
+		seen[choice] = true
+	}
+	return form.Choices, nil
+}
+
+func (question *Question) hasChoice(choice string) bool {
+	for _, c := range question.Choices {
+		if c == choice {
+			return true
+		}
+	}
+	return false
+}
+
+func questionKey(c context.Context, ckey *datastore.Key, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Question", "", id, ckey)
+}
+
+// putQuestions saves the questions of a new conference.
+func putQuestions(c context.Context, ckey *datastore.Key, questions []*Question) error {
+	if len(questions) == 0 {
+		return nil
+	}
+	keys := make([]*datastore.Key, len(questions))
+	for i, question := range questions {
+		keys[i] = questionKey(c, ckey, question.ID)
+	}
+	_, err := datastore.PutMulti(c, keys, questions)
+	return err
+}
+
+// loadQuestions gets the questions of the conference, in order.
+func loadQuestions(c context.Context, ckey *datastore.Key) ([]*Question, error) {
+	questions := make([]*Question, 0)
+	keys, err := datastore.NewQuery("Question").
+		Ancestor(ckey).
+		GetAll(c, &questions)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		questions[i].ID = key.IntID()
+	}
+	return questions, nil
+}
+
+// registrationAnswers validates the answers of a registration to the conference,
+// within the transaction of the registration.
+func registrationAnswers(c context.Context, ckey *datastore.Key, forms []*AnswerForm) ([]Answer, error) {
+	questions, err := loadQuestions(c, ckey)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to get questions")
+	}
+	answers, err := fromAnswerForms(questions, forms)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid answers")
+	}
+	return answers, nil
+}
+
+// GetQuestions returns the questions of the Conference with the specified ConferenceKeyForm.
+func (ConferenceAPI) GetQuestions(c context.Context, form *ConferenceKeyForm) (*Questions, error) {
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	questions, err := loadQuestions(c, ckey)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to get questions")
+	}
+	return &Questions{Items: questions}, nil
+}
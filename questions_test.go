@@ -0,0 +1,139 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFromQuestionForms(t *testing.T) {
+	tts := []struct {
+		form  QuestionForm
+		valid bool
+	}{
+		{QuestionForm{Text: "Company"}, true},
+		{QuestionForm{Text: "Diet", Type: QuestionSingleChoice, Choices: []string{"Vegan", "None"}}, true},
+		{QuestionForm{Text: "Needs", Type: QuestionMultipleChoice, Choices: []string{"Wheelchair"}}, true},
+		{QuestionForm{Text: " "}, false},
+		{QuestionForm{Text: "Company", Choices: []string{"Google"}}, false},
+		{QuestionForm{Text: "Diet", Type: QuestionSingleChoice}, false},
+		{QuestionForm{Text: "Diet", Type: QuestionSingleChoice, Choices: []string{"Vegan", "Vegan"}}, false},
+		{QuestionForm{Text: "Diet", Type: "CHOICE", Choices: []string{"Vegan"}}, false},
+	}
+
+	for _, tt := range tts {
+		_, err := fromQuestionForms([]*QuestionForm{&tt.form})
+		if (err == nil) != tt.valid {
+			t.Errorf("%+v got:%v, want valid:%t", tt.form, err, tt.valid)
+		}
+	}
+
+	questions, err := fromQuestionForms([]*QuestionForm{{Text: "Company"}, {Text: "Diet"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if questions[0].ID != 1 || questions[1].ID != 2 || questions[0].Type != QuestionText {
+		t.Errorf("got:%+v %+v, want the text questions 1 and 2", questions[0], questions[1])
+	}
+}
+
+func testQuestions() []*Question {
+	return []*Question{
+		{ID: 1, Text: "Company", Type: QuestionText},
+		{ID: 2, Text: "Diet", Type: QuestionSingleChoice, Choices: []string{"Vegan", "None"}, Required: true},
+		{ID: 3, Text: "Needs", Type: QuestionMultipleChoice, Choices: []string{"Wheelchair", "Interpreter"}},
+	}
+}
+
+func TestFromAnswerForms(t *testing.T) {
+	diet := &AnswerForm{QuestionID: 2, Choices: []string{"Vegan"}}
+
+	tts := []struct {
+		forms   []*AnswerForm
+		answers []Answer
+		valid   bool
+	}{
+		{[]*AnswerForm{diet}, []Answer{{2, "Vegan"}}, true},
+		{[]*AnswerForm{
+			{QuestionID: 3, Choices: []string{"Interpreter", "Wheelchair"}},
+			{QuestionID: 1, Text: " Google "},
+			diet,
+		}, []Answer{{1, "Google"}, {2, "Vegan"}, {3, "Interpreter"}, {3, "Wheelchair"}}, true},
+		{[]*AnswerForm{diet, {QuestionID: 1}}, []Answer{{2, "Vegan"}}, true},
+		{nil, nil, false},
+		{[]*AnswerForm{{QuestionID: 2, Choices: []string{"Vegan", "None"}}}, nil, false},
+		{[]*AnswerForm{{QuestionID: 2, Choices: []string{"Paleo"}}}, nil, false},
+		{[]*AnswerForm{{QuestionID: 2, Text: "Vegan"}}, nil, false},
+		{[]*AnswerForm{diet, {QuestionID: 1, Choices: []string{"Google"}}}, nil, false},
+		{[]*AnswerForm{diet, {QuestionID: 3, Choices: []string{"Wheelchair", "Wheelchair"}}}, nil, false},
+		{[]*AnswerForm{diet, diet}, nil, false},
+		{[]*AnswerForm{diet, {QuestionID: 4, Text: "?"}}, nil, false},
+	}
+
+	for i, tt := range tts {
+		answers, err := fromAnswerForms(testQuestions(), tt.forms)
+		if (err == nil) != tt.valid {
+			t.Errorf("%d got:%v, want valid:%t", i, err, tt.valid)
+		}
+		if err == nil && !reflect.DeepEqual(answers, tt.answers) {
+			t.Errorf("%d got:%v, want:%v", i, answers, tt.answers)
+		}
+	}
+}
+
+func TestNewRoster(t *testing.T) {
+	registrations := []*Registration{
+		{Email: "alice@email", Ticket: TicketRegular,
+			Answers: []Answer{{1, "Google"}, {2, "Vegan"}, {3, "Interpreter"}, {3, "Wheelchair"}}},
+		{Email: "bob@email", Ticket: TicketStudent,
+			Answers: []Answer{{2, "Vegan"}, {3, "Wheelchair"}}, CheckedIn: time.Now()},
+		{Email: "carol@email", Ticket: TicketRegular},
+	}
+	roster := newRoster(testQuestions(), registrations)
+
+	if len(roster.Attendees) != 3 {
+		t.Fatalf("got:%d, want:3 attendees", len(roster.Attendees))
+	}
+	alice := []*AnswerForm{
+		{QuestionID: 1, Text: "Google"},
+		{QuestionID: 2, Choices: []string{"Vegan"}},
+		{QuestionID: 3, Choices: []string{"Interpreter", "Wheelchair"}},
+	}
+	if !reflect.DeepEqual(roster.Attendees[0].Answers, alice) {
+		t.Errorf("got:%v, want:%v", roster.Attendees[0].Answers, alice)
+	}
+	if len(roster.Attendees[2].Answers) != 0 {
+		t.Errorf("got:%v, want no answers", roster.Attendees[2].Answers)
+	}
+
+	answered := []int{1, 2, 2}
+	counts := [][]ChoiceCount{
+		nil,
+		{{"Vegan", 2}, {"None", 0}},
+		{{"Wheelchair", 2}, {"Interpreter", 1}},
+	}
+	for i, summary := range roster.Questions {
+		if summary.Answered != answered[i] {
+			t.Errorf("got:%d, want:%d", summary.Answered, answered[i])
+		}
+		var got []ChoiceCount
+		for _, count := range summary.Counts {
+			got = append(got, *count)
+		}
+		if !reflect.DeepEqual(got, counts[i]) {
+			t.Errorf("got:%v, want:%v", got, counts[i])
+		}
+	}
+
+	var attendance []TicketAttendance
+	for _, tally := range roster.Attendance {
+		attendance = append(attendance, *tally)
+	}
+	want := []TicketAttendance{{TicketRegular, 2, 0}, {TicketStudent, 1, 1}}
+	if !reflect.DeepEqual(attendance, want) {
+		t.Errorf("got:%v, want:%v", attendance, want)
+	}
+}
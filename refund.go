@@ -0,0 +1,196 @@
+package ud859
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Refund statuses.
+const (
+	// RefundPending is issued to the PaymentProvider once the cancellation has committed.
+	RefundPending = "PENDING"
+	RefundIssued  = "ISSUED"
+)
+
+// RefundRule refunds Percent of the amount paid for the cancellations before Until.
+type RefundRule struct {
+	Until   time.Time `json:"until"`
+	Percent int       `json:"percent"`
+}
+
+// RefundRuleForm gives a RefundRule.
+type RefundRuleForm struct {
+	Until   string `json:"until" endpoints:"req"`
+	Percent int    `json:"percent"`
+}
+
+// Refund records the refund of a cancelled paid registration. Its key is
+// a child of the conference key, named after the refunded payment.
+type Refund struct {
+	ProfileKey *datastore.Key `json:"-"`
+	Email      string         `json:"-" datastore:",noindex"`
+	PaymentID  string         `json:"-" datastore:",noindex"`
+	// Status is RefundPending until the PaymentProvider has refunded the payment.
+	Status string `json:"status"`
+	// RefundID is given by the PaymentProvider, empty when nothing is refunded.
+	RefundID string `json:"-" datastore:",noindex"`
+	// Amount is Percent of the amount Paid.
+	Paid     int64  `json:"paid" datastore:",noindex"`
+	Amount   int64  `json:"amount" datastore:",noindex"`
+	Percent  int    `json:"percent" datastore:",noindex"`
+	Currency string `json:"currency" datastore:",noindex"`
+	// InvoiceKey is the key of the Invoice of the payment.
+	InvoiceKey *datastore.Key `json:"-" datastore:",noindex"`
+	Created    time.Time      `json:"-" datastore:",noindex"`
+}
+
+// Cancellation is returned when a registration is cancelled.
+type Cancellation struct {
+	WebsafeKey string `json:"websafeConferenceKey"`
+	// Refund is the amount refunded, in Currency.
+	Refund   int64  `json:"refund"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// fromRefundRuleForms creates a refund policy, the rules end one after
+// the other and do not refund more than the rules before.
+func fromRefundRuleForms(forms []*RefundRuleForm) ([]RefundRule, error) {
+	var policy []RefundRule
+	for i, form := range forms {
+		until, err := time.Parse(time.RFC3339, form.Until)
+		if err != nil {
+			return nil, err
+		}
+		if form.Percent < 0 || form.Percent > 100 {
+			return nil, fmt.Errorf("invalid percent %d", form.Percent)
+		}
+		if i > 0 {
+			previous := policy[i-1]
+			if !previous.Until.Before(until) {
+				return nil, fmt.Errorf("rule until %s does not end after %s", form.Until, previous.Until)
+			}
+			if previous.Percent < form.Percent {
+				return nil, fmt.Errorf("rule until %s refunds more than the rule before", form.Until)
+			}
+		}
+		policy = append(policy, RefundRule{until, form.Percent})
+	}
+	return policy, nil
+}
+
+// refundPercent returns the percent of the amount paid refunded at now,
+// the conferences without a refund policy fully refund.
+func (conference *Conference) refundPercent(now time.Time) int {
+	if len(conference.RefundPolicy) == 0 || conference.status() == StatusCancelled {
+		return 100
+	}
+	for _, rule := range conference.RefundPolicy {
+		if now.Before(rule.Until) {
+			return rule.Percent
+		}
+	}
+	return 0
+}
+
+func init() {
+	subscribe("refund", refundSubscriber, EventRegistrationCancelled)
+}
+
+// refundRegistration records the refund of a paid registration following the refund policy,
+// within the transaction of the cancellation. The refund is issued by the refundSubscriber.
+func refundRegistration(c context.Context, ckey *datastore.Key, conference *Conference,
+	registration *Registration, now time.Time) (*Refund, error) {
+
+	percent := conference.refundPercent(now)
+	refund := &Refund{
+		ProfileKey: registration.ProfileKey,
+		Email:      registration.Email,
+		PaymentID:  registration.PaymentID,
+		Status:     RefundPending,
+		Paid:       registration.Amount,
+		Amount:     registration.Amount * int64(percent) / 100,
+		Percent:    percent,
+		Currency:   conference.Currency,
+		InvoiceKey: registration.InvoiceKey,
+		Created:    now,
+	}
+	if refund.Amount == 0 {
+		refund.Status = RefundIssued
+	}
+
+	// a payment is refunded once
+	key := datastore.NewKey(c, "Refund", registration.PaymentID, 0, ckey)
+	_, err := datastore.Put(c, key, refund)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to save refund")
+	}
+	return refund, nil
+}
+
+// refundSubscriber issues the pending refunds of the conference of a cancelled registration.
+func refundSubscriber(c context.Context, e *Event) error {
+	ckey, err := datastore.DecodeKey(e.ConferenceKey)
+	if err != nil {
+		return err
+	}
+
+	keys, err := datastore.NewQuery("Refund").
+		Ancestor(ckey).
+		Filter("Status =", RefundPending).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := issueRefund(c, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// issueRefund refunds the payment of the pending refund at key, the key of the refund
+// is the reference of the PaymentProvider so that a payment is not refunded twice.
+func issueRefund(c context.Context, key *datastore.Key) error {
+	refund := new(Refund)
+	err := datastore.Get(c, key, refund)
+	if err != nil {
+		return err
+	}
+	if refund.Status != RefundPending {
+		return nil
+	}
+
+	id, err := payments.Refund(c, refund.PaymentID, refund.Amount, key.Encode())
+	if err != nil {
+		return err
+	}
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		refund := new(Refund)
+		err := datastore.Get(c, key, refund)
+		if err != nil {
+			return err
+		}
+		if refund.Status != RefundPending {
+			return nil
+		}
+
+		refund.Status = RefundIssued
+		refund.RefundID = id
+		_, err = datastore.Put(c, key, refund)
+		return err
+	}, nil)
+
+	if err != nil {
+		log.Errorf(c, "payment %s refunded by %s, unable to save refund: %v", refund.PaymentID, id, err)
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestRefundPercent(t *testing.T) {
+	policy, err := fromRefundRuleForms([]*RefundRuleForm{
+		{Until: "2016-01-01T00:00:00Z", Percent: 100},
+		{Until: "2016-06-01T00:00:00Z", Percent: 50},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conference := &Conference{RefundPolicy: policy}
+
+	tts := []struct {
+		now     time.Time
+		percent int
+	}{
+		{time.Date(2015, 12, 31, 0, 0, 0, 0, time.UTC), 100},
+		{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), 50},
+		{time.Date(2016, 5, 31, 0, 0, 0, 0, time.UTC), 50},
+		{time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC), 0},
+	}
+	for _, tt := range tts {
+		if percent := conference.refundPercent(tt.now); percent != tt.percent {
+			t.Errorf("%v got:%d, want:%d", tt.now, percent, tt.percent)
+		}
+	}
+
+	// a cancelled conference refunds fully
+	conference.Status = StatusCancelled
+	if percent := conference.refundPercent(tts[3].now); percent != 100 {
+		t.Errorf("got:%d, want:100", percent)
+	}
+	// a conference without policy refunds fully
+	if percent := new(Conference).refundPercent(tts[3].now); percent != 100 {
+		t.Errorf("got:%d, want:100", percent)
+	}
+}
+
+func TestFromRefundRuleForms(t *testing.T) {
+	tts := []struct {
+		forms []*RefundRuleForm
+		valid bool
+	}{
+		{nil, true},
+		{[]*RefundRuleForm{{"2016-01-01T00:00:00Z", 80}}, true},
+		{[]*RefundRuleForm{{"2016-01-01", 80}}, false},
+		{[]*RefundRuleForm{{"2016-01-01T00:00:00Z", 120}}, false},
+		{[]*RefundRuleForm{{"2016-06-01T00:00:00Z", 100}, {"2016-01-01T00:00:00Z", 50}}, false},
+		{[]*RefundRuleForm{{"2016-01-01T00:00:00Z", 50}, {"2016-06-01T00:00:00Z", 100}}, false},
+	}
+	for _, tt := range tts {
+		_, err := fromRefundRuleForms(tt.forms)
+		if (err == nil) != tt.valid {
+			t.Errorf("got:%v, want valid:%t", err, tt.valid)
+		}
+	}
+}
+
+func TestIssueRefund(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := appengine.NewContext(r)
+
+	okey := datastore.NewKey(c, "Profile", "organizer@email", 0, nil)
+	ckey := datastore.NewKey(c, "Conference", "", 1, okey)
+	conference := &Conference{
+		Currency: "EUR",
+		RefundPolicy: []RefundRule{
+			{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), 50},
+		},
+	}
+
+	// record the refunds within the transaction of the cancellation
+	refund := func(paymentID string, now time.Time) *datastore.Key {
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			_, err := refundRegistration(c, ckey, conference, &Registration{
+				PaymentID: paymentID,
+				Amount:    5000,
+			}, now)
+			return err
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return datastore.NewKey(c, "Refund", paymentID, 0, ckey)
+	}
+	half := refund(fakeCheckoutPrefix+"half", time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC))
+	none := refund(fakeCheckoutPrefix+"none", time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	verify := func(key *datastore.Key, status string, amount int64) *Refund {
+		refund := new(Refund)
+		if err := datastore.Get(c, key, refund); err != nil {
+			t.Fatal(err)
+		}
+		if refund.Status != status || refund.Amount != amount {
+			t.Errorf("got:%s %d, want:%s %d", refund.Status, refund.Amount, status, amount)
+		}
+		return refund
+	}
+	verify(half, RefundPending, 2500)
+	verify(none, RefundIssued, 0)
+
+	// issue the pending refunds once the cancellation has committed
+	e := &Event{Name: EventRegistrationCancelled, ConferenceKey: ckey.Encode()}
+	if err = refundSubscriber(c, e); err != nil {
+		t.Fatal(err)
+	}
+	issued := verify(half, RefundIssued, 2500)
+	if !strings.HasPrefix(issued.RefundID, fakeRefundPrefix) {
+		t.Errorf("got:%q, want a refund id", issued.RefundID)
+	}
+	if zero := verify(none, RefundIssued, 0); zero.RefundID != "" {
+		t.Errorf("got:%q, want no refund id", zero.RefundID)
+	}
+
+	// a redelivered event refunds nothing more
+	if err = refundSubscriber(c, e); err != nil {
+		t.Fatal(err)
+	}
+	if again := verify(half, RefundIssued, 2500); again.RefundID != issued.RefundID {
+		t.Errorf("got:%s, want:%s", again.RefundID, issued.RefundID)
+	}
+}
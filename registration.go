@@ -1,13 +1,88 @@
 package ud859
 
 import (
+	"strings"
+	"time"
+
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
+// Registration is the registration of a profile to a conference, its key is
+// named after the profile and is a child of the conference key.
+type Registration struct {
+	ProfileKey *datastore.Key `json:"-"`
+	Email      string         `json:"-" datastore:",noindex"`
+	// Ticket is the ticket type of the registration.
+	Ticket  string    `json:"ticket"`
+	Created time.Time `json:"-" datastore:",noindex"`
+	// Status is the payment status, PaymentConfirmed when empty.
+	Status    string `json:"status"`
+	PaymentID string `json:"-" datastore:",noindex"`
+	Amount    int64  `json:"amount" datastore:",noindex"`
+	// PaymentReference identifies the charge of the checkout at the PaymentProvider.
+	PaymentReference string `json:"-" datastore:",noindex"`
+	// Discount is the amount discounted by the PromoCode.
+	PromoCode string `json:"promoCode,omitempty" datastore:",noindex"`
+	Discount  int64  `json:"discount,omitempty" datastore:",noindex"`
+	// HoldUntil is when the seat of a pending payment is released.
+	HoldUntil time.Time `json:"-"`
+	// InvoiceKey is the key of the Invoice of a paid registration.
+	InvoiceKey *datastore.Key `json:"-" datastore:",noindex"`
+	// Booker is the key of the profile which has registered the group of the registration.
+	Booker      *datastore.Key `json:"-"`
+	BookerEmail string         `json:"-" datastore:",noindex"`
+	// Answers are the answers to the questions of the conference.
+	Answers []Answer `json:"answers,omitempty" datastore:",noindex"`
+	// CheckedIn is when the ticket of the attendee has been checked in at the venue.
+	CheckedIn time.Time `json:"checkedIn" datastore:",noindex"`
+}
+
+// CancellationForm cancels a registration to a conference.
+type CancellationForm struct {
+	WebsafeKey string `json:"websafeConferenceKey" endpoints:"req"`
+	// Attendee is the email of an attendee whose seat has been booked by the current user.
+	Attendee string `json:"attendee"`
+}
+
+// RegistrationForm gives the ticket type of a registration, TicketRegular when empty.
+type RegistrationForm struct {
+	WebsafeKey string `json:"websafeConferenceKey" endpoints:"req"`
+	Ticket     string `json:"ticket"`
+	// Attendees are the emails of a group registered by the current user.
+	Attendees []string `json:"attendees"`
+	// PaymentToken is given by the payer to confirm the payment of a Checkout.
+	PaymentToken string `json:"paymentToken"`
+	// PromoCode discounts the price of the ticket.
+	PromoCode string `json:"promoCode"`
+	// Invitation is the token of an invitation to an invite-only conference.
+	Invitation string `json:"invitation"`
+	// Answers answer the questions of the conference.
+	Answers []*AnswerForm `json:"answers"`
+}
+
+// registrationKey returns the key of the registration of the profile to the conference.
+func registrationKey(c context.Context, ckey, pkey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "Registration", pkey.StringID(), 0, ckey)
+}
+
+// loadRegistration gets the registration of the profile to the conference,
+// the registrations made before the ticket types are regular.
+func loadRegistration(c context.Context, ckey, pkey *datastore.Key) (*datastore.Key, *Registration, error) {
+	key := registrationKey(c, ckey, pkey)
+	registration := new(Registration)
+	err := datastore.Get(c, key, registration)
+	if err == datastore.ErrNoSuchEntity {
+		registration.ProfileKey = pkey
+		registration.Ticket = TicketRegular
+	} else if err != nil {
+		return nil, nil, errInternalServer(err, "unable to get registration")
+	}
+	return key, registration, nil
+}
+
 func (p *Profile) register(websafeKey string) {
 	p.Conferences = append(p.Conferences, websafeKey)
 }
@@ -31,8 +106,72 @@ func (p Profile) IsRegistered(websafeKey string) bool {
 	return false
 }
 
-// GotoConference performs the registration to the specified ConferenceKeyForm.
-func (ConferenceAPI) GotoConference(c context.Context, form *ConferenceKeyForm) error {
+// The bounds of the registration window in the search index, which has no zero time.
+var (
+	windowStart = time.Unix(0, 0).UTC()
+	windowEnd   = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// registrationWindow returns when the registrations open and close, and the cancellation
+// deadline. The conferences created before the registration windows close when they end,
+// or when they start if they have no EndDate.
+func (conference *Conference) registrationWindow() (open, close, deadline time.Time) {
+	open, close, deadline = conference.RegistrationOpen, conference.RegistrationClose, conference.CancellationDeadline
+	if close.IsZero() {
+		close = conference.EndDate
+	}
+	if close.IsZero() {
+		close = conference.StartDate
+	}
+	if deadline.IsZero() {
+		deadline = conference.StartDate
+	}
+
+	if open.IsZero() {
+		open = windowStart
+	}
+	if close.IsZero() {
+		close = windowEnd
+	}
+	if deadline.IsZero() {
+		deadline = windowEnd
+	}
+	return open, close, deadline
+}
+
+// checkRegistration returns an error if the registrations are not open at now.
+func (conference *Conference) checkRegistration(now time.Time) error {
+	if status := conference.status(); status != StatusPublished {
+		return errConflict("conference is " + strings.ToLower(status))
+	}
+
+	open, close, _ := conference.registrationWindow()
+	if now.Before(open) {
+		return errConflict("registration is not open yet")
+	}
+	if !now.Before(close) {
+		return errConflict("registration is closed")
+	}
+	return nil
+}
+
+// checkCancellation returns an error if the registrations can not be cancelled at now.
+func (conference *Conference) checkCancellation(now time.Time) error {
+	if conference.status() == StatusCancelled {
+		// the attendees leave a cancelled conference at any time
+		return nil
+	}
+
+	_, _, deadline := conference.registrationWindow()
+	if !now.Before(deadline) {
+		return errConflict("cancellation deadline has passed")
+	}
+	return nil
+}
+
+// GotoConference performs the registration to the specified RegistrationForm,
+// of the current user or of a group of attendees.
+func (ConferenceAPI) GotoConference(c context.Context, form *RegistrationForm) error {
 	pid, err := profileID(c)
 	if err != nil {
 		return err
@@ -41,23 +180,45 @@ func (ConferenceAPI) GotoConference(c context.Context, form *ConferenceKeyForm)
 	if err != nil {
 		return errBadRequest(err, "invalid conference key")
 	}
+	if len(form.Attendees) > 0 {
+		return registerGroup(c, pid, ckey, form)
+	}
+	if conference, err := getConference(c, ckey); err == nil && conference.ApprovalRequired {
+		// the approval is required since the conference creation
+		return applyConference(c, pid, ckey, form)
+	}
+
+	// the payment of a checkout is confirmed before the transaction, which may be retried,
+	// and a registration without payment replaces the checkout whose payment is not confirmed
+	rkey := registrationKey(c, ckey, pid.key)
+	var paid, pending string
+	if form.PaymentToken != "" {
+		paid, err = confirmCheckout(c, rkey, form, time.Now())
+	} else {
+		pending, err = pendingCheckout(c, rkey)
+	}
+	if err != nil {
+		return err
+	}
+
+	var profile *Profile
+	var conference *Conference
+	var events dispatcher
 
 	err = datastore.RunInTransaction(c, func(c context.Context) error {
 		errc := make(chan error, 2)
-		var profile *Profile
-		var conference *Conference
 
 		go func() {
 			// get the profile
 			var err error
-			profile, err = getProfile(c, pid)
+			profile, err = loadProfile(c, pid)
 			errc <- err
 		}()
 
 		go func() {
 			// get the conference
 			var err error
-			conference, err = getConference(c, ckey)
+			conference, err = loadConference(c, ckey)
 			if err != nil {
 				err = errBadRequest(err, "conference does not exist")
 			}
@@ -78,28 +239,101 @@ func (ConferenceAPI) GotoConference(c context.Context, form *ConferenceKeyForm)
 		if profile.IsRegistered(conference.WebsafeKey) {
 			return errConflict("already registered")
 		}
-		if conference.SeatsAvailable <= 0 {
-			return errConflict("no seats available")
+		now := time.Now()
+		if err := conference.checkRegistration(now); err != nil {
+			return err
+		}
+		if err := checkInvitation(c, ckey, conference, pid, form.Invitation); err != nil {
+			return err
+		}
+
+		registration := new(Registration)
+		err = datastore.Get(c, rkey, registration)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return errInternalServer(err, "unable to get registration")
+		}
+
+		if err == nil && registration.Status == PaymentPending && form.PaymentToken != "" {
+			// the seat is held by a checkout
+			if paid == "" || registration.PaymentID != paid {
+				return errConflict("payment of the checkout is not confirmed")
+			}
+			if err := completePayment(c, ckey, conference, profile, registration); err != nil {
+				return err
+			}
+		} else {
+			if err == nil && registration.Status == PaymentPending {
+				// give back the seat held by the checkout
+				if registration.PaymentID != pending {
+					return errConflict("checkout has changed, register again")
+				}
+				if err := releaseRegistration(c, ckey, conference, registration); err != nil {
+					return err
+				}
+			}
+
+			// take a seat of the ticket type
+			ticket, err := conference.ticket(form.Ticket)
+			if err != nil {
+				return err
+			}
+			price, discount, err := ticketPrice(c, ckey, ticket, form.PromoCode, now)
+			if err != nil {
+				return err
+			}
+			if price > 0 {
+				return errConflict("payment required, checkout first")
+			}
+			answers, err := registrationAnswers(c, ckey, form.Answers)
+			if err != nil {
+				return err
+			}
+			if err := conference.reserve(ticket.Type); err != nil {
+				return err
+			}
+			registration = &Registration{
+				ProfileKey: pid.key,
+				Email:      pid.email,
+				Ticket:     ticket.Type,
+				Created:    now,
+				Status:     PaymentConfirmed,
+				Answers:    answers,
+			}
+			if discount > 0 {
+				registration.PromoCode = normalizeCode(form.PromoCode)
+				registration.Discount = discount
+			}
 		}
 
 		// register to the conference
 		profile.register(conference.WebsafeKey)
-		_, err = datastore.Put(c, pid.key, profile)
+		_, err = putProfile(c, pid.key, profile)
 		if err != nil {
 			return errInternalServer(err, "unable to save profile")
 		}
 
-		// decrease the available seats
-		conference.SeatsAvailable--
-		_, err = datastore.Put(c, ckey, conference)
+		_, err = putConference(c, ckey, conference)
 		if err != nil {
 			return errInternalServer(err, "unable to save conference")
 		}
 
-		// update indexation
-		err = indexConference(c, conference)
+		_, err = datastore.Put(c, rkey, registration)
+		if err != nil {
+			return errInternalServer(err, "unable to save registration")
+		}
+
+		// publish the event
+		events = newDispatcher(ckey)
+		events.publish(&Event{
+			Name:          EventRegistrationCreated,
+			ConferenceKey: conference.WebsafeKey,
+			ProfileKey:    pid.key.Encode(),
+			Email:         pid.email,
+		})
+
+		err = events.save(c)
 		if err != nil {
-			return errInternalServer(err, "unable to index conference")
+			return errInternalServer(err, "unable to publish event")
 		}
 		return nil
 
@@ -109,41 +343,53 @@ func (ConferenceAPI) GotoConference(c context.Context, form *ConferenceKeyForm)
 		return err
 	}
 
-	// clear cache
-	err = deleteCacheNoFilters.Call(c)
-	if err != nil {
-		log.Errorf(c, "unable to clear cache: %v", err)
-	}
+	// cache the entities
+	cacheProfile(c, pid.key, profile)
+	cacheConference(c, ckey, conference)
+	events.flush(c)
 	return nil
 }
 
-// CancelConference cancels the registration to the specified ConferenceKeyForm.
-func (ConferenceAPI) CancelConference(c context.Context, form *ConferenceKeyForm) error {
+// CancelConference cancels the registration to the specified CancellationForm,
+// and refunds a paid registration following the refund policy of the conference.
+// The seat is given to the oldest waitlisted application of its ticket type.
+func (ConferenceAPI) CancelConference(c context.Context, form *CancellationForm) (*Cancellation, error) {
 	pid, err := profileID(c)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	ckey, err := datastore.DecodeKey(form.WebsafeKey)
 	if err != nil {
-		return errBadRequest(err, "invalid conference key")
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	attendee := pid
+	if form.Attendee != "" {
+		attendee, err = emailID(c, pid, form.Attendee)
+		if err != nil {
+			return nil, errBadRequest(err, "invalid email")
+		}
 	}
 
+	var profile, promotedProfile *Profile
+	var promoted *identity
+	var conference *Conference
+	var cancellation *Cancellation
+	var events dispatcher
+
 	err = datastore.RunInTransaction(c, func(c context.Context) error {
 		errc := make(chan error, 2)
-		var profile *Profile
-		var conference *Conference
 
 		go func() {
 			// get the profile
 			var err error
-			profile, err = getProfile(c, pid)
+			profile, err = loadProfile(c, attendee)
 			errc <- err
 		}()
 
 		go func() {
 			// get the conference
 			var err error
-			conference, err = getConference(c, ckey)
+			conference, err = loadConference(c, ckey)
 			if err != nil {
 				err = errBadRequest(err, "conference does not exist")
 			}
@@ -164,38 +410,79 @@ func (ConferenceAPI) CancelConference(c context.Context, form *ConferenceKeyForm
 		if !profile.IsRegistered(conference.WebsafeKey) {
 			return errConflict("not registered")
 		}
+		now := time.Now()
+		if err := conference.checkCancellation(now); err != nil {
+			return err
+		}
+
+		rkey, registration, err := loadRegistration(c, ckey, attendee.key)
+		if err != nil {
+			return err
+		}
+		if err := registration.checkManager(pid); err != nil {
+			return err
+		}
 
 		// unregister from the conference
 		profile.unregister(conference.WebsafeKey)
-		_, err = datastore.Put(c, pid.key, profile)
+		_, err = putProfile(c, attendee.key, profile)
 		if err != nil {
 			return errInternalServer(err, "unable to save profile")
 		}
 
-		// increase the available seats
-		conference.SeatsAvailable++
-		_, err = datastore.Put(c, ckey, conference)
+		// give back the seat of the ticket type, to the oldest waitlisted application if any
+		if err := conference.release(registration.Ticket); err != nil {
+			return err
+		}
+		events = newDispatcher(ckey)
+		promoted, promotedProfile, err = promoteWaitlisted(c, ckey, conference, registration.Ticket, now, events)
+		if err != nil {
+			return err
+		}
+		cancellation = &Cancellation{WebsafeKey: conference.WebsafeKey}
+		if registration.PaymentID != "" {
+			refund, err := refundRegistration(c, ckey, conference, registration, now)
+			if err != nil {
+				return err
+			}
+			cancellation.Refund, cancellation.Currency = refund.Amount, refund.Currency
+		}
+		_, err = putConference(c, ckey, conference)
 		if err != nil {
 			return errInternalServer(err, "unable to save conference")
 		}
 
-		// update indexation
-		err = indexConference(c, conference)
+		err = datastore.Delete(c, rkey)
 		if err != nil {
-			return errInternalServer(err, "unable to index conference")
+			return errInternalServer(err, "unable to delete registration")
+		}
+
+		// publish the event
+		events.publish(&Event{
+			Name:          EventRegistrationCancelled,
+			ConferenceKey: conference.WebsafeKey,
+			ProfileKey:    attendee.key.Encode(),
+			Email:         attendee.email,
+		})
+
+		err = events.save(c)
+		if err != nil {
+			return errInternalServer(err, "unable to publish event")
 		}
 		return nil
 
 	}, &datastore.TransactionOptions{XG: true})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// clear cache
-	err = deleteCacheNoFilters.Call(c)
-	if err != nil {
-		log.Errorf(c, "unable to clear cache: %v", err)
+	// cache the entities
+	cacheProfile(c, attendee.key, profile)
+	if promoted != nil {
+		cacheProfile(c, promoted.key, promotedProfile)
 	}
-	return nil
+	cacheConference(c, ckey, conference)
+	events.flush(c)
+	return cancellation, nil
 }
@@ -0,0 +1,51 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistrationWindow(t *testing.T) {
+	date := func(day int) time.Time {
+		return time.Date(2016, 10, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	tts := []struct {
+		conference            Conference
+		open, close, deadline time.Time
+	}{
+		// the registration window
+		{Conference{StartDate: date(10), EndDate: date(12),
+			RegistrationOpen: date(1), RegistrationClose: date(8), CancellationDeadline: date(5)},
+			date(1), date(8), date(5)},
+		// closed when the conference ends, cancelled until it starts
+		{Conference{StartDate: date(10), EndDate: date(12)},
+			windowStart, date(12), date(10)},
+		// closed when the conference starts without EndDate
+		{Conference{StartDate: date(10)},
+			windowStart, date(10), date(10)},
+		// no dates
+		{Conference{},
+			windowStart, windowEnd, windowEnd},
+	}
+
+	for _, tt := range tts {
+		open, close, deadline := tt.conference.registrationWindow()
+		if !open.Equal(tt.open) || !close.Equal(tt.close) || !deadline.Equal(tt.deadline) {
+			t.Errorf("got:(%v, %v, %v), want:(%v, %v, %v)",
+				open, close, deadline, tt.open, tt.close, tt.deadline)
+		}
+	}
+
+	// a conference without EndDate is closed once started
+	conference := &Conference{StartDate: date(10)}
+	if err := conference.checkRegistration(date(9)); err != nil {
+		t.Errorf("got:%v, want:nil", err)
+	}
+	if err := conference.checkRegistration(date(11)); err == nil {
+		t.Errorf("registration should be closed")
+	}
+}
@@ -0,0 +1,158 @@
+package ud859
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// Roster lists the attendees of a conference with their answers, summarizes
+// the answers to each question and the attendance by ticket type.
+type Roster struct {
+	Attendees  []*RosterAttendee   `json:"attendees"`
+	Questions  []*QuestionSummary  `json:"questions"`
+	Attendance []*TicketAttendance `json:"attendance"`
+}
+
+// RosterAttendee is a registered attendee and its answers.
+type RosterAttendee struct {
+	Email   string        `json:"email"`
+	Ticket  string        `json:"ticket"`
+	Answers []*AnswerForm `json:"answers"`
+	// CheckedIn is zero until the attendee is checked in.
+	CheckedIn time.Time `json:"checkedIn"`
+}
+
+// TicketAttendance counts the registered and checked in attendees of a ticket type.
+type TicketAttendance struct {
+	Ticket     string `json:"ticket"`
+	Registered int    `json:"registered"`
+	CheckedIn  int    `json:"checkedIn"`
+}
+
+// QuestionSummary counts the attendees who have answered a question,
+// and the attendees who have answered each choice of a choice question.
+type QuestionSummary struct {
+	Question *Question      `json:"question"`
+	Answered int            `json:"answered"`
+	Counts   []*ChoiceCount `json:"counts,omitempty"`
+}
+
+// ChoiceCount is the number of attendees who have answered a choice.
+type ChoiceCount struct {
+	Choice string `json:"choice"`
+	Count  int    `json:"count"`
+}
+
+// newRoster creates the roster of the registrations, in the order of the questions,
+// of the choices and of the ticket types.
+func newRoster(questions []*Question, registrations []*Registration) *Roster {
+	roster := &Roster{
+		Attendees: make([]*RosterAttendee, 0, len(registrations)),
+		Questions: make([]*QuestionSummary, len(questions)),
+	}
+
+	summaries := make(map[int64]*QuestionSummary)
+	counts := make(map[int64]map[string]*ChoiceCount)
+	for i, question := range questions {
+		summary := &QuestionSummary{Question: question}
+		counts[question.ID] = make(map[string]*ChoiceCount)
+		for _, choice := range question.Choices {
+			count := &ChoiceCount{Choice: choice}
+			summary.Counts = append(summary.Counts, count)
+			counts[question.ID][choice] = count
+		}
+		roster.Questions[i] = summary
+		summaries[question.ID] = summary
+	}
+
+	attendance := make(map[string]*TicketAttendance)
+	for _, registration := range registrations {
+		attendee := &RosterAttendee{
+			Email:     registration.Email,
+			Ticket:    registration.Ticket,
+			Answers:   make([]*AnswerForm, 0),
+			CheckedIn: registration.CheckedIn,
+		}
+
+		tally := attendance[registration.Ticket]
+		if tally == nil {
+			tally = &TicketAttendance{Ticket: registration.Ticket}
+			attendance[registration.Ticket] = tally
+		}
+		tally.Registered++
+		if !registration.CheckedIn.IsZero() {
+			tally.CheckedIn++
+		}
+
+		var last *AnswerForm
+		for _, answer := range registration.Answers {
+			summary := summaries[answer.QuestionID]
+			if summary == nil {
+				continue
+			}
+			if last == nil || last.QuestionID != answer.QuestionID {
+				last = &AnswerForm{QuestionID: answer.QuestionID}
+				attendee.Answers = append(attendee.Answers, last)
+				summary.Answered++
+			}
+
+			if summary.Question.Type == QuestionText {
+				last.Text = answer.Value
+			} else {
+				last.Choices = append(last.Choices, answer.Value)
+				if count := counts[answer.QuestionID][answer.Value]; count != nil {
+					count.Count++
+				}
+			}
+		}
+		roster.Attendees = append(roster.Attendees, attendee)
+	}
+
+	roster.Attendance = make([]*TicketAttendance, 0, len(attendance))
+	for _, typ := range ticketTypes {
+		if tally := attendance[typ]; tally != nil {
+			roster.Attendance = append(roster.Attendance, tally)
+		}
+	}
+	return roster
+}
+
+// GetRoster returns the roster of the attendees of a conference created by the current user.
+func (ConferenceAPI) GetRoster(c context.Context, form *ConferenceKeyForm) (*Roster, error) {
+	pid, err := profileID(c)
+	if err != nil {
+		return nil, err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return nil, errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return nil, errForbidden("not the organizer of the conference")
+	}
+
+	questions, err := loadQuestions(c, ckey)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to get questions")
+	}
+
+	var registrations []*Registration
+	_, err = datastore.NewQuery("Registration").
+		Ancestor(ckey).
+		GetAll(c, &registrations)
+	if err != nil {
+		return nil, errInternalServer(err, "unable to query registrations")
+	}
+
+	// the seats held by a checkout are not registered yet
+	registered := make([]*Registration, 0, len(registrations))
+	for _, registration := range registrations {
+		if registration.Status != PaymentPending {
+			registered = append(registered, registration)
+		}
+	}
+	return newRoster(questions, registered), nil
+}
@@ -1,15 +1,14 @@
 package ud859
 
 import (
-	"fmt"
-	"sort"
 	"strings"
 	"time"
-	"unicode"
 
 	"golang.org/x/net/context"
 
-	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/search"
 )
 
@@ -26,86 +25,207 @@ type conferenceDoc struct {
 	Month          float64     `json:"-" search:"MONTH"`
 	MaxAttendees   float64     `json:"maxAttendees" search:"MAX_ATTENDEES"`
 	SeatsAvailable float64     `json:"seatsAvailable" search:"SEATS_AVAILABLE"`
+
+	// the capacity and the available seats of the ticket types.
+	CapacityRegular float64 `json:"-" search:"CAPACITY_REGULAR"`
+	SeatsRegular    float64 `json:"-" search:"SEATS_REGULAR"`
+	CapacityStudent float64 `json:"-" search:"CAPACITY_STUDENT"`
+	SeatsStudent    float64 `json:"-" search:"SEATS_STUDENT"`
+	CapacitySpeaker float64 `json:"-" search:"CAPACITY_SPEAKER"`
+	SeatsSpeaker    float64 `json:"-" search:"SEATS_SPEAKER"`
+	CapacitySponsor float64 `json:"-" search:"CAPACITY_SPONSOR"`
+	SeatsSponsor    float64 `json:"-" search:"SEATS_SPONSOR"`
+
+	// the prices of the ticket types, in the currency of the conference.
+	PriceRegular float64     `json:"-" search:"PRICE_REGULAR"`
+	PriceStudent float64     `json:"-" search:"PRICE_STUDENT"`
+	PriceSpeaker float64     `json:"-" search:"PRICE_SPEAKER"`
+	PriceSponsor float64     `json:"-" search:"PRICE_SPONSOR"`
+	Currency     search.Atom `json:"currency" search:"CURRENCY"`
+
+	Created time.Time   `json:"-" search:"CREATED"`
+	Status  search.Atom `json:"status" search:"STATUS"`
+
+	RegistrationOpen     time.Time `json:"registrationOpen" search:"REGISTRATION_OPEN"`
+	RegistrationClose    time.Time `json:"registrationClose" search:"REGISTRATION_CLOSE"`
+	CancellationDeadline time.Time `json:"cancellationDeadline" search:"CANCELLATION_DEADLINE"`
+
+	// Location is not saved when the venue location is unknown.
+	Location appengine.GeoPoint `json:"-" search:"LOCATION"`
+
+	// the prefixes of the tokens, for the suggestions.
+	NamePrefix  string `json:"-" search:"NAME_PREFIX"`
+	CityPrefix  string `json:"-" search:"CITY_PREFIX"`
+	TopicPrefix string `json:"-" search:"TOPIC_PREFIX"`
+
+	// topics are saved as facets, one per topic.
+	topics []string
 }
 
 // fromConference creates a conferenceDoc from a Conference.
 func fromConference(c *Conference) *conferenceDoc {
-	return &conferenceDoc{
+	open, close, deadline := c.registrationWindow()
+
+	doc := &conferenceDoc{
 		WebsafeKey:     search.Atom(c.WebsafeKey),
 		Name:           c.Name,
 		Description:    c.Description,
 		Organizer:      c.Organizer,
 		Topics:         strings.Join(c.Topics, " "),
+		topics:         c.Topics,
 		City:           c.City,
-		StartDate:      c.StartDate,
-		EndDate:        c.EndDate,
+		StartDate:      c.StartDate.UTC(),
+		EndDate:        c.EndDate.UTC(),
 		Month:          float64(c.StartDate.Month()),
 		MaxAttendees:   float64(c.MaxAttendees),
 		SeatsAvailable: float64(c.SeatsAvailable),
+		Currency:       search.Atom(c.Currency),
+		Created:        c.Created.UTC(),
+		Status:         search.Atom(c.status()),
+		Location:       appengine.GeoPoint{Lat: c.Latitude, Lng: c.Longitude},
+		NamePrefix:     prefixes(c.Name),
+		CityPrefix:     prefixes(c.City),
+		TopicPrefix:    prefixes(c.Topics...),
+
+		RegistrationOpen:     open.UTC(),
+		RegistrationClose:    close.UTC(),
+		CancellationDeadline: deadline.UTC(),
+	}
+	doc.setTickets(c.tickets())
+	return doc
+}
+
+// Save saves the fields of the conferenceDoc, and its facets.
+func (doc *conferenceDoc) Save() ([]search.Field, *search.DocumentMetadata, error) {
+	fields, err := search.SaveStruct(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if doc.Location.Lat == 0 && doc.Location.Lng == 0 {
+		// the distance to an unknown location is not computed
+		for i, field := range fields {
+			if field.Name == Location {
+				fields = append(fields[:i], fields[i+1:]...)
+				break
+			}
+		}
+	}
+	return fields, &search.DocumentMetadata{Facets: doc.facets()}, nil
+}
+
+// Load loads the fields of the conferenceDoc, and the topics from its facets.
+func (doc *conferenceDoc) Load(fields []search.Field, meta *search.DocumentMetadata) error {
+	if meta != nil {
+		for _, facet := range meta.Facets {
+			if topic, ok := facet.Value.(search.Atom); ok && facet.Name == Topics {
+				doc.topics = append(doc.topics, string(topic))
+			}
+		}
 	}
+	return search.LoadStruct(doc, fields)
 }
 
 // fromConferenceDoc creates a Conference from a conferenceDoc.
 func fromConferenceDoc(doc *conferenceDoc) *Conference {
+	topics := doc.topics
+	if topics == nil {
+		// indexed without facets
+		topics = strings.Split(doc.Topics, " ")
+	}
+
 	return &Conference{
 		WebsafeKey:     string(doc.WebsafeKey),
 		Name:           doc.Name,
 		Description:    doc.Description,
 		Organizer:      doc.Organizer,
-		Topics:         strings.Split(doc.Topics, " "),
+		Topics:         topics,
 		City:           doc.City,
 		StartDate:      doc.StartDate.UTC(),
 		EndDate:        doc.EndDate.UTC(),
 		Month:          int(doc.StartDate.Month()),
 		MaxAttendees:   int(doc.MaxAttendees),
 		SeatsAvailable: int(doc.SeatsAvailable),
+		Tickets:        doc.tickets(),
+		Currency:       string(doc.Currency),
+		Created:        doc.Created.UTC(),
+		Status:         string(doc.Status),
+		Visibility:     VisibilityPublic,
+		Latitude:       doc.Location.Lat,
+		Longitude:      doc.Location.Lng,
+
+		RegistrationOpen:     fromWindow(doc.RegistrationOpen, windowStart),
+		RegistrationClose:    fromWindow(doc.RegistrationClose, windowEnd),
+		CancellationDeadline: fromWindow(doc.CancellationDeadline, windowEnd),
 	}
 }
 
-// query returns the query string to apply to the search index.
-func (q ConferenceQueryForm) query() string {
-	var str string
-	for _, filter := range q.Filters {
-		field := filter.Field
-		op := filter.Op
+// fromWindow returns the zero time for a bound of the registration window.
+func fromWindow(t, bound time.Time) time.Time {
+	if t.Equal(bound) {
+		return time.Time{}
+	}
+	return t.UTC()
+}
 
-		if op == NE {
-			field = "NOT " + field
-			op = EQ
-		}
+// searchConferences searches the index, or evaluates the filters against the datastore
+// when the search index is unavailable.
+func searchConferences(c context.Context, form *ConferenceQueryForm) (*Conferences, error) {
+	query, err := form.query()
+	if err != nil {
+		return nil, errBadRequest(err, "invalid query")
+	}
 
-		if field == "KEY" {
-			str += fmt.Sprintf("%s = %q ", field, filter.Value)
-			continue
-		}
+	if !searchBreaker.allow() {
+		return filterConferences(c, form)
+	}
 
-		switch v := filter.Value.(type) {
-		case string:
-			str += fmt.Sprintf("%s = (%s) ", field, strings.Map(alphaNumeric, v))
-		case time.Time:
-			str += fmt.Sprintf("%s %s %s ", field, op, v.Format("2006-01-02"))
-		default:
-			str += fmt.Sprintf("%s %s %v ", field, op, v)
-		}
+	conferences, err := searchIndex(c, form, query)
+	if err != nil && searchUnavailable(err) {
+		log.Warningf(c, "search index unavailable: %v", err)
+		searchBreaker.failure()
+		return filterConferences(c, form)
+	} else if err != nil && strings.Contains(err.Error(), "INVALID_REQUEST") {
+		return nil, errBadRequest(err, "invalid query")
+	} else if err != nil {
+		return nil, errInternalServer(err, "unable to search conferences")
 	}
-	return str
+
+	searchBreaker.success()
+	return conferences, nil
 }
 
-func alphaNumeric(r rune) rune {
-	if unicode.IsLetter(r) || unicode.IsNumber(r) {
-		return r
+// searchUnavailable returns true if the search error is caused by the service
+// rather than by the query: the service is unavailable, has timed out or has failed.
+func searchUnavailable(err error) bool {
+	if err == context.DeadlineExceeded || appengine.IsTimeoutError(err) {
+		return true
 	}
-	return ' '
+	message := err.Error()
+	for _, code := range []string{"TRANSIENT_ERROR", "INTERNAL_ERROR", "TIMEOUT", "unavailable"} {
+		if strings.Contains(message, code) {
+			return true
+		}
+	}
+	return false
 }
 
-func searchConferences(c context.Context, form *ConferenceQueryForm) (*Conferences, error) {
+func searchIndex(c context.Context, form *ConferenceQueryForm, query string) (*Conferences, error) {
 	index, err := search.Open("Conference")
 	if err != nil {
-		return nil, errInternalServer(err, "unable to open search index")
+		return nil, err
 	}
 
-	it := index.Search(c, form.query(), nil)
-	conferences := new(Conferences)
+	c, cancel := context.WithTimeout(c, searchTimeout)
+	defer cancel()
+
+	it := index.Search(c, query, &search.SearchOptions{
+		Sort:   form.sortOptions(),
+		Facets: facetOptions(),
+	})
+	conferences := &Conferences{
+		Plan: form.plan(conferencesBackfilled(c)),
+	}
 
 	for {
 		doc := new(conferenceDoc)
@@ -114,32 +234,44 @@ func searchConferences(c context.Context, form *ConferenceQueryForm) (*Conferenc
 		if err == search.Done {
 			break
 		} else if err != nil {
-			return nil, errInternalServer(err, "unable to search index")
+			return nil, err
 		}
 
 		conference := fromConferenceDoc(doc)
 		conferences.Items = append(conferences.Items, conference)
 	}
 
-	sort.Sort(conferences)
+	facets, err := it.Facets()
+	if err != nil {
+		return nil, err
+	}
+	conferences.Facets = fromFacetResults(facets)
 	return conferences, nil
 }
 
-func isTesting() bool {
-	return clientID == "YOUR-CLIENT-ID"
+func init() {
+	subscribe("index", indexSubscriber,
+		EventConferenceCreated, EventConferenceUpdated,
+		EventRegistrationCreated, EventRegistrationCancelled)
 }
 
-func indexConference(c context.Context, conference *Conference) error {
-	if isTesting() {
-		// when testing, update the index without delay
-		return indexConferenceNow(c, conference)
+// indexSubscriber indexes the latest version of the conference concerned by the event.
+func indexSubscriber(c context.Context, e *Event) error {
+	key, err := datastore.DecodeKey(e.ConferenceKey)
+	if err != nil {
+		return err
+	}
+	conference, err := loadConference(c, key)
+	if err != nil {
+		return err
 	}
-	return indexConferenceDelay.Call(c, conference)
+	if !conference.listed() {
+		return unindexConference(c, conference)
+	}
+	return indexConference(c, conference)
 }
 
-var indexConferenceDelay = delay.Func("index_conference", indexConferenceNow)
-
-func indexConferenceNow(c context.Context, conference *Conference) error {
+func indexConference(c context.Context, conference *Conference) error {
 	index, err := search.Open("Conference")
 	if err != nil {
 		return errInternalServer(err, "unable to open search index")
@@ -148,5 +280,23 @@ func indexConferenceNow(c context.Context, conference *Conference) error {
 	if err != nil {
 		return errInternalServer(err, "unable to index conference")
 	}
+
+	// the cached queries may be older than the index
+	invalidateQueries(c)
+	return nil
+}
+
+// unindexConference removes a conference from the search index.
+func unindexConference(c context.Context, conference *Conference) error {
+	index, err := search.Open("Conference")
+	if err != nil {
+		return errInternalServer(err, "unable to open search index")
+	}
+	err = index.Delete(c, conference.WebsafeKey)
+	if err != nil {
+		return errInternalServer(err, "unable to unindex conference")
+	}
+
+	invalidateQueries(c)
 	return nil
 }
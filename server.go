@@ -47,15 +47,34 @@ func RegisterConferenceAPI(server *endpoints.Server) error {
 	// conference
 	register("GetConference", "getConference", "GET", "conference/{websafeConferenceKey}")
 	login("CreateConference", "createConference", "POST", "conference")
+	register("GetQuestions", "getQuestions", "GET", "conference/{websafeConferenceKey}/questions")
+	login("SetConferenceStatus", "setConferenceStatus", "POST", "conference/{websafeConferenceKey}/status")
+	login("CreatePromoCode", "createPromoCode", "POST", "conference/{websafeConferenceKey}/promoCodes")
+	login("PromoCodes", "getPromoCodes", "GET", "conference/{websafeConferenceKey}/promoCodes")
+	login("InviteAttendees", "inviteAttendees", "POST", "conference/{websafeConferenceKey}/invitations")
+	login("RevokeInvitation", "revokeInvitation", "DELETE", "conference/{websafeConferenceKey}/invitations")
+	login("Invitations", "getInvitations", "GET", "conference/{websafeConferenceKey}/invitations")
+	login("Applications", "getApplications", "GET", "conference/{websafeConferenceKey}/applications")
+	login("ApproveApplication", "approveApplication", "POST", "conference/{websafeConferenceKey}/applications/approve")
+	login("RejectApplication", "rejectApplication", "POST", "conference/{websafeConferenceKey}/applications/reject")
 
 	// query conferences
 	login("ConferencesCreated", "getConferencesCreated", "POST", "getConferencesCreated")
 	login("ConferencesToAttend", "getConferencesToAttend", "GET", "getConferencesToAttend")
 	register("QueryConferences", "queryConferences", "POST", "queryConferences")
+	register("Suggest", "suggest", "GET", "suggest")
 
 	// registration
 	login("GotoConference", "registerForConference", "POST", "conference/{websafeConferenceKey}/registration")
 	login("CancelConference", "unregisterFromConference", "DELETE", "conference/{websafeConferenceKey}/registration")
+	login("TransferRegistration", "transferRegistration", "POST", "conference/{websafeConferenceKey}/transfer")
+	login("GroupRegistrations", "getGroupRegistrations", "GET", "conference/{websafeConferenceKey}/group")
+	login("CheckoutConference", "checkoutConference", "POST", "conference/{websafeConferenceKey}/checkout")
+	login("GetInvoice", "getInvoice", "GET", "conference/{websafeConferenceKey}/invoice")
+	login("GetApplication", "getApplication", "GET", "conference/{websafeConferenceKey}/application")
+	login("GetTicketToken", "getTicketToken", "GET", "conference/{websafeConferenceKey}/ticket")
+	login("GetRoster", "getRoster", "GET", "conference/{websafeConferenceKey}/roster")
+	login("CheckIn", "checkIn", "POST", "conference/{websafeConferenceKey}/checkIn")
 
 	return nil
 }
@@ -79,6 +79,30 @@ func (c *client) doAs(email, url string, v interface{}) (*httptest.ResponseRecor
 	return w, nil
 }
 
+// get serves the url with the http handlers of the application.
+func (c *client) get(url string) (*httptest.ResponseRecorder, error) {
+	r, err := c.inst.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	return w, nil
+}
+
+// post serves the url with the http handlers of the application.
+func (c *client) post(url string) (*httptest.ResponseRecorder, error) {
+	r, err := c.inst.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	return w, nil
+}
+
 // authenticator
 
 type testAuthenticator struct{}
@@ -120,7 +144,22 @@ func TestAPI(t *testing.T) {
 	t.Run("GetConference", withClient(c, getConference))
 	t.Run("CreateConference", withClient(c, createConference))
 	t.Run("QueryConferences", withClient(c, queryConferences))
+	t.Run("Suggest", withClient(c, suggestConferences))
+	t.Run("CacheStats", withClient(c, cacheStats))
 	t.Run("Registration", withClient(c, gotoConferences))
+	t.Run("Outbox", withClient(c, deadLetters))
+	t.Run("Status", withClient(c, conferenceStatus))
+	t.Run("RegistrationWindow", withClient(c, registrationWindow))
+	t.Run("Tickets", withClient(c, ticketTypes))
+	t.Run("Payments", withClient(c, paidRegistration))
+	t.Run("PromoCodes", withClient(c, promoCodes))
+	t.Run("RefundPolicy", withClient(c, refundPolicy))
+	t.Run("Transfer", withClient(c, transferRegistration))
+	t.Run("Group", withClient(c, groupRegistration))
+	t.Run("Invitations", withClient(c, invitations))
+	t.Run("Approval", withClient(c, approvalWorkflow))
+	t.Run("Questions", withClient(c, registrationQuestions))
+	t.Run("CheckIn", withClient(c, ticketCheckIn))
 }
 
 // profile
@@ -235,8 +274,8 @@ func createConference(c *client, t *testing.T) {
 			Description:  "Largest event in the world dedicated to the Go programming language",
 			Topics:       []string{"Programming", "Go", "Mountain"},
 			City:         "Denver, Colorado",
-			StartDate:    "2016-07-11T23:00:00Z",
-			EndDate:      "2016-07-13T23:00:00Z",
+			StartDate:    "2036-07-11T23:00:00Z",
+			EndDate:      "2036-07-13T23:00:00Z",
 			MaxAttendees: "10",
 		},
 		{
@@ -244,8 +283,8 @@ func createConference(c *client, t *testing.T) {
 			Description:  "The European Go conference",
 			Topics:       []string{"Programming", "Go"},
 			City:         "Paris",
-			StartDate:    "2016-10-10T23:00:00Z",
-			EndDate:      "2016-10-10T23:00:00Z",
+			StartDate:    "2036-10-10T23:00:00Z",
+			EndDate:      "2036-10-10T23:00:00Z",
 			MaxAttendees: "1",
 		},
 	}
@@ -367,6 +406,11 @@ func queryConferences(c *client, t *testing.T) {
 	t.Run("Nofilters", withClient(c, queryNofilters))
 	t.Run("Invalid", withClient(c, queryInvalid))
 	t.Run("Filters", withClient(c, queryFilters))
+	t.Run("Explain", withClient(c, queryExplain))
+	t.Run("QueryString", withClient(c, queryString))
+	t.Run("Facets", withClient(c, queryFacets))
+	t.Run("Sort", withClient(c, querySort))
+	t.Run("Near", withClient(c, queryNear))
 }
 
 func queryNofilters(c *client, t *testing.T) {
@@ -396,6 +440,9 @@ func queryInvalid(c *client, t *testing.T) {
 		{ud859.Month, ud859.EQ, "dotGo"},
 		{ud859.Month, "OK", 10},
 		{ud859.StartDate, ud859.EQ, "dotGo"},
+		{"FOO", ud859.EQ, "dotGo"},
+		{ud859.City, ud859.LT, "Paris"},
+		{ud859.Name, ud859.EQ, 10},
 	}
 
 	for _, tt := range tts {
@@ -481,24 +528,24 @@ func queryFilters(c *client, t *testing.T) {
 		{[]r{{ud859.SeatsAvailable, ud859.LT, 10}}, 1},
 		{[]r{{ud859.SeatsAvailable, ud859.LTE, 10}}, 2},
 		//
-		{[]r{{ud859.StartDate, ud859.GTE, "2016-10-01T23:00:00Z"},
-			{ud859.StartDate, ud859.LTE, "2016-10-31T23:00:00Z"}}, 1},
-		{[]r{{ud859.StartDate, ud859.GTE, "2016-01-01T23:00:00Z"}}, 2},
-		{[]r{{ud859.StartDate, ud859.GTE, "2017-01-01T23:00:00Z"}}, 0},
+		{[]r{{ud859.StartDate, ud859.GTE, "2036-10-01T23:00:00Z"},
+			{ud859.StartDate, ud859.LTE, "2036-10-31T23:00:00Z"}}, 1},
+		{[]r{{ud859.StartDate, ud859.GTE, "2036-01-01T23:00:00Z"}}, 2},
+		{[]r{{ud859.StartDate, ud859.GTE, "2037-01-01T23:00:00Z"}}, 0},
 		//
 		{[]r{{ud859.City, ud859.EQ, "Paris"},
-			{ud859.StartDate, ud859.GT, "2016-10-01T23:00:00Z"}}, 1},
+			{ud859.StartDate, ud859.GT, "2036-10-01T23:00:00Z"}}, 1},
 		{[]r{{ud859.City, ud859.EQ, "Paris"},
-			{ud859.StartDate, ud859.GT, "2016-11-01T23:00:00Z"}}, 0},
+			{ud859.StartDate, ud859.GT, "2036-11-01T23:00:00Z"}}, 0},
 		{[]r{{ud859.City, ud859.EQ, "Paris"},
 			{ud859.Topics, ud859.EQ, "Go"},
-			{ud859.StartDate, ud859.GT, "2016-10-01T23:00:00Z"}}, 1},
+			{ud859.StartDate, ud859.GT, "2036-10-01T23:00:00Z"}}, 1},
 		{[]r{{ud859.City, ud859.EQ, "Paris"},
 			{ud859.Topics, ud859.EQ, "Go"},
-			{ud859.StartDate, ud859.GT, "2016-11-01T23:00:00Z"}}, 0},
+			{ud859.StartDate, ud859.GT, "2036-11-01T23:00:00Z"}}, 0},
 		//
 		{[]r{{ud859.Topics, ud859.EQ, "Go"},
-			{ud859.StartDate, ud859.GT, "2016-01-01T23:00:00Z"}}, 2},
+			{ud859.StartDate, ud859.GT, "2036-01-01T23:00:00Z"}}, 2},
 	}
 
 	for _, tt := range tts {
@@ -534,6 +581,371 @@ func queryFilters(c *client, t *testing.T) {
 	}
 }
 
+func queryExplain(c *client, t *testing.T) {
+	type r ud859.Filter
+
+	tts := []struct {
+		restrictions []r
+		backend      string
+	}{
+		{nil, ud859.BackendDatastore},
+		{[]r{{ud859.City, ud859.EQ, "Denver, Colorado"}}, ud859.BackendDatastore},
+		{[]r{{ud859.City, ud859.NE, "Paris"}}, ud859.BackendSearch},
+		{[]r{{ud859.Month, ud859.EQ, 10}}, ud859.BackendDatastore},
+		{[]r{{ud859.Month, ud859.GT, 3}}, ud859.BackendSearch},
+		{[]r{{ud859.City, ud859.EQ, "Paris"},
+			{ud859.StartDate, ud859.GT, "2036-10-01T23:00:00Z"}}, ud859.BackendDatastore},
+		{[]r{{ud859.City, ud859.EQ, "Paris"},
+			{ud859.Topics, ud859.EQ, "Go"}}, ud859.BackendSearch},
+	}
+
+	// the conferences saved before the backfill lack the CITY and Month properties
+	query := new(ud859.ConferenceQueryForm).Filter(ud859.City, ud859.EQ, "Paris")
+	if plan := explainQuery(c, t, query); plan.Backend != ud859.BackendSearch {
+		t.Errorf("got:%s, want:%s before the backfill", plan.Backend, ud859.BackendSearch)
+	}
+	backfillConferences(c, t)
+
+	for _, tt := range tts {
+		query := new(ud859.ConferenceQueryForm)
+		for _, r := range tt.restrictions {
+			query.Filter(r.Field, r.Op, r.Value)
+		}
+
+		plan := explainQuery(c, t, query)
+		if plan.Backend != tt.backend {
+			t.Errorf("%v got:%s, want:%s", tt.restrictions, plan.Backend, tt.backend)
+		}
+	}
+}
+
+// explainQuery returns the QueryPlan of the query.
+func explainQuery(c *client, t *testing.T, query *ud859.ConferenceQueryForm) *ud859.QueryPlan {
+	query.Explain = true
+	w, err := c.do("/ConferenceAPI.QueryConferences", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// decode the conferences
+	conferences := new(ud859.Conferences)
+	err = json.NewDecoder(w.Body).Decode(conferences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conferences.Plan == nil {
+		t.Fatalf("%v: plan is missing", query.Filters)
+	}
+	return conferences.Plan
+}
+
+// backfillConferences saves again the conferences with the properties queried by the datastore.
+func backfillConferences(c *client, t *testing.T) {
+	w, err := c.post("/admin/backfill_conferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	var progress struct {
+		Count int  `json:"count"`
+		Done  bool `json:"done"`
+	}
+	if err = json.NewDecoder(w.Body).Decode(&progress); err != nil {
+		t.Fatal(err)
+	}
+	if !progress.Done || progress.Count == 0 {
+		t.Fatalf("unexpected backfill %+v", progress)
+	}
+}
+
+func queryString(c *client, t *testing.T) {
+	tts := []struct {
+		query    string
+		status   int
+		expected int
+	}{
+		{`city:Paris`, http.StatusOK, 1},
+		{`topic:go month>=7`, http.StatusOK, 2},
+		{`topic:go -city:Paris`, http.StatusOK, 1},
+		{`"European Go"`, http.StatusOK, 1},
+		{`"Go European"`, http.StatusOK, 0},
+		{`city:Denver -topic:Mountain`, http.StatusOK, 0},
+		{`foo:bar`, http.StatusBadRequest, 0},
+		{`month>=june`, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tts {
+		query := &ud859.ConferenceQueryForm{Query: tt.query}
+
+		w, err := c.do("/ConferenceAPI.QueryConferences", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.status {
+			t.Fatalf("%s got:%d, want:%d", tt.query, w.Code, tt.status)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		// decode the conferences
+		conferences := new(ud859.Conferences)
+		err = json.NewDecoder(w.Body).Decode(conferences)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conferences.Items) != tt.expected {
+			t.Errorf("%s got:%d, want:%d", tt.query, len(conferences.Items), tt.expected)
+		}
+	}
+}
+
+func queryFacets(c *client, t *testing.T) {
+	type r ud859.Filter
+
+	tts := []struct {
+		restrictions []r
+		facet        string
+		expected     map[string]int
+	}{
+		{nil, ud859.Topics, map[string]int{"Go": 2, "Programming": 2, "Mountain": 1}},
+		{nil, ud859.City, map[string]int{"Paris": 1, "Denver, Colorado": 1}},
+		{nil, ud859.Month, map[string]int{"7": 1, "10": 1}},
+		{nil, ud859.SeatsAvailable, map[string]int{"1-9": 1, "10-99": 1}},
+		{[]r{{ud859.City, ud859.EQ, "Paris"}}, ud859.Topics, map[string]int{"Go": 1, "Programming": 1}},
+		{[]r{{ud859.Topics, ud859.EQ, "Mountain"}}, ud859.City, map[string]int{"Denver, Colorado": 1}},
+		{[]r{{ud859.Topics, ud859.EQ, "Go"}}, ud859.Topics, map[string]int{"Go": 2, "Programming": 2, "Mountain": 1}},
+	}
+
+	for _, tt := range tts {
+		query := new(ud859.ConferenceQueryForm)
+		for _, r := range tt.restrictions {
+			query.Filter(r.Field, r.Op, r.Value)
+		}
+
+		w, err := c.do("/ConferenceAPI.QueryConferences", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+		}
+
+		// decode the conferences
+		conferences := new(ud859.Conferences)
+		err = json.NewDecoder(w.Body).Decode(conferences)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counts := make(map[string]int)
+		for _, facet := range conferences.Facets {
+			if facet.Name != tt.facet {
+				continue
+			}
+			for _, value := range facet.Values {
+				counts[value.Value] = value.Count
+			}
+		}
+		if !reflect.DeepEqual(counts, tt.expected) {
+			t.Errorf("%v %s got:%v, want:%v", tt.restrictions, tt.facet, counts, tt.expected)
+		}
+	}
+}
+
+func querySort(c *client, t *testing.T) {
+	type r ud859.Filter
+
+	tts := []struct {
+		sort         string
+		restrictions []r
+		status       int
+		expected     []string
+	}{
+		{"", nil, http.StatusOK, []string{"gophercon", "dotGo"}},
+		{ud859.SortStartDate, nil, http.StatusOK, []string{"gophercon", "dotGo"}},
+		{ud859.SortStartDateDesc, nil, http.StatusOK, []string{"dotGo", "gophercon"}},
+		{ud859.SortSeatsAvailable, nil, http.StatusOK, []string{"gophercon", "dotGo"}},
+		{ud859.SortName, nil, http.StatusOK, []string{"dotGo", "gophercon"}},
+		{ud859.SortCreated, nil, http.StatusOK, []string{"dotGo", "gophercon"}},
+		{ud859.SortStartDateDesc, []r{{ud859.Topics, ud859.EQ, "Go"}}, http.StatusOK, []string{"dotGo", "gophercon"}},
+		{ud859.SortName, []r{{ud859.Month, ud859.GT, 3}}, http.StatusOK, []string{"dotGo", "gophercon"}},
+		{ud859.SortRelevance, []r{{ud859.Text, ud859.EQ, "European"}}, http.StatusOK, []string{"dotGo"}},
+		{"FOO", nil, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tts {
+		query := &ud859.ConferenceQueryForm{Sort: tt.sort}
+		for _, r := range tt.restrictions {
+			query.Filter(r.Field, r.Op, r.Value)
+		}
+
+		w, err := c.do("/ConferenceAPI.QueryConferences", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.status {
+			t.Fatalf("%s got:%d, want:%d", tt.sort, w.Code, tt.status)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		// decode the conferences
+		conferences := new(ud859.Conferences)
+		err = json.NewDecoder(w.Body).Decode(conferences)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, conference := range conferences.Items {
+			names = append(names, conference.Name)
+		}
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("%s %v got:%v, want:%v", tt.sort, tt.restrictions, names, tt.expected)
+		}
+	}
+}
+
+func queryNear(c *client, t *testing.T) {
+	tts := []struct {
+		near     *ud859.Near
+		sort     string
+		status   int
+		expected []string
+	}{
+		{&ud859.Near{City: "Lyon", Radius: 500}, "", http.StatusOK, []string{"dotGo"}},
+		{&ud859.Near{City: "Lyon", Radius: 200}, "", http.StatusOK, nil},
+		{&ud859.Near{Latitude: 40.015, Longitude: -105.2705, Radius: 100}, "", http.StatusOK, []string{"gophercon"}},
+		{&ud859.Near{City: "Lyon", Radius: 20000}, ud859.SortDistance, http.StatusOK, []string{"dotGo", "gophercon"}},
+		{&ud859.Near{City: "Seattle", Radius: 20000}, ud859.SortDistance, http.StatusOK, []string{"gophercon", "dotGo"}},
+		{&ud859.Near{City: "Atlantis", Radius: 100}, "", http.StatusBadRequest, nil},
+		{&ud859.Near{Latitude: 91, Radius: 100}, "", http.StatusBadRequest, nil},
+		{&ud859.Near{City: "Lyon"}, "", http.StatusBadRequest, nil},
+		{nil, ud859.SortDistance, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tts {
+		query := &ud859.ConferenceQueryForm{Near: tt.near, Sort: tt.sort}
+
+		w, err := c.do("/ConferenceAPI.QueryConferences", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.status {
+			t.Fatalf("%v got:%d, want:%d", tt.near, w.Code, tt.status)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		// decode the conferences
+		conferences := new(ud859.Conferences)
+		err = json.NewDecoder(w.Body).Decode(conferences)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, conference := range conferences.Items {
+			names = append(names, conference.Name)
+		}
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("%v got:%v, want:%v", tt.near, names, tt.expected)
+		}
+	}
+}
+
+// suggest
+
+func suggestConferences(c *client, t *testing.T) {
+	tts := []struct {
+		prefix   string
+		expected []ud859.Suggestion
+	}{
+		{"goph", []ud859.Suggestion{{ud859.Name, "gophercon"}}},
+		{"PAR", []ud859.Suggestion{{ud859.City, "Paris"}}},
+		{"den col", []ud859.Suggestion{{ud859.City, "Denver, Colorado"}}},
+		{"mount", []ud859.Suggestion{{ud859.Topics, "Mountain"}}},
+		{"dart", nil},
+		{"  ", nil},
+	}
+
+	for _, tt := range tts {
+		w, err := c.do("/ConferenceAPI.Suggest", &ud859.SuggestForm{Prefix: tt.prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+		}
+
+		// decode the suggestions
+		suggestions := new(ud859.Suggestions)
+		err = json.NewDecoder(w.Body).Decode(suggestions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var items []ud859.Suggestion
+		for _, item := range suggestions.Items {
+			items = append(items, *item)
+		}
+		if !reflect.DeepEqual(items, tt.expected) {
+			t.Errorf("%q got:%v, want:%v", tt.prefix, items, tt.expected)
+		}
+	}
+}
+
+// cache
+
+func cacheStats(c *client, t *testing.T) {
+	query := new(ud859.ConferenceQueryForm).
+		Filter(ud859.City, ud859.EQ, "Paris")
+
+	// the second query is served by the cache
+	for i := 0; i < 2; i++ {
+		w, err := c.do("/ConferenceAPI.QueryConferences", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+		}
+	}
+
+	w, err := c.get("/admin/cache_stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// decode the statistics
+	var stats struct {
+		Hits   int `json:"hits"`
+		Misses int `json:"misses"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits == 0 {
+		t.Errorf("got:%d, want:>0", stats.Hits)
+	}
+	if stats.Misses == 0 {
+		t.Errorf("got:%d, want:>0", stats.Misses)
+	}
+}
+
 // registration
 
 func gotoConferences(c *client, t *testing.T) {
@@ -818,9 +1230,11 @@ func verifyConferencesToAttend(c *client, t *testing.T, count int) {
 }
 
 func verifyIndexedConference(c *client, t *testing.T, conference *ud859.Conference) {
-	// build the query
+	// build the query, the name filter is answered by the search index
 	query := new(ud859.ConferenceQueryForm).
-		Filter("KEY", ud859.EQ, conference.WebsafeKey)
+		Filter(ud859.Key, ud859.EQ, conference.WebsafeKey).
+		Filter(ud859.Name, ud859.EQ, conference.Name)
+	query.Explain = true
 
 	w, err := c.do("/ConferenceAPI.QueryConferences", query)
 	if err != nil {
@@ -840,9 +1254,956 @@ func verifyIndexedConference(c *client, t *testing.T, conference *ud859.Conferen
 	if len(conferences.Items) != 1 {
 		t.Fatalf("got:%d, want:%d", len(conferences.Items), 1)
 	}
+	if conferences.Plan == nil || conferences.Plan.Backend != ud859.BackendSearch {
+		t.Fatalf("got:%+v, want:%s", conferences.Plan, ud859.BackendSearch)
+	}
+	conferences.Plan = nil
 
 	if !reflect.DeepEqual(conferences.Items[0], conference) {
 		t.Errorf("got: %+v", conferences.Items[0])
 		t.Fatalf("want:%+v", conference)
 	}
 }
+
+// outbox
+
+func deadLetters(c *client, t *testing.T) {
+	w, err := c.get("/admin/outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// decode the dead letters
+	var letters []interface{}
+	err = json.NewDecoder(w.Body).Decode(&letters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 0 {
+		t.Errorf("got:%d, want:0", len(letters))
+	}
+}
+
+// status
+
+func conferenceStatus(c *client, t *testing.T) {
+	form := &ud859.ConferenceForm{
+		Name:         "draftGo",
+		Topics:       []string{"Go"},
+		City:         "Lyon",
+		StartDate:    "2036-11-10T23:00:00Z",
+		EndDate:      "2036-11-10T23:00:00Z",
+		MaxAttendees: "5",
+		Status:       ud859.StatusDraft,
+	}
+
+	w, err := c.doID("/ConferenceAPI.CreateConference", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// decode the conference created
+	created := new(ud859.ConferenceCreated)
+	err = json.NewDecoder(w.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &ud859.ConferenceKeyForm{WebsafeKey: created.WebsafeKey}
+
+	// the draft is not listed, nor open for registration
+	verifyListed(c, t, 2)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", key, http.StatusConflict)
+
+	status := func(s string) *ud859.ConferenceStatusForm {
+		return &ud859.ConferenceStatusForm{WebsafeKey: created.WebsafeKey, Status: s}
+	}
+
+	// only the organizer changes the status
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.SetConferenceStatus",
+		status(ud859.StatusPublished), http.StatusForbidden)
+
+	// publish
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.SetConferenceStatus",
+		status(ud859.StatusPublished), http.StatusOK)
+	verifyListed(c, t, 3)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.SetConferenceStatus",
+		status(ud859.StatusDraft), http.StatusConflict)
+
+	// cancel
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.SetConferenceStatus",
+		status(ud859.StatusCancelled), http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CancelConference", key, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", key, http.StatusConflict)
+
+	// archive the ended conferences
+	past := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:      "pastGo",
+		StartDate: "2016-11-10T23:00:00Z",
+		EndDate:   "2016-11-10T23:00:00Z",
+	})
+
+	w, err = c.get("/tasks/archive_conferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	verifyStatus(c, t, past, ud859.StatusArchived)
+	verifyStatus(c, t, key, ud859.StatusCancelled)
+}
+
+func verifyStatus(c *client, t *testing.T, key *ud859.ConferenceKeyForm, status string) {
+	w, err := c.do("/ConferenceAPI.GetConference", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conference := new(ud859.Conference)
+	err = json.NewDecoder(w.Body).Decode(conference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conference.Status != status {
+		t.Errorf("%s got:%s, want:%s", conference.Name, conference.Status, status)
+	}
+}
+
+// createConferenceForm creates a conference and returns its key.
+func createConferenceForm(c *client, t *testing.T, form *ud859.ConferenceForm) *ud859.ConferenceKeyForm {
+	w, err := c.doID("/ConferenceAPI.CreateConference", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// decode the conference created
+	created := new(ud859.ConferenceCreated)
+	err = json.NewDecoder(w.Body).Decode(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ud859.ConferenceKeyForm{WebsafeKey: created.WebsafeKey}
+}
+
+// registration window
+
+func registrationWindow(c *client, t *testing.T) {
+	later := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:             "laterGo",
+		StartDate:        "2036-12-10T23:00:00Z",
+		EndDate:          "2036-12-10T23:00:00Z",
+		RegistrationOpen: "2035-01-01T00:00:00Z",
+		MaxAttendees:     "5",
+	})
+	closed := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:              "closedGo",
+		StartDate:         "2036-12-10T23:00:00Z",
+		EndDate:           "2036-12-10T23:00:00Z",
+		RegistrationOpen:  "2000-01-01T00:00:00Z",
+		RegistrationClose: "2001-01-01T00:00:00Z",
+		MaxAttendees:      "5",
+	})
+	strict := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:                 "strictGo",
+		StartDate:            "2036-12-10T23:00:00Z",
+		EndDate:              "2036-12-10T23:00:00Z",
+		CancellationDeadline: "2001-01-01T00:00:00Z",
+		MaxAttendees:         "5",
+	})
+
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", later, http.StatusConflict)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", closed, http.StatusConflict)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", strict, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CancelConference", strict, http.StatusConflict)
+
+	// the registration closes before it opens
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CreateConference", &ud859.ConferenceForm{
+		Name:              "invalidGo",
+		RegistrationOpen:  "2001-01-01T00:00:00Z",
+		RegistrationClose: "2000-01-01T00:00:00Z",
+	}, http.StatusBadRequest)
+
+	// query the conferences open for registration
+	w, err := c.do("/ConferenceAPI.QueryConferences", &ud859.ConferenceQueryForm{RegistrationOpen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// decode the conferences
+	conferences := new(ud859.Conferences)
+	err = json.NewDecoder(w.Body).Decode(conferences)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, conference := range conferences.Items {
+		names = append(names, conference.Name)
+	}
+	expected := []string{"gophercon", "dotGo", "strictGo"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got:%v, want:%v", names, expected)
+	}
+}
+
+// ticket types
+
+func ticketTypes(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:      "ticketGo",
+		StartDate: "2036-12-10T23:00:00Z",
+		EndDate:   "2036-12-10T23:00:00Z",
+		Tickets: []*ud859.TicketForm{
+			{Type: ud859.TicketStudent, Capacity: 1},
+			{Type: ud859.TicketRegular, Capacity: 1},
+		},
+	})
+	student := &ud859.RegistrationForm{WebsafeKey: key.WebsafeKey, Ticket: ud859.TicketStudent}
+	speaker := &ud859.RegistrationForm{WebsafeKey: key.WebsafeKey, Ticket: ud859.TicketSpeaker}
+	regular := &ud859.RegistrationForm{WebsafeKey: key.WebsafeKey}
+
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", student, http.StatusOK)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", student, http.StatusConflict)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", speaker, http.StatusBadRequest)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", regular, http.StatusOK)
+
+	verifyTickets(c, t, key, []ud859.Ticket{
+		{Type: ud859.TicketRegular, Capacity: 1, SeatsAvailable: 0},
+		{Type: ud859.TicketStudent, Capacity: 1, SeatsAvailable: 0},
+	})
+
+	// the student seat is given back
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CancelConference", key, http.StatusOK)
+	verifyTickets(c, t, key, []ud859.Ticket{
+		{Type: ud859.TicketRegular, Capacity: 1, SeatsAvailable: 0},
+		{Type: ud859.TicketStudent, Capacity: 1, SeatsAvailable: 1},
+	})
+
+	// query the conferences having student seats
+	w, err := c.do("/ConferenceAPI.QueryConferences", &ud859.ConferenceQueryForm{
+		Filters: []*ud859.Filter{
+			{Field: "SEATS_STUDENT", Op: ud859.GT, Value: 0},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// decode the conferences
+	conferences := new(ud859.Conferences)
+	err = json.NewDecoder(w.Body).Decode(conferences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conferences.Items) != 1 || conferences.Items[0].Name != "ticketGo" {
+		t.Errorf("got:%v, want:[ticketGo]", conferences.Items)
+	}
+
+	// the tickets capacity differs from the max attendees
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CreateConference", &ud859.ConferenceForm{
+		Name:         "invalidGo",
+		MaxAttendees: "3",
+		Tickets:      []*ud859.TicketForm{{Type: ud859.TicketRegular, Capacity: 1}},
+	}, http.StatusBadRequest)
+}
+
+// payments
+
+func paidRegistration(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:      "paidGo",
+		StartDate: "2036-12-10T23:00:00Z",
+		EndDate:   "2036-12-10T23:00:00Z",
+		Currency:  "eur",
+		Tickets: []*ud859.TicketForm{
+			{Type: ud859.TicketRegular, Capacity: 1, Price: 5000},
+		},
+	})
+	form := &ud859.RegistrationForm{WebsafeKey: key.WebsafeKey}
+
+	// the payment is required
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", form, http.StatusConflict)
+
+	// hold the seat
+	w, err := c.doID("/ConferenceAPI.CheckoutConference", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	checkout := new(ud859.Checkout)
+	err = json.NewDecoder(w.Body).Decode(checkout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkout.PaymentID == "" || checkout.Amount != 5000 || checkout.Currency != "EUR" {
+		t.Errorf("got:%+v, want:5000 EUR", checkout)
+	}
+
+	// the seat is held
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.CheckoutConference", form, http.StatusConflict)
+	verifyTickets(c, t, key, []ud859.Ticket{
+		{Type: ud859.TicketRegular, Capacity: 1, SeatsAvailable: 0, Price: 5000},
+	})
+
+	// the holds are released once expired
+	w, err = c.get("/tasks/release_holds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// confirm the payment
+	form.PaymentToken = "tok_declined"
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", form, http.StatusConflict)
+	form.PaymentToken = "tok_visa"
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", form, http.StatusOK)
+	verifyTickets(c, t, key, []ud859.Ticket{
+		{Type: ud859.TicketRegular, Capacity: 1, SeatsAvailable: 0, Price: 5000},
+	})
+
+	// the invoice of the payment
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GetInvoice", key, http.StatusNotFound)
+	w, err = c.doID("/ConferenceAPI.GetInvoice", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	invoice := new(ud859.Invoice)
+	err = json.NewDecoder(w.Body).Decode(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.Number != 1 || invoice.Amount != 5000 || invoice.PaymentID != checkout.PaymentID {
+		t.Errorf("got:%d %d %s, want:1 5000 %s", invoice.Number, invoice.Amount, invoice.PaymentID, checkout.PaymentID)
+	}
+	if !strings.Contains(invoice.HTML, "50.00 EUR") || !bytes.HasPrefix(invoice.PDF, []byte("%PDF-")) {
+		t.Errorf("got:%s, want an HTML and a PDF invoice", invoice.HTML)
+	}
+
+	// the payment is refunded
+	verifyRefund(c, t, key, 5000)
+	verifyTickets(c, t, key, []ud859.Ticket{
+		{Type: ud859.TicketRegular, Capacity: 1, SeatsAvailable: 1, Price: 5000},
+	})
+}
+
+// refund policies
+
+func refundPolicy(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:      "policyGo",
+		StartDate: "2036-12-10T23:00:00Z",
+		EndDate:   "2036-12-10T23:00:00Z",
+		Tickets: []*ud859.TicketForm{
+			{Type: ud859.TicketRegular, Capacity: 1, Price: 1000},
+		},
+		RefundPolicy: []*ud859.RefundRuleForm{
+			{Until: "2001-01-01T00:00:00Z", Percent: 100},
+			{Until: "2036-01-01T00:00:00Z", Percent: 50},
+		},
+	})
+	form := &ud859.RegistrationForm{WebsafeKey: key.WebsafeKey, PaymentToken: "tok_visa"}
+
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CheckoutConference", form, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", form, http.StatusOK)
+	verifyRefund(c, t, key, 500)
+
+	// the rules refund less and less
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CreateConference", &ud859.ConferenceForm{
+		Name: "invalidGo",
+		RefundPolicy: []*ud859.RefundRuleForm{
+			{Until: "2001-01-01T00:00:00Z", Percent: 50},
+			{Until: "2036-01-01T00:00:00Z", Percent: 100},
+		},
+	}, http.StatusBadRequest)
+}
+
+// transfer
+
+func transferRegistration(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:         "transferGo",
+		StartDate:    "2036-12-10T23:00:00Z",
+		EndDate:      "2036-12-10T23:00:00Z",
+		MaxAttendees: "2",
+	})
+	transfer := &ud859.TransferForm{WebsafeKey: key.WebsafeKey, Email: "carol@email"}
+
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.TransferRegistration", transfer, http.StatusConflict)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.TransferRegistration", &ud859.TransferForm{
+		WebsafeKey: key.WebsafeKey, Email: emailTest,
+	}, http.StatusBadRequest)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.TransferRegistration", transfer, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.TransferRegistration", transfer, http.StatusConflict)
+
+	// the seat is not released
+	w, err := c.do("/ConferenceAPI.GetConference", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conference := new(ud859.Conference)
+	err = json.NewDecoder(w.Body).Decode(conference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conference.SeatsAvailable != 1 {
+		t.Errorf("got:%d, want:%d", conference.SeatsAvailable, 1)
+	}
+
+	// the profile of the recipient is pending
+	w, err = c.doAs("carol@email", "/ConferenceAPI.GetProfile", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := new(ud859.Profile)
+	err = json.NewDecoder(w.Body).Decode(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !profile.Pending || !profile.IsRegistered(key.WebsafeKey) {
+		t.Errorf("got:%+v, want a pending profile registered to %s", profile, conference.Name)
+	}
+
+	// the recipient holds the registration
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CancelConference", key, http.StatusConflict)
+	verifyStatusCode(c, t, "carol@email", "/ConferenceAPI.CancelConference", key, http.StatusOK)
+}
+
+// group registration
+
+func groupRegistration(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:         "groupGo",
+		StartDate:    "2036-12-10T23:00:00Z",
+		EndDate:      "2036-12-10T23:00:00Z",
+		MaxAttendees: "3",
+	})
+
+	// all or none of the seats are reserved
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey,
+		Attendees:  []string{"dave@email", "erin@email", "frank@email", "gus@email"},
+	}, http.StatusConflict)
+	verifyGroup(c, t, key, nil)
+
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey,
+		Attendees:  []string{emailTest, "dave@email", "erin@email"},
+	}, http.StatusOK)
+	verifyGroup(c, t, key, []string{emailTest, "dave@email", "erin@email"})
+
+	// the booker manages the seats of the group
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.CancelConference", &ud859.CancellationForm{
+		WebsafeKey: key.WebsafeKey, Attendee: "erin@email",
+	}, http.StatusForbidden)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CancelConference", &ud859.CancellationForm{
+		WebsafeKey: key.WebsafeKey, Attendee: "erin@email",
+	}, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.TransferRegistration", &ud859.TransferForm{
+		WebsafeKey: key.WebsafeKey, From: "dave@email", Email: "frank@email",
+	}, http.StatusOK)
+	verifyGroup(c, t, key, []string{emailTest, "frank@email"})
+}
+
+// invitations
+
+func invitations(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:         "privateGo",
+		City:         "Nantes",
+		StartDate:    "2036-12-10T23:00:00Z",
+		EndDate:      "2036-12-10T23:00:00Z",
+		MaxAttendees: "5",
+		Visibility:   ud859.VisibilityInviteOnly,
+	})
+
+	// the conference is not listed
+	w, err := c.do("/ConferenceAPI.QueryConferences", &ud859.ConferenceQueryForm{
+		Filters: []*ud859.Filter{{Field: ud859.City, Op: ud859.EQ, Value: "Nantes"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conferences := new(ud859.Conferences)
+	err = json.NewDecoder(w.Body).Decode(conferences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conferences.Items) != 0 {
+		t.Errorf("got:%v, want:[]", conferences.Items)
+	}
+
+	// only the organizer invites
+	form := &ud859.InvitationForm{WebsafeKey: key.WebsafeKey, Emails: []string{"alice@email", "carol@email"}}
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.InviteAttendees", form, http.StatusForbidden)
+	w, err = c.doID("/ConferenceAPI.InviteAttendees", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	invitations := new(ud859.Invitations)
+	err = json.NewDecoder(w.Body).Decode(invitations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invitations.Items) != 2 || invitations.Items[1].Token == "" {
+		t.Fatalf("got:%v, want 2 invitations", invitations.Items)
+	}
+	token := invitations.Items[1].Token
+
+	// the invitees register by email or by token, once
+	verifyStatusCode(c, t, "dave@email", "/ConferenceAPI.GotoConference", key, http.StatusForbidden)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	verifyStatusCode(c, t, "dave@email", "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey, Invitation: token,
+	}, http.StatusOK)
+	verifyStatusCode(c, t, "erin@email", "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey, Invitation: token,
+	}, http.StatusForbidden)
+
+	// a revoked invitation is not valid
+	revocation := &ud859.RevocationForm{WebsafeKey: key.WebsafeKey, Email: "carol@email"}
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.RevokeInvitation", revocation, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.RevokeInvitation", revocation, http.StatusNotFound)
+	verifyStatusCode(c, t, "carol@email", "/ConferenceAPI.GotoConference", key, http.StatusForbidden)
+
+	w, err = c.doID("/ConferenceAPI.Invitations", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitations = new(ud859.Invitations)
+	err = json.NewDecoder(w.Body).Decode(invitations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invitations.Items) != 1 || !invitations.Items[0].Used {
+		t.Errorf("got:%v, want the used invitation of alice", invitations.Items)
+	}
+}
+
+// approval
+
+func approvalWorkflow(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:             "approvalGo",
+		StartDate:        "2036-12-10T23:00:00Z",
+		EndDate:          "2036-12-10T23:00:00Z",
+		MaxAttendees:     "1",
+		ApprovalRequired: true,
+	})
+
+	// the applications hold no seat
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	verifyStatusCode(c, t, "carol@email", "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	verifyStatusCode(c, t, "dave@email", "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", key, http.StatusConflict)
+	verifyApplication(c, t, "alice@email", key, ud859.ApplicationPending)
+	verifyTickets(c, t, key, []ud859.Ticket{{Type: ud859.TicketRegular, Capacity: 1, SeatsAvailable: 1}})
+
+	// only the organizer decides
+	decision := func(email string) *ud859.ApplicationForm {
+		return &ud859.ApplicationForm{WebsafeKey: key.WebsafeKey, Email: email}
+	}
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.ApproveApplication",
+		decision("alice@email"), http.StatusForbidden)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.ApproveApplication",
+		decision("alice@email"), http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.ApproveApplication",
+		decision("carol@email"), http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.RejectApplication",
+		decision("dave@email"), http.StatusOK)
+	verifyApplication(c, t, "alice@email", key, ud859.ApplicationApproved)
+	verifyApplication(c, t, "carol@email", key, ud859.ApplicationWaitlisted)
+	verifyApplication(c, t, "dave@email", key, ud859.ApplicationRejected)
+	verifyTickets(c, t, key, []ud859.Ticket{{Type: ud859.TicketRegular, Capacity: 1, SeatsAvailable: 0}})
+
+	// the application is found whatever the case of the email
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.RejectApplication",
+		decision("Dave@Email"), http.StatusConflict)
+
+	// the waitlisted application is registered when a seat is given back
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.ApproveApplication",
+		decision("carol@email"), http.StatusConflict)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.CancelConference", key, http.StatusOK)
+	verifyApplication(c, t, "carol@email", key, ud859.ApplicationApproved)
+	verifyTickets(c, t, key, []ud859.Ticket{{Type: ud859.TicketRegular, Capacity: 1, SeatsAvailable: 0}})
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.ApproveApplication",
+		decision("carol@email"), http.StatusConflict)
+	verifyStatusCode(c, t, "dave@email", "/ConferenceAPI.GotoConference", key, http.StatusConflict)
+
+	// the approval is not supported with paid tickets
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CreateConference", &ud859.ConferenceForm{
+		Name:             "paidApprovalGo",
+		Tickets:          []*ud859.TicketForm{{Type: ud859.TicketRegular, Capacity: 1, Price: 1000}},
+		ApprovalRequired: true,
+	}, http.StatusBadRequest)
+}
+
+// questions
+
+func registrationQuestions(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:         "questionsGo",
+		StartDate:    "2036-12-10T23:00:00Z",
+		EndDate:      "2036-12-10T23:00:00Z",
+		MaxAttendees: "5",
+		Questions: []*ud859.QuestionForm{
+			{Text: "Company"},
+			{Text: "Diet", Type: ud859.QuestionSingleChoice, Choices: []string{"Vegan", "None"}, Required: true},
+		},
+	})
+
+	// the required question is answered with a valid choice
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", key, http.StatusBadRequest)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey,
+		Answers:    []*ud859.AnswerForm{{QuestionID: 2, Choices: []string{"Paleo"}}},
+	}, http.StatusBadRequest)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey,
+		Answers: []*ud859.AnswerForm{
+			{QuestionID: 1, Text: "Google"},
+			{QuestionID: 2, Choices: []string{"Vegan"}},
+		},
+	}, http.StatusOK)
+	verifyStatusCode(c, t, "carol@email", "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey,
+		Answers:    []*ud859.AnswerForm{{QuestionID: 2, Choices: []string{"Vegan"}}},
+	}, http.StatusOK)
+
+	// the roster counts the choices
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GetRoster", key, http.StatusForbidden)
+	w, err := c.doID("/ConferenceAPI.GetRoster", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	roster := new(ud859.Roster)
+	err = json.NewDecoder(w.Body).Decode(roster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roster.Attendees) != 2 || len(roster.Questions) != 2 {
+		t.Fatalf("got:%d attendees %d questions, want:2 2", len(roster.Attendees), len(roster.Questions))
+	}
+	diet := roster.Questions[1]
+	if diet.Answered != 2 || len(diet.Counts) != 2 || diet.Counts[0].Count != 2 || diet.Counts[1].Count != 0 {
+		t.Errorf("got:%+v, want 2 vegan answers", diet)
+	}
+}
+
+func ticketCheckIn(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:         "checkInGo",
+		StartDate:    "2036-12-11T23:00:00Z",
+		EndDate:      "2036-12-11T23:00:00Z",
+		MaxAttendees: "5",
+	})
+
+	// the ticket of a registered attendee
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GetTicketToken", key, http.StatusConflict)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	w, err := c.doAs("alice@email", "/ConferenceAPI.GetTicketToken", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	ticket := new(ud859.TicketToken)
+	err = json.NewDecoder(w.Body).Decode(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Token == "" || len(ticket.QRCode) == 0 {
+		t.Fatalf("got:%+v, want a token and a QR code", ticket)
+	}
+
+	// the organizer checks in the ticket once
+	form := &ud859.CheckInForm{WebsafeKey: key.WebsafeKey, Token: ticket.Token}
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.CheckIn", form, http.StatusForbidden)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.CheckIn", &ud859.CheckInForm{
+		WebsafeKey: key.WebsafeKey,
+		Token:      ticket.Token + "A",
+	}, http.StatusForbidden)
+	w, err = c.doID("/ConferenceAPI.CheckIn", &ud859.CheckInForm{
+		WebsafeKey: key.WebsafeKey,
+		Token:      ticket.Token[:len(ticket.Token)-2] + "AA",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got:%d, want:%d", w.Code, http.StatusBadRequest)
+	}
+	w, err = c.doID("/ConferenceAPI.CheckIn", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	checkIn := new(ud859.CheckIn)
+	err = json.NewDecoder(w.Body).Decode(checkIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkIn.Email != "alice@email" || checkIn.Ticket != ud859.TicketRegular {
+		t.Errorf("got:%+v, want the regular ticket of alice", checkIn)
+	}
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CheckIn", form, http.StatusConflict)
+
+	// a checked in registration is not transferred
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.TransferRegistration", &ud859.TransferForm{
+		WebsafeKey: key.WebsafeKey, Email: "dave@email",
+	}, http.StatusConflict)
+
+	// a cancelled registration is no longer checked in
+	verifyStatusCode(c, t, "carol@email", "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	w, err = c.doAs("carol@email", "/ConferenceAPI.GetTicketToken", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(w.Body).Decode(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyStatusCode(c, t, "carol@email", "/ConferenceAPI.CancelConference", key, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CheckIn", &ud859.CheckInForm{
+		WebsafeKey: key.WebsafeKey,
+		Token:      ticket.Token,
+	}, http.StatusConflict)
+
+	// nor at a cancelled conference
+	verifyStatusCode(c, t, "dave@email", "/ConferenceAPI.GotoConference", key, http.StatusOK)
+	w, err = c.doAs("dave@email", "/ConferenceAPI.GetTicketToken", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(w.Body).Decode(ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.SetConferenceStatus", &ud859.ConferenceStatusForm{
+		WebsafeKey: key.WebsafeKey, Status: ud859.StatusCancelled,
+	}, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CheckIn", &ud859.CheckInForm{
+		WebsafeKey: key.WebsafeKey,
+		Token:      ticket.Token,
+	}, http.StatusConflict)
+}
+
+func verifyApplication(c *client, t *testing.T, email string, key *ud859.ConferenceKeyForm, status string) {
+	w, err := c.doAs(email, "/ConferenceAPI.GetApplication", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	application := new(ud859.Application)
+	err = json.NewDecoder(w.Body).Decode(application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if application.Status != status {
+		t.Errorf("got:%s, want:%s", application.Status, status)
+	}
+}
+
+func verifyGroup(c *client, t *testing.T, key *ud859.ConferenceKeyForm, emails []string) {
+	w, err := c.doID("/ConferenceAPI.GroupRegistrations", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	seats := new(ud859.GroupSeats)
+	err = json.NewDecoder(w.Body).Decode(seats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	for _, seat := range seats.Items {
+		got[seat.Email] = true
+	}
+	want := make(map[string]bool)
+	for _, email := range emails {
+		want[email] = true
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:%v, want:%v", got, want)
+	}
+}
+
+func verifyRefund(c *client, t *testing.T, key *ud859.ConferenceKeyForm, refund int64) {
+	w, err := c.doID("/ConferenceAPI.CancelConference", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	cancellation := new(ud859.Cancellation)
+	err = json.NewDecoder(w.Body).Decode(cancellation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancellation.Refund != refund {
+		t.Errorf("got:%d, want:%d", cancellation.Refund, refund)
+	}
+}
+
+// promo codes
+
+func promoCodes(c *client, t *testing.T) {
+	key := createConferenceForm(c, t, &ud859.ConferenceForm{
+		Name:      "promoGo",
+		StartDate: "2036-12-10T23:00:00Z",
+		EndDate:   "2036-12-10T23:00:00Z",
+		Tickets: []*ud859.TicketForm{
+			{Type: ud859.TicketRegular, Capacity: 5, Price: 1000},
+		},
+	})
+
+	free := &ud859.PromoCodeForm{WebsafeKey: key.WebsafeKey, Code: "free", Percent: 100, MaxUses: 1}
+	early := &ud859.PromoCodeForm{WebsafeKey: key.WebsafeKey, Code: "EARLY", Percent: 20,
+		ValidUntil: "2036-01-01T00:00:00Z"}
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CreatePromoCode", free, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CreatePromoCode", early, http.StatusOK)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CreatePromoCode", free, http.StatusConflict)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.CreatePromoCode", &ud859.PromoCodeForm{
+		WebsafeKey: key.WebsafeKey, Code: "ALICE", Amount: 100,
+	}, http.StatusForbidden)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CreatePromoCode", &ud859.PromoCodeForm{
+		WebsafeKey: key.WebsafeKey, Code: "BOTH", Percent: 10, Amount: 100,
+	}, http.StatusBadRequest)
+
+	// the free code is used once, without checkout
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.CheckoutConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey, PromoCode: "FREE",
+	}, http.StatusBadRequest)
+	verifyStatusCode(c, t, emailTest, "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey, PromoCode: "FREE",
+	}, http.StatusOK)
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.GotoConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey, PromoCode: "free",
+	}, http.StatusConflict)
+
+	// the early code discounts the checkout
+	w, err := c.doAs("alice@email", "/ConferenceAPI.CheckoutConference", &ud859.RegistrationForm{
+		WebsafeKey: key.WebsafeKey, PromoCode: "early",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	checkout := new(ud859.Checkout)
+	err = json.NewDecoder(w.Body).Decode(checkout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkout.Amount != 800 || checkout.Currency != "USD" {
+		t.Errorf("got:%d %s, want:800 USD", checkout.Amount, checkout.Currency)
+	}
+
+	// the redemption stats
+	verifyStatusCode(c, t, "alice@email", "/ConferenceAPI.PromoCodes", key, http.StatusForbidden)
+	w, err = c.doID("/ConferenceAPI.PromoCodes", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+	promos := new(ud859.PromoCodes)
+	err = json.NewDecoder(w.Body).Decode(promos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := make(map[string][2]int64)
+	for _, promo := range promos.Items {
+		stats[promo.Code] = [2]int64{int64(promo.Uses), promo.Discounted}
+	}
+	expected := map[string][2]int64{"EARLY": {1, 200}, "FREE": {1, 1000}}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("got:%v, want:%v", stats, expected)
+	}
+}
+
+func verifyTickets(c *client, t *testing.T, key *ud859.ConferenceKeyForm, tickets []ud859.Ticket) {
+	w, err := c.do("/ConferenceAPI.GetConference", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conference := new(ud859.Conference)
+	err = json.NewDecoder(w.Body).Decode(conference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conference.Tickets, tickets) {
+		t.Errorf("got:%v, want:%v", conference.Tickets, tickets)
+	}
+}
+
+func verifyListed(c *client, t *testing.T, count int) {
+	w, err := c.do("/ConferenceAPI.QueryConferences", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("got:%d, want:%d", w.Code, http.StatusOK)
+	}
+
+	// decode the conferences
+	conferences := new(ud859.Conferences)
+	err = json.NewDecoder(w.Body).Decode(conferences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conferences.Items) != count {
+		t.Errorf("got:%d, want:%d", len(conferences.Items), count)
+	}
+}
+
+func verifyStatusCode(c *client, t *testing.T, email, url string, v interface{}, code int) {
+	w, err := c.doAs(email, url, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != code {
+		t.Errorf("%s got:%d, want:%d", url, w.Code, code)
+	}
+}
@@ -0,0 +1,89 @@
+package ud859
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/search"
+)
+
+// Sort orders of the conferences, a '-' prefix sorts in descending order.
+const (
+	SortStartDate      = "START_DATE"
+	SortStartDateDesc  = "-START_DATE"
+	SortSeatsAvailable = "-SEATS_AVAILABLE"
+	SortName           = "NAME"
+	SortCreated        = "-CREATED"
+	// SortRelevance ranks the conferences by the frequency of the searched terms.
+	SortRelevance = "RELEVANCE"
+	// SortDistance sorts the conferences by distance from the Near location.
+	SortDistance = "DISTANCE"
+)
+
+// sortOrder defines how the search index and the datastore sort the conferences.
+type sortOrder struct {
+	// expr is the sort expression of the search index.
+	expr       string
+	ascending  bool
+	defaultVal interface{}
+	// property is the order of the datastore.
+	property string
+	// scored orders by relevance, which only the search index knows.
+	scored bool
+	// distance orders by distance from the Near location.
+	distance bool
+	// backfill is true when the property is indexed only once the conferences are backfilled.
+	backfill bool
+}
+
+// the documents missing the field of the sort expression come last.
+var sortOrders = map[string]sortOrder{
+	SortStartDate:      {expr: StartDate, ascending: true, defaultVal: sortDate(maxDate), property: "START_DATE"},
+	SortStartDateDesc:  {expr: StartDate, defaultVal: sortDate(minDate), property: "-START_DATE"},
+	SortSeatsAvailable: {expr: SeatsAvailable, defaultVal: 0.0, property: "-SeatsAvailable", backfill: true},
+	SortName:           {expr: Name, ascending: true, defaultVal: "\uffff", property: "Name", backfill: true},
+	SortCreated:        {expr: Created, defaultVal: sortDate(minDate), property: "-CREATED", backfill: true},
+	SortRelevance:      {expr: "_score", defaultVal: 0.0, property: "START_DATE", scored: true},
+	SortDistance:       {expr: Location, ascending: true, defaultVal: 2 * math.Pi * earthRadius, property: "START_DATE", distance: true},
+}
+
+var (
+	minDate = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxDate = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+)
+
+// sortDate returns the default of a date sort expression,
+// the search index sorts the dates as milliseconds since the epoch.
+func sortDate(t time.Time) string {
+	return strconv.FormatInt(t.Unix()*1000, 10)
+}
+
+// order returns the sortOrder of the ConferenceQueryForm.
+func (q ConferenceQueryForm) order() sortOrder {
+	if order, ok := sortOrders[q.Sort]; ok {
+		return order
+	}
+	return sortOrders[SortStartDate]
+}
+
+// sortOptions returns the sort options of the search index.
+func (q ConferenceQueryForm) sortOptions() *search.SortOptions {
+	o := q.order()
+
+	expr := o.expr
+	if o.distance {
+		expr = q.Near.distance()
+	}
+
+	options := &search.SortOptions{
+		Expressions: []search.SortExpression{
+			// Reverse sorts in ascending order
+			{Expr: expr, Reverse: o.ascending, Default: o.defaultVal},
+		},
+	}
+	if o.scored {
+		options.Scorer = search.MatchScorer
+	}
+	return options
+}
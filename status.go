@@ -0,0 +1,262 @@
+package ud859
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+const archiveBatchSize = 50
+
+// Conference statuses.
+const (
+	// StatusDraft is neither searchable nor open for registration.
+	StatusDraft     = "DRAFT"
+	StatusPublished = "PUBLISHED"
+	StatusCancelled = "CANCELLED"
+	// StatusArchived is the status of the ended conferences.
+	StatusArchived = "ARCHIVED"
+)
+
+// statusTransitions lists the statuses allowed after a status.
+var statusTransitions = map[string][]string{
+	StatusDraft:     {StatusPublished, StatusCancelled},
+	StatusPublished: {StatusCancelled, StatusArchived},
+	StatusCancelled: {StatusArchived},
+}
+
+// ConferenceStatusForm changes the status of a conference.
+type ConferenceStatusForm struct {
+	WebsafeKey string `json:"websafeConferenceKey" endpoints:"req"`
+	Status     string `json:"status" endpoints:"req"`
+}
+
+func init() {
+	http.HandleFunc("/tasks/archive_conferences", archiveConferences)
+
+	subscribe("cancellation", cancellationSubscriber, EventConferenceCancelled)
+}
+
+// status returns the status of the conference, the conferences created
+// before the statuses are published.
+func (conference *Conference) status() string {
+	if conference.Status == "" {
+		return StatusPublished
+	}
+	return conference.Status
+}
+
+// ended returns true if the conference has ended at now, a day after it starts without EndDate.
+func (conference *Conference) ended(now time.Time) bool {
+	end := conference.EndDate
+	if end.IsZero() {
+		end = conference.StartDate.AddDate(0, 0, 1)
+	}
+	return !end.After(now)
+}
+
+// canTransition returns true if the conference may change to status.
+func (conference *Conference) canTransition(status string) bool {
+	for _, next := range statusTransitions[conference.status()] {
+		if next == status {
+			return true
+		}
+	}
+	return false
+}
+
+// SetConferenceStatus changes the status of a conference created by the current user.
+func (ConferenceAPI) SetConferenceStatus(c context.Context, form *ConferenceStatusForm) error {
+	pid, err := profileID(c)
+	if err != nil {
+		return err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return errBadRequest(err, "invalid conference key")
+	}
+	if !ckey.Parent().Equal(pid.key) {
+		return errForbidden("not the organizer of the conference")
+	}
+
+	_, err = transitConference(c, ckey, form.Status)
+	return err
+}
+
+// transitConference changes the status of the conference and publishes the change.
+func transitConference(c context.Context, ckey *datastore.Key, status string) (*Conference, error) {
+	var conference *Conference
+	var events dispatcher
+
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		var err error
+		conference, err = loadConference(c, ckey)
+		if err != nil {
+			return err
+		}
+
+		if !conference.canTransition(status) {
+			return errConflict(fmt.Sprintf("conference is %s, can not be %s",
+				strings.ToLower(conference.status()), strings.ToLower(status)))
+		}
+
+		conference.Status = status
+		_, err = putConference(c, ckey, conference)
+		if err != nil {
+			return errInternalServer(err, "unable to save conference")
+		}
+
+		// publish the events
+		events = newDispatcher(ckey)
+		events.publish(&Event{
+			Name:          EventConferenceUpdated,
+			ConferenceKey: conference.WebsafeKey,
+		})
+		if status == StatusCancelled {
+			events.publish(&Event{
+				Name:          EventConferenceCancelled,
+				ConferenceKey: conference.WebsafeKey,
+			})
+		}
+
+		err = events.save(c)
+		if err != nil {
+			return errInternalServer(err, "unable to publish event")
+		}
+		return nil
+	}, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the conference
+	cacheConference(c, ckey, conference)
+	events.flush(c)
+	return conference, nil
+}
+
+// cancellationSubscriber notifies the registered attendees of a cancelled conference.
+func cancellationSubscriber(c context.Context, e *Event) error {
+	key, err := datastore.DecodeKey(e.ConferenceKey)
+	if err != nil {
+		return err
+	}
+	conference, err := loadConference(c, key)
+	if err != nil {
+		return err
+	}
+
+	var profiles []*Profile
+	_, err = datastore.NewQuery("Profile").
+		Filter("Conferences =", e.ConferenceKey).
+		GetAll(c, &profiles)
+	if err != nil {
+		return err
+	}
+
+	body, err := conferenceText(conference)
+	if err != nil {
+		return err
+	}
+	for _, profile := range profiles {
+		// one task per attendee, so that a redelivered event sends no duplicate
+		name := taskName("cancellation", e.ConferenceKey, profile.Email)
+		err = sendMail(c, name, profile.Email,
+			"A Conference has been cancelled",
+			"Hi, the following conference has been cancelled:\n"+body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivableStatuses are the statuses of the conferences archived after their EndDate,
+// the conferences saved before the statuses have an empty status once backfilled.
+var archivableStatuses = []string{"", StatusPublished, StatusCancelled}
+
+// anyStatus queries the conferences of any status: their status is not indexed
+// until the conferences saved before the statuses are backfilled.
+const anyStatus = "*"
+
+// archiveConferences archives the conferences after their EndDate.
+func archiveConferences(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	now := time.Now()
+
+	statuses := archivableStatuses
+	if !conferencesBackfilled(c) {
+		statuses = []string{anyStatus}
+	}
+	for _, status := range statuses {
+		if err := archiveBatch(c, status, now, ""); err != nil {
+			log.Errorf(c, "unable to archive conferences: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+var archiveBatchDelay *delay.Function
+
+func init() {
+	// archiveBatch refers to archiveBatchDelay for its continuation
+	archiveBatchDelay = delay.Func("archive_conferences", archiveBatch)
+}
+
+// archiveBatch archives a batch of the ended conferences of the status from the cursor,
+// and chains the next batch through the task queue.
+func archiveBatch(c context.Context, status string, now time.Time, cursor string) error {
+	query := datastore.NewQuery("Conference")
+	if status != anyStatus {
+		query = query.Filter("Status =", status)
+	}
+	// EndDate is not indexed, the conferences end after they start
+	query = query.Filter("START_DATE <", now).Limit(archiveBatchSize)
+
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+		query = query.Start(start)
+	}
+
+	var count int
+	it := query.Run(c)
+	for {
+		conference := new(Conference)
+		key, err := it.Next(conference)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		count++
+
+		if !conference.ended(now) || !conference.canTransition(StatusArchived) {
+			continue
+		}
+		if _, err := transitConference(c, key, StatusArchived); err != nil {
+			log.Errorf(c, "unable to archive conference %s: %v", key.Encode(), err)
+		}
+	}
+
+	if count < archiveBatchSize {
+		return nil
+	}
+	next, err := it.Cursor()
+	if err != nil {
+		return err
+	}
+	return archiveBatchDelay.Call(c, status, now, next.String())
+}
@@ -0,0 +1,34 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConferenceEnded(t *testing.T) {
+	date := func(day, hour int) time.Time {
+		return time.Date(2016, 10, day, hour, 0, 0, 0, time.UTC)
+	}
+
+	tts := []struct {
+		conference Conference
+		now        time.Time
+		ended      bool
+	}{
+		{Conference{StartDate: date(10, 0), EndDate: date(12, 0)}, date(11, 0), false},
+		{Conference{StartDate: date(10, 0), EndDate: date(12, 0)}, date(12, 0), true},
+		// a day after it starts without EndDate
+		{Conference{StartDate: date(10, 0)}, date(10, 12), false},
+		{Conference{StartDate: date(10, 0)}, date(11, 0), true},
+	}
+
+	for _, tt := range tts {
+		if ended := tt.conference.ended(tt.now); ended != tt.ended {
+			t.Errorf("%v-%v at %v got:%t, want:%t",
+				tt.conference.StartDate, tt.conference.EndDate, tt.now, ended, tt.ended)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package ud859
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/search"
+)
+
+// The prefix fields of the conferenceDoc.
+const (
+	NamePrefix  = "NAME_PREFIX"
+	CityPrefix  = "CITY_PREFIX"
+	TopicPrefix = "TOPIC_PREFIX"
+)
+
+const (
+	// maxPrefixLength is the length of the longest indexed prefix of a token.
+	maxPrefixLength = 20
+	// suggestDocuments is the number of the most popular conferences to suggest from.
+	suggestDocuments = 50
+	// suggestLimit is the number of suggestions.
+	suggestLimit = 10
+)
+
+func init() {
+	// the prefix fields are not searchable with the filters
+	for _, field := range []string{NamePrefix, CityPrefix, TopicPrefix} {
+		delete(searchFields, field)
+	}
+}
+
+// SuggestForm is the beginning of a word typed in the search box.
+type SuggestForm struct {
+	Prefix string `json:"prefix" endpoints:"req"`
+}
+
+// Suggestion is the value of a field matching the prefix.
+type Suggestion struct {
+	// Field is one of Name, City or Topics.
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+// Suggestions is a list of Suggestions, the most popular first.
+type Suggestions struct {
+	Items []*Suggestion `json:"items"`
+}
+
+// Suggest returns the conference names, cities and topics starting with the prefix.
+func (ConferenceAPI) Suggest(c context.Context, form *SuggestForm) (*Suggestions, error) {
+	tokens := prefixTokens(form.Prefix)
+	if len(tokens) == 0 {
+		return &Suggestions{Items: make([]*Suggestion, 0)}, nil
+	}
+
+	generation, err := queryGeneration(c)
+	if err != nil {
+		log.Errorf(c, "unable to get cache generation: %v", err)
+		return suggest(c, tokens)
+	}
+	sum := sha1.Sum([]byte(strings.Join(tokens, " ")))
+	key := fmt.Sprintf("SUGGEST:%d:%s", generation, hex.EncodeToString(sum[:]))
+
+	suggestions := new(Suggestions)
+	_, err = memcache.Gob.Get(c, key, suggestions)
+	if err == nil {
+		return suggestions, nil
+	} else if err != memcache.ErrCacheMiss {
+		log.Errorf(c, "unable to get cache: %v", err)
+	}
+
+	suggestions, err = suggest(c, tokens)
+	if err != nil {
+		// the search box works without suggestions
+		log.Warningf(c, "unable to suggest: %v", err)
+		return &Suggestions{Items: make([]*Suggestion, 0)}, nil
+	}
+
+	item := &memcache.Item{
+		Key:        key,
+		Object:     suggestions,
+		Expiration: cacheExpiration,
+	}
+	if err := memcache.Gob.Set(c, item); err != nil {
+		log.Errorf(c, "unable to set cache: %v", err)
+	}
+	return suggestions, nil
+}
+
+// suggest searches the most popular conferences having a field starting with the tokens.
+func suggest(c context.Context, tokens []string) (*Suggestions, error) {
+	if !searchBreaker.allow() {
+		return nil, fmt.Errorf("search index unavailable")
+	}
+
+	index, err := search.Open("Conference")
+	if err != nil {
+		return nil, err
+	}
+
+	c, cancel := context.WithTimeout(c, searchTimeout)
+	defer cancel()
+
+	quoted := make([]string, len(tokens))
+	for i, token := range tokens {
+		quoted[i] = quote(token)
+	}
+	value := "(" + strings.Join(quoted, " ") + ")"
+	query := fmt.Sprintf("%s = %s OR %s = %s OR %s = %s",
+		NamePrefix, value, CityPrefix, value, TopicPrefix, value)
+
+	it := index.Search(c, query, &search.SearchOptions{
+		Limit: suggestDocuments,
+		Sort: &search.SortOptions{
+			Expressions: []search.SortExpression{
+				{Expr: MaxAttendees + " - " + SeatsAvailable, Default: 0.0},
+			},
+		},
+	})
+
+	var conferences []*Conference
+	for {
+		doc := new(conferenceDoc)
+
+		_, err := it.Next(doc)
+		if err == search.Done {
+			break
+		} else if err != nil {
+			if searchUnavailable(err) {
+				searchBreaker.failure()
+			}
+			return nil, err
+		}
+		conferences = append(conferences, fromConferenceDoc(doc))
+	}
+
+	searchBreaker.success()
+	return rankSuggestions(conferences, tokens), nil
+}
+
+// rankSuggestions ranks the values matching the tokens by their count of registrations.
+func rankSuggestions(conferences []*Conference, tokens []string) *Suggestions {
+	var ranked rankedSuggestions
+	index := make(map[Suggestion]int)
+
+	add := func(field, value string, registrations int) {
+		if !matchPrefix(value, tokens) {
+			return
+		}
+		s := Suggestion{field, value}
+		if i, ok := index[s]; ok {
+			ranked[i].registrations += registrations
+			return
+		}
+		index[s] = len(ranked)
+		ranked = append(ranked, &rankedSuggestion{s, registrations, len(ranked)})
+	}
+
+	for _, conference := range conferences {
+		registrations := conference.MaxAttendees - conference.SeatsAvailable
+		add(Name, conference.Name, registrations)
+		add(City, conference.City, registrations)
+		for _, topic := range conference.Topics {
+			add(Topics, topic, registrations)
+		}
+	}
+	sort.Sort(ranked)
+
+	suggestions := &Suggestions{Items: make([]*Suggestion, 0)}
+	for i := 0; i < len(ranked) && i < suggestLimit; i++ {
+		suggestion := ranked[i].Suggestion
+		suggestions.Items = append(suggestions.Items, &suggestion)
+	}
+	return suggestions
+}
+
+type rankedSuggestion struct {
+	Suggestion
+	registrations int
+	order         int
+}
+
+// rankedSuggestions sorts the suggestions by registrations, then in the order of popularity of the conferences.
+type rankedSuggestions []*rankedSuggestion
+
+func (r rankedSuggestions) Len() int      { return len(r) }
+func (r rankedSuggestions) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rankedSuggestions) Less(i, j int) bool {
+	if r[i].registrations != r[j].registrations {
+		return r[i].registrations > r[j].registrations
+	}
+	return r[i].order < r[j].order
+}
+
+// matchPrefix returns true if each token is the prefix of a token of the value.
+func matchPrefix(value string, tokens []string) bool {
+	words := tokenize(value)
+	for _, token := range tokens {
+		found := false
+		for _, word := range words {
+			if strings.HasPrefix(word, token) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixTokens returns the tokens typed, truncated to the longest indexed prefix.
+func prefixTokens(prefix string) []string {
+	tokens := tokenize(prefix)
+	for i, token := range tokens {
+		if runes := []rune(token); len(runes) > maxPrefixLength {
+			tokens[i] = string(runes[:maxPrefixLength])
+		}
+	}
+	return tokens
+}
+
+// prefixes returns the prefixes of the tokens of the values, to be indexed.
+func prefixes(values ...string) string {
+	var prefixes []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, token := range tokenize(value) {
+			runes := []rune(token)
+			for i := 1; i <= len(runes) && i <= maxPrefixLength; i++ {
+				prefix := string(runes[:i])
+				if !seen[prefix] {
+					seen[prefix] = true
+					prefixes = append(prefixes, prefix)
+				}
+			}
+		}
+	}
+	return strings.Join(prefixes, " ")
+}
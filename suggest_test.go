@@ -0,0 +1,54 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrefixes(t *testing.T) {
+	got := prefixes("Go", "Web Go")
+	want := "g go w we web"
+	if got != want {
+		t.Errorf("got:%q, want:%q", got, want)
+	}
+}
+
+func TestPrefixTokens(t *testing.T) {
+	// the long tokens match their longest indexed prefix
+	got := prefixTokens("Go Supercalifragilisticexpialidocious")
+	want := []string{"go", "supercalifragilistic"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:%q, want:%q", got, want)
+	}
+	if !matchPrefix("Supercalifragilisticexpialidocious Go", got) {
+		t.Errorf("%q should match the value", got)
+	}
+}
+
+func TestRankSuggestions(t *testing.T) {
+	// sorted by popularity
+	conferences := []*Conference{
+		{Name: "Gophers Paris", City: "Paris", Topics: []string{"Go"}, MaxAttendees: 10, SeatsAvailable: 2},
+		{Name: "Gopherfest", City: "Paris", Topics: []string{"Go", "Gardening"}, MaxAttendees: 10, SeatsAvailable: 7},
+		{Name: "GolangUK", City: "London", Topics: []string{"Go"}, MaxAttendees: 10, SeatsAvailable: 6},
+	}
+
+	got := rankSuggestions(conferences, []string{"go"})
+	want := []Suggestion{
+		{Topics, "Go"},
+		{Name, "Gophers Paris"},
+		{Name, "GolangUK"},
+		{Name, "Gopherfest"},
+	}
+
+	var items []Suggestion
+	for _, item := range got.Items {
+		items = append(items, *item)
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("got:%v, want:%v", items, want)
+	}
+}
@@ -0,0 +1,188 @@
+package ud859
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ticket types.
+const (
+	TicketRegular = "REGULAR"
+	TicketStudent = "STUDENT"
+	TicketSpeaker = "SPEAKER"
+	TicketSponsor = "SPONSOR"
+)
+
+// ticketTypes lists the ticket types in the order of the tickets of a Conference.
+var ticketTypes = []string{TicketRegular, TicketStudent, TicketSpeaker, TicketSponsor}
+
+// Ticket is the quota of a ticket type of a conference.
+type Ticket struct {
+	Type           string `json:"type"`
+	Capacity       int    `json:"capacity"`
+	SeatsAvailable int    `json:"seatsAvailable"`
+	// Price is in the smallest unit of the currency of the conference, 0 is free.
+	Price int64 `json:"price"`
+}
+
+// TicketForm gives the capacity of a ticket type.
+type TicketForm struct {
+	Type     string `json:"type" endpoints:"req"`
+	Capacity int    `json:"capacity" endpoints:"req"`
+	Price    int64  `json:"price"`
+}
+
+// fromTicketForms creates the tickets of a conference, a regular ticket for all
+// the attendees when the forms are empty.
+func fromTicketForms(forms []*TicketForm, attendees int) ([]Ticket, error) {
+	if len(forms) == 0 {
+		if attendees == 0 {
+			return nil, nil
+		}
+		return []Ticket{{TicketRegular, attendees, attendees, 0}}, nil
+	}
+
+	capacities := make(map[string]int)
+	prices := make(map[string]int64)
+	total := 0
+	for _, form := range forms {
+		if !validTicketType(form.Type) {
+			return nil, fmt.Errorf("invalid ticket type %q", form.Type)
+		}
+		if _, ok := capacities[form.Type]; ok {
+			return nil, fmt.Errorf("duplicate ticket type %s", form.Type)
+		}
+		if form.Capacity <= 0 {
+			return nil, fmt.Errorf("invalid capacity %d of ticket type %s", form.Capacity, form.Type)
+		}
+		if form.Price < 0 {
+			return nil, fmt.Errorf("invalid price %d of ticket type %s", form.Price, form.Type)
+		}
+		capacities[form.Type] = form.Capacity
+		prices[form.Type] = form.Price
+		total += form.Capacity
+	}
+	if attendees != 0 && attendees != total {
+		return nil, fmt.Errorf("max attendees %d differs from the tickets capacity %d", attendees, total)
+	}
+
+	var tickets []Ticket
+	for _, typ := range ticketTypes {
+		if capacity, ok := capacities[typ]; ok {
+			tickets = append(tickets, Ticket{typ, capacity, capacity, prices[typ]})
+		}
+	}
+	return tickets, nil
+}
+
+func validTicketType(typ string) bool {
+	for _, t := range ticketTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// tickets returns the tickets of the conference, the conferences created
+// before the ticket types have a single regular ticket.
+func (conference *Conference) tickets() []Ticket {
+	if conference.Tickets == nil && conference.MaxAttendees > 0 {
+		return []Ticket{{TicketRegular, conference.MaxAttendees, conference.SeatsAvailable, 0}}
+	}
+	return conference.Tickets
+}
+
+// ticket returns the ticket of the type, to be updated.
+func (conference *Conference) ticket(typ string) (*Ticket, error) {
+	if typ == "" {
+		typ = TicketRegular
+	}
+	if !validTicketType(typ) {
+		return nil, errBadRequest(fmt.Errorf("%q", typ), "invalid ticket type")
+	}
+
+	conference.Tickets = conference.tickets()
+	for i := range conference.Tickets {
+		if conference.Tickets[i].Type == typ {
+			return &conference.Tickets[i], nil
+		}
+	}
+	return nil, errBadRequest(fmt.Errorf("%s", typ), "ticket type not offered")
+}
+
+// reserve takes a seat of the ticket type.
+func (conference *Conference) reserve(typ string) error {
+	ticket, err := conference.ticket(typ)
+	if err != nil {
+		return err
+	}
+	if ticket.SeatsAvailable <= 0 {
+		return errConflict("no " + strings.ToLower(ticket.Type) + " seats available")
+	}
+
+	ticket.SeatsAvailable--
+	conference.SeatsAvailable--
+	return nil
+}
+
+// release gives back a seat of the ticket type.
+func (conference *Conference) release(typ string) error {
+	ticket, err := conference.ticket(typ)
+	if err != nil {
+		return err
+	}
+
+	ticket.SeatsAvailable++
+	conference.SeatsAvailable++
+	return nil
+}
+
+// ticketFields returns the fields of the conferenceDoc of a ticket type.
+func (doc *conferenceDoc) ticketFields(typ string) (capacity, seats, price *float64) {
+	switch typ {
+	case TicketRegular:
+		return &doc.CapacityRegular, &doc.SeatsRegular, &doc.PriceRegular
+	case TicketStudent:
+		return &doc.CapacityStudent, &doc.SeatsStudent, &doc.PriceStudent
+	case TicketSpeaker:
+		return &doc.CapacitySpeaker, &doc.SeatsSpeaker, &doc.PriceSpeaker
+	case TicketSponsor:
+		return &doc.CapacitySponsor, &doc.SeatsSponsor, &doc.PriceSponsor
+	}
+	return new(float64), new(float64), new(float64)
+}
+
+// setTickets sets the ticket fields of the conferenceDoc.
+func (doc *conferenceDoc) setTickets(tickets []Ticket) {
+	for _, ticket := range tickets {
+		capacity, seats, price := doc.ticketFields(ticket.Type)
+		*capacity, *seats = float64(ticket.Capacity), float64(ticket.SeatsAvailable)
+		*price = float64(ticket.Price)
+	}
+}
+
+// tickets returns the tickets of the ticket types having a capacity.
+func (doc *conferenceDoc) tickets() []Ticket {
+	var tickets []Ticket
+	for _, typ := range ticketTypes {
+		capacity, seats, price := doc.ticketFields(typ)
+		if *capacity > 0 {
+			tickets = append(tickets, Ticket{typ, int(*capacity), int(*seats), int64(*price)})
+		}
+	}
+	return tickets
+}
+
+// ticketField returns the ticket type of a capacity or seats field of the conferenceDoc.
+func ticketField(field string) (typ string, capacity bool, ok bool) {
+	for _, typ := range ticketTypes {
+		switch field {
+		case "CAPACITY_" + typ:
+			return typ, true, true
+		case "SEATS_" + typ:
+			return typ, false, true
+		}
+	}
+	return "", false, false
+}
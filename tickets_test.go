@@ -0,0 +1,64 @@
+//go:build go1.7
+// +build go1.7
+
+package ud859
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFromTicketForms(t *testing.T) {
+	tts := []struct {
+		forms     []*TicketForm
+		attendees int
+		tickets   []Ticket
+		valid     bool
+	}{
+		{nil, 0, nil, true},
+		{nil, 5, []Ticket{{TicketRegular, 5, 5, 0}}, true},
+		{[]*TicketForm{{TicketSponsor, 2, 0}, {TicketRegular, 3, 0}}, 0,
+			[]Ticket{{TicketRegular, 3, 3, 0}, {TicketSponsor, 2, 2, 0}}, true},
+		{[]*TicketForm{{TicketSponsor, 2, 0}, {TicketRegular, 3, 0}}, 5,
+			[]Ticket{{TicketRegular, 3, 3, 0}, {TicketSponsor, 2, 2, 0}}, true},
+		{[]*TicketForm{{TicketRegular, 3, 0}}, 5, nil, false},
+		{[]*TicketForm{{TicketRegular, 3, 0}, {TicketRegular, 2, 0}}, 0, nil, false},
+		{[]*TicketForm{{TicketStudent, 0, 0}}, 0, nil, false},
+		{[]*TicketForm{{"VIP", 1, 0}}, 0, nil, false},
+		{[]*TicketForm{{TicketStudent, 2, 1500}}, 0, []Ticket{{TicketStudent, 2, 2, 1500}}, true},
+		{[]*TicketForm{{TicketStudent, 2, -1}}, 0, nil, false},
+	}
+
+	for _, tt := range tts {
+		tickets, err := fromTicketForms(tt.forms, tt.attendees)
+		if (err == nil) != tt.valid {
+			t.Errorf("%v got:%v, want valid:%t", tt.forms, err, tt.valid)
+		}
+		if !reflect.DeepEqual(tickets, tt.tickets) {
+			t.Errorf("got:%v, want:%v", tickets, tt.tickets)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	// a conference created before the ticket types
+	conference := &Conference{MaxAttendees: 2, SeatsAvailable: 1}
+
+	if err := conference.reserve(TicketStudent); err == nil {
+		t.Error("reserved a ticket type not offered")
+	}
+	if err := conference.reserve(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := conference.reserve(TicketRegular); err == nil {
+		t.Error("reserved a full ticket type")
+	}
+	if err := conference.release(TicketRegular); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Ticket{{TicketRegular, 2, 1, 0}}
+	if !reflect.DeepEqual(conference.Tickets, want) || conference.SeatsAvailable != 1 {
+		t.Errorf("got:%v %d, want:%v 1", conference.Tickets, conference.SeatsAvailable, want)
+	}
+}
@@ -0,0 +1,238 @@
+package ud859
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// TransferForm transfers the registration of the current user to the conference
+// to the user of the email.
+type TransferForm struct {
+	WebsafeKey string `json:"websafeConferenceKey" endpoints:"req"`
+	Email      string `json:"email" endpoints:"req"`
+	// From is the email of an attendee whose seat has been booked by the current user.
+	From string `json:"from"`
+}
+
+// Transfer records the transfer of a registration. Its key is a child of the conference key.
+type Transfer struct {
+	FromKey *datastore.Key `json:"-"`
+	From    string         `json:"from" datastore:",noindex"`
+	ToKey   *datastore.Key `json:"-"`
+	To      string         `json:"to" datastore:",noindex"`
+	Ticket  string         `json:"ticket" datastore:",noindex"`
+	Created time.Time      `json:"created" datastore:",noindex"`
+}
+
+func init() {
+	subscribe("transfer", transferSubscriber, EventRegistrationTransferred)
+}
+
+// TransferRegistration moves the registration of the current user, or of an attendee
+// of its group, to another user: the seat is not released. The profile of the other
+// user is created when missing. The transfer is allowed until the registration closes
+// or the cancellation deadline, whichever comes first, and not once checked in.
+func (ConferenceAPI) TransferRegistration(c context.Context, form *TransferForm) error {
+	pid, err := profileID(c)
+	if err != nil {
+		return err
+	}
+	ckey, err := datastore.DecodeKey(form.WebsafeKey)
+	if err != nil {
+		return errBadRequest(err, "invalid conference key")
+	}
+
+	holder := pid
+	if form.From != "" {
+		holder, err = emailID(c, pid, form.From)
+		if err != nil {
+			return errBadRequest(err, "invalid email")
+		}
+	}
+	to, err := emailID(c, pid, form.Email)
+	if err != nil {
+		return errBadRequest(err, "invalid email")
+	}
+	if to.key.Equal(holder.key) {
+		return errBadRequest(fmt.Errorf("%s", form.Email), "can not transfer to the same attendee")
+	}
+
+	var from, recipient *Profile
+	var events dispatcher
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		var err error
+		from, err = loadProfile(c, holder)
+		if err != nil {
+			return err
+		}
+		recipient, err = loadProfile(c, to)
+		if err != nil {
+			return err
+		}
+		conference, err := loadConference(c, ckey)
+		if err != nil {
+			return errBadRequest(err, "conference does not exist")
+		}
+
+		if !from.IsRegistered(conference.WebsafeKey) {
+			return errConflict("not registered")
+		}
+		if recipient.IsRegistered(conference.WebsafeKey) {
+			return errConflict("recipient already registered")
+		}
+		// the holder cancels, and the recipient registers
+		now := time.Now()
+		if err := conference.checkRegistration(now); err != nil {
+			return err
+		}
+		if err := conference.checkCancellation(now); err != nil {
+			return err
+		}
+		if conference.ApprovalRequired {
+			return errConflict("registration requires approval")
+		}
+		if err := checkInvitation(c, ckey, conference, to, ""); err != nil {
+			return err
+		}
+
+		// move the registration
+		rkey, registration, err := loadRegistration(c, ckey, holder.key)
+		if err != nil {
+			return err
+		}
+		if err := registration.checkManager(pid); err != nil {
+			return err
+		}
+		if !registration.CheckedIn.IsZero() {
+			return errConflict("already checked in")
+		}
+
+		// a pending checkout holds a seat already
+		tokey := registrationKey(c, ckey, to.key)
+		err = datastore.Get(c, tokey, new(Registration))
+		if err == nil {
+			return errConflict("recipient has a pending checkout")
+		} else if err != datastore.ErrNoSuchEntity {
+			return errInternalServer(err, "unable to get registration")
+		}
+
+		err = datastore.Delete(c, rkey)
+		if err != nil {
+			return errInternalServer(err, "unable to delete registration")
+		}
+		registration.ProfileKey, registration.Email = to.key, to.email
+		// the answers are the ones of the previous holder
+		registration.Answers = nil
+		_, err = datastore.Put(c, tokey, registration)
+		if err != nil {
+			return errInternalServer(err, "unable to save registration")
+		}
+
+		from.unregister(conference.WebsafeKey)
+		_, err = putProfile(c, holder.key, from)
+		if err != nil {
+			return errInternalServer(err, "unable to save profile")
+		}
+		if recipient.Version == 0 {
+			// until its user saves it
+			recipient.Pending = true
+		}
+		recipient.register(conference.WebsafeKey)
+		_, err = putProfile(c, to.key, recipient)
+		if err != nil {
+			return errInternalServer(err, "unable to save profile")
+		}
+
+		// record the transfer
+		transfer := &Transfer{
+			FromKey: holder.key,
+			From:    holder.email,
+			ToKey:   to.key,
+			To:      to.email,
+			Ticket:  registration.Ticket,
+			Created: now,
+		}
+		_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Transfer", ckey), transfer)
+		if err != nil {
+			return errInternalServer(err, "unable to save transfer")
+		}
+
+		// publish the event
+		events = newDispatcher(ckey)
+		events.publish(&Event{
+			Name:          EventRegistrationTransferred,
+			ConferenceKey: conference.WebsafeKey,
+			ProfileKey:    holder.key.Encode(),
+			Email:         holder.email,
+			Recipient:     to.email,
+			RecipientKey:  to.key.Encode(),
+		})
+
+		err = events.save(c)
+		if err != nil {
+			return errInternalServer(err, "unable to publish event")
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+
+	if err != nil {
+		return err
+	}
+
+	// cache the entities
+	cacheProfile(c, holder.key, from)
+	cacheProfile(c, to.key, recipient)
+	events.flush(c)
+	return nil
+}
+
+// transferSubscriber notifies both parties of a transfer.
+func transferSubscriber(c context.Context, e *Event) error {
+	key, err := datastore.DecodeKey(e.ConferenceKey)
+	if err != nil {
+		return err
+	}
+	conference, err := loadConference(c, key)
+	if err != nil {
+		return err
+	}
+
+	body, err := conferenceText(conference)
+	if err != nil {
+		return err
+	}
+
+	// one task per party, so that a redelivered event sends no duplicate
+	transfer := e.Time.String()
+	err = sendMail(c, taskName("transfer", e.ConferenceKey, e.Email, transfer), e.Email,
+		"Your registration has been transferred",
+		"Hi, your registration to the following conference has been transferred to "+e.Recipient+":\n"+body)
+	if err != nil {
+		return err
+	}
+	values := url.Values{
+		"email":   {e.Recipient},
+		"subject": {"A registration has been transferred to you"},
+		"body":    {"Hi, " + e.Email + " has transferred you the registration to the following conference:\n" + body},
+	}
+	if e.RecipientKey != "" {
+		// the events published before the ticket tokens have no RecipientKey
+		pkey, err := datastore.DecodeKey(e.RecipientKey)
+		if err != nil {
+			return err
+		}
+		token, err := signTicket(c, key, pkey)
+		if err != nil {
+			return err
+		}
+		values.Set("body", values.Get("body")+ticketText(token))
+		values.Set("ticket", token)
+	}
+	return queueMail(c, taskName("transfer", e.ConferenceKey, e.Recipient, transfer), values)
+}